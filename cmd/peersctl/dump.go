@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func runDump(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	var conn connFlags
+	conn.register(fs)
+
+	d := &dumper{out: os.Stdout}
+	fs.StringVar(&d.format, "format", "text", "output `format`, text or ndjson")
+	fs.Var(&d.tables, "table", "only dump tables matching the `pattern`, can be repeated")
+	fs.Var(&d.keys, "key", "only dump keys matching the `pattern` or contained in the CIDR prefix, can be repeated")
+	requestSync := fs.Bool("sync", true, "request all entries from HAProxy after connecting")
+	duration := fs.Duration("duration", 0, "stop after `duration`, run until interrupted if zero")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	if d.format != "text" && d.format != "ndjson" {
+		return fmt.Errorf("unknown format %q", d.format)
+	}
+	for _, patterns := range [][]string{d.tables, d.keys} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+		}
+	}
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	return conn.run(ctx, func() peers.Handler {
+		return &dumpSession{dumper: d, sync: *requestSync}
+	})
+}
+
+// dumper writes the updates of all sessions.
+type dumper struct {
+	format string
+	tables listFlag
+	keys   listFlag
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// match reports whether the table and key pass the filters.
+func (d *dumper) match(table string, key sticktable.MapKey) bool {
+	if len(d.tables) > 0 && !matchAny(d.tables, table) {
+		return false
+	}
+	if len(d.keys) == 0 {
+		return true
+	}
+
+	for _, p := range d.keys {
+		if prefix, err := netip.ParsePrefix(p); err == nil {
+			if addr, ok := keyAddr(key); ok && prefix.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, sticktable.FormatKey(key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAddr returns the address of an address key.
+func keyAddr(k sticktable.MapKey) (netip.Addr, bool) {
+	switch k := k.(type) {
+	case *sticktable.IPv4AddressKey:
+		return netip.Addr(*k), true
+	case *sticktable.IPv6AddressKey:
+		return netip.Addr(*k).Unmap(), true
+	case *sticktable.AddressKey:
+		return netip.Addr(*k).Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+func (d *dumper) write(peer string, u *sticktable.EntryUpdate) error {
+	if !d.match(u.StickTable.Name, u.Key) {
+		return nil
+	}
+
+	r := newRecord(u, 0)
+
+	var line []byte
+	if d.format == "ndjson" {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(formatRecord(peer, r))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.out.Write(line)
+	return err
+}
+
+// formatRecord formats the record as a line of the text format.
+func formatRecord(peer string, r record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", peer, r.Table, r.Key)
+	if r.ExpireMS != nil {
+		fmt.Fprintf(&b, " exp=%d", *r.ExpireMS)
+	}
+
+	names := make([]string, 0, len(r.Data))
+	for name := range r.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%s", name, formatText(r.Data[name]))
+	}
+
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// dumpSession is the handler of a single session.
+type dumpSession struct {
+	dumper *dumper
+	sync   bool
+	peer   string
+}
+
+func (s *dumpSession) HandleHandshake(ctx context.Context, h *peers.Handshake) {
+	s.peer = h.LocalPeerIdentifier
+	log.Printf("connected to %s", s.peer)
+
+	if s.sync {
+		if err := peers.WriterFromContext(ctx).SendSyncRequest(); err != nil {
+			log.Printf("requesting entries of %s: %v", s.peer, err)
+		}
+	}
+}
+
+func (s *dumpSession) HandleUpdate(_ context.Context, u *sticktable.EntryUpdate) {
+	if err := s.dumper.write(s.peer, u); err != nil {
+		log.Printf("writing update: %v", err)
+	}
+}
+
+func (s *dumpSession) Close() error {
+	log.Printf("disconnected from %s", s.peer)
+	return nil
+}
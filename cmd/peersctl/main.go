@@ -0,0 +1,138 @@
+// peersctl dumps and pushes stick-table entries using the HAProxy peers
+// protocol. It either listens for HAProxy to connect, like a peer of its
+// peers section, or dials a peer of HAProxy.
+//
+//	peersctl dump -listen :21000
+//	peersctl dump -dial haproxy:10000 -name peersctl -remote haproxy1 -format ndjson -table st_src
+//	peersctl push -listen :21000 -table "my_blocklist type ip size 200k expire 5m store gpc0" blocked.csv
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
+)
+
+// reconnectDelay is the time waited before dialing again after a session
+// ended.
+const reconnectDelay = time.Second
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: peersctl <command> [flags]
+
+Commands:
+  dump    print received stick-table updates
+  push    send stick-table entries read from a CSV or NDJSON file
+
+Run "peersctl <command> -h" for the flags of a command.
+`)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("peersctl: ")
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "dump":
+		err = runDump(ctx, args)
+	case "push":
+		err = runPush(ctx, args)
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connFlags are the flags selecting how to connect to HAProxy.
+type connFlags struct {
+	listen string
+	dial   string
+	name   string
+	remote string
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.listen, "listen", "", "listen on `addr` for HAProxy to connect, unix@path for a unix socket")
+	fs.StringVar(&c.dial, "dial", "", "connect to the HAProxy peer at `addr`, unix@path for a unix socket")
+	fs.StringVar(&c.name, "name", "", "local peer `name`, defaults to the hostname")
+	fs.StringVar(&c.remote, "remote", "", "`name` of the HAProxy peer to dial")
+}
+
+func (c *connFlags) validate() error {
+	switch {
+	case (c.listen == "") == (c.dial == ""):
+		return fmt.Errorf("exactly one of -listen and -dial is required")
+	case c.dial != "" && c.remote == "":
+		return fmt.Errorf("-remote is required with -dial")
+	}
+	return nil
+}
+
+// run serves sessions with handlers of source until ctx is done. Dialed
+// sessions are reestablished after they ended.
+func (c *connFlags) run(ctx context.Context, source func() peers.Handler) error {
+	p := &peers.Peer{
+		BaseContext:   ctx,
+		Name:          c.name,
+		HandlerSource: source,
+	}
+
+	if c.listen != "" {
+		l, err := socket.Listen(c.listen, 0)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		err = p.Serve(l)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	for {
+		err := p.DialAndServe(ctx, c.dial, c.remote)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Print(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
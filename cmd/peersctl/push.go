@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func runPush(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: peersctl push [flags] [file]\n\nReads the entries from stdin if file is - or missing.\n\n")
+		fs.PrintDefaults()
+	}
+	var conn connFlags
+	conn.register(fs)
+
+	tables := make(tableFlag)
+	fs.Var(tables, "table", "`definition` of a table like in a peers section: \"<name> type ip size 200k expire 5m store gpc0\", can be repeated")
+	format := fs.String("format", "", "input `format`, csv or ndjson, defaults to the file extension")
+	linger := fs.Duration("linger", time.Second, "keep the session open for `duration` after pushing, so HAProxy applies the entries")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("at least one -table is required")
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+
+		if *format == "" && strings.EqualFold(filepath.Ext(name), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	var updates []*sticktable.EntryUpdate
+	var err error
+	switch *format {
+	case "csv":
+		updates, err = readCSV(r, tables)
+	case "", "ndjson":
+		updates, err = readNDJSON(r, tables)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The session is ended after the entries were pushed once.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pushed atomic.Bool
+	err = conn.run(ctx, func() peers.Handler {
+		return &pushSession{
+			updates: updates,
+			done: func() {
+				pushed.Store(true)
+				time.AfterFunc(*linger, cancel)
+			},
+		}
+	})
+	if err == nil && !pushed.Load() {
+		return errors.New("interrupted before pushing")
+	}
+	return err
+}
+
+// pushSession sends the entries after the handshake.
+type pushSession struct {
+	updates []*sticktable.EntryUpdate
+	done    func()
+}
+
+func (s *pushSession) HandleHandshake(ctx context.Context, h *peers.Handshake) {
+	w := peers.WriterFromContext(ctx)
+	peer := h.LocalPeerIdentifier
+
+	if err := w.SendEntries(s.updates); err != nil {
+		log.Printf("pushing to %s: %v", peer, err)
+		return
+	}
+	log.Printf("pushed %d entries to %s", len(s.updates), peer)
+	s.done()
+}
+
+func (s *pushSession) HandleUpdate(context.Context, *sticktable.EntryUpdate) {}
+
+func (s *pushSession) Close() error { return nil }
+
+// entryParser builds the updates of the records read by push.
+type entryParser struct {
+	tables tableFlag
+}
+
+// table returns the definition of the table, which may only be omitted if
+// a single table is defined.
+func (p entryParser) table(name string) (*sticktable.Definition, error) {
+	if name == "" && len(p.tables) == 1 {
+		for _, def := range p.tables {
+			return def, nil
+		}
+	}
+
+	def, ok := p.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown table %q", name)
+	}
+	return def, nil
+}
+
+// update returns the update of the key with the values given by data type
+// name. Data types without value are sent as zero.
+func (p entryParser) update(table, key string, expire *uint32, values map[string]string) (*sticktable.EntryUpdate, error) {
+	def, err := p.table(table)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := def.KeyType.ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &sticktable.EntryUpdate{StickTable: def, Key: k, Data: make([]sticktable.MapData, len(def.DataTypes))}
+	for i, dt := range def.DataTypes {
+		u.Data[i] = dt.New()
+	}
+	if expire != nil {
+		u.WithExpiry = true
+		u.Expiry = *expire
+	}
+
+	for name, value := range values {
+		t, err := sticktable.ParseDataType(name)
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(def.DataTypes, func(dt sticktable.DataTypeDefinition) bool { return dt.DataType == t })
+		if i < 0 {
+			return nil, fmt.Errorf("table %s does not store %s", def.Name, t)
+		}
+		if value == "" {
+			continue
+		}
+
+		if u.Data[i], err = parseData(def.DataTypes[i], value); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", t, err)
+		}
+	}
+
+	return u, nil
+}
+
+// readCSV reads entries from CSV with a header row. The key column is
+// required, the table column may only be omitted if a single table is
+// defined. An optional expire_ms column sets the expiry of the entry, all
+// other columns are data types. Array elements are separated by commas.
+func readCSV(r io.Reader, tables tableFlag) ([]*sticktable.EntryUpdate, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if !slices.Contains(header, "key") {
+		return nil, fmt.Errorf("missing key column")
+	}
+
+	p := entryParser{tables: tables}
+	var updates []*sticktable.EntryUpdate
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return updates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		var table, key string
+		var expire *uint32
+		values := make(map[string]string)
+		for i, column := range header {
+			switch column {
+			case "table":
+				table = row[i]
+			case "key":
+				key = row[i]
+			case "expire_ms":
+				if row[i] == "" {
+					continue
+				}
+				v, err := strconv.ParseUint(row[i], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid expire_ms %q", line, row[i])
+				}
+				e := uint32(v)
+				expire = &e
+			default:
+				values[column] = row[i]
+			}
+		}
+
+		u, err := p.update(table, key, expire, values)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		updates = append(updates, u)
+	}
+}
+
+// readNDJSON reads entries in the format written by dump.
+func readNDJSON(r io.Reader, tables tableFlag) ([]*sticktable.EntryUpdate, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	p := entryParser{tables: tables}
+	var updates []*sticktable.EntryUpdate
+	for n := 1; ; n++ {
+		var rec record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			return updates, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", n, err)
+		}
+
+		values := make(map[string]string, len(rec.Data))
+		for name, v := range rec.Data {
+			s, err := jsonText(v)
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %s: %w", n, name, err)
+			}
+			values[name] = s
+		}
+
+		u, err := p.update(rec.Table, rec.Key, rec.ExpireMS, values)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", n, err)
+		}
+		updates = append(updates, u)
+	}
+}
+
+// jsonText converts a decoded JSON value to the text format of parseData.
+func jsonText(v any) (string, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return v, nil
+	case []any:
+		elements := make([]string, len(v))
+		for i, e := range v {
+			n, ok := e.(json.Number)
+			if !ok {
+				return "", fmt.Errorf("unexpected array element %v", e)
+			}
+			elements[i] = n.String()
+		}
+		return strings.Join(elements, ","), nil
+	default:
+		return "", fmt.Errorf("unexpected value %v", v)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/mirror"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func testTables(t *testing.T) tableFlag {
+	t.Helper()
+	tables := make(tableFlag)
+	for _, decl := range []string{
+		"st_src type ip size 1k expire 5m store gpc0,http_req_rate(10s),gpc(2)",
+		"st_path type string len 16 size 1k store gpt0",
+	} {
+		if err := tables.Set(decl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tables
+}
+
+func TestReadEntries(t *testing.T) {
+	tables := testTables(t)
+
+	csvInput := `table,key,expire_ms,gpc0,http_req_rate,gpc
+# comment
+st_src,192.0.2.1,1000,1,20,"3,4"
+st_src,192.0.2.2,,,,
+`
+	fromCSV, err := readCSV(strings.NewReader(csvInput), tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ndjsonInput := `{"table":"st_src","key":"192.0.2.1","expire_ms":1000,"data":{"gpc":[3,4],"gpc0":1,"http_req_rate":20}}
+{"table":"st_src","key":"192.0.2.2","data":{"gpc":[0,0],"gpc0":0,"http_req_rate":0}}
+`
+	fromNDJSON, err := readNDJSON(strings.NewReader(ndjsonInput), tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(fromCSV, fromNDJSON, cmp.Transformer("String", sticktable.MapKey.String)); diff != "" {
+		t.Errorf("CSV and NDJSON mismatch (-csv +ndjson):\n%s", diff)
+	}
+
+	// The NDJSON format of dump is read back unchanged.
+	var out bytes.Buffer
+	d := &dumper{format: "ndjson", out: &out}
+	for _, u := range fromCSV {
+		if err := d.write("hap1", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(ndjsonInput, out.String()); diff != "" {
+		t.Errorf("dump mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, input := range []string{
+		"key,gpc0\n192.0.2.1,1\n",
+		"table,gpc0\nst_src,1\n",
+		"table,key,gpc0\nst_src,foo,1\n",
+		"table,key,gpt0\nst_src,192.0.2.1,1\n",
+		"table,key,gpc0\nst_src,192.0.2.1,x\n",
+		"table,key,gpc\nst_src,192.0.2.1,1\n",
+		"table,key,expire_ms\nst_src,192.0.2.1,-1\n",
+	} {
+		if _, err := readCSV(strings.NewReader(input), tables); err == nil {
+			t.Errorf("readCSV(%q): expected error", input)
+		}
+	}
+}
+
+func TestPushAndDump(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The store stands in for HAProxy, it teaches the pushed entries on
+	// the sync request of dump.
+	store := &mirror.Store{}
+	peer := &peers.Peer{BaseContext: ctx, Name: "hap1", Handler: store}
+	go peer.Serve(l)
+
+	err = runPush(ctx, []string{
+		"-dial", l.Addr().String(), "-name", "peersctl", "-remote", "hap1", "-linger", "0",
+		"-table", "st_path type string len 16 size 1k store gpt0",
+		"-format", "csv", writeFile(t, "key,gpt0\n/login,1\n/admin,2\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	d := &dumper{format: "text", keys: listFlag{"/adm*"}, out: &out}
+	conn := connFlags{dial: l.Addr().String(), name: "peersctl", remote: "hap1"}
+
+	dumpCtx, dumpCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer dumpCancel()
+	if err := conn.run(dumpCtx, func() peers.Handler { return &dumpSession{dumper: d, sync: true} }); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "hap1 st_path /admin gpt0=2\n"; out.String() != want {
+		t.Errorf("expected %q, got %q", want, out.String())
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	name := t.TempDir() + "/entries.csv"
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
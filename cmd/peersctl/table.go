@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// tableFlag collects the tables given with -table in the syntax of the
+// table keyword of an HAProxy peers section:
+//
+//	<name> type ip size 200k expire 5m store gpc0,http_req_rate(10s)
+type tableFlag map[string]*sticktable.Definition
+
+func (f tableFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f tableFlag) Set(s string) error {
+	def, err := sticktable.ParseDefinition("table " + s)
+	if err != nil {
+		return fmt.Errorf("table %q: %w", s, err)
+	}
+
+	f[def.Name] = def
+	return nil
+}
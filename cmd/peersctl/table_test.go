@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func TestTableFlag(t *testing.T) {
+	f := make(tableFlag)
+	if err := f.Set("st_src type ip size 1k store gpc0"); err != nil {
+		t.Fatal(err)
+	}
+
+	def := f["st_src"]
+	if def == nil || def.Name != "st_src" || def.KeyType != sticktable.KeyTypeIPv4Address {
+		t.Errorf("expected ip table st_src, got %v", f)
+	}
+
+	for _, s := range []string{"", "type ip size 1k", "st_src type foo"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("Set(%q): expected error", s)
+		}
+	}
+}
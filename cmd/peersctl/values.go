@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// record is an entry as written by dump in NDJSON format and read by push.
+type record struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	// ExpireMS is the expiry sent with the entry, omitted if the expiry of
+	// the table applies.
+	ExpireMS *uint32        `json:"expire_ms,omitempty"`
+	Data     map[string]any `json:"data"`
+}
+
+// newRecord returns the record of an update received elapsed ago.
+func newRecord(u *sticktable.EntryUpdate, elapsed time.Duration) record {
+	r := record{
+		Table: u.StickTable.Name,
+		Key:   sticktable.FormatKey(u.Key),
+		Data:  make(map[string]any, len(u.Data)),
+	}
+	if u.WithExpiry {
+		expiry := u.Expiry
+		r.ExpireMS = &expiry
+	}
+
+	for i, d := range u.Data {
+		dt := u.StickTable.DataTypes[i]
+		r.Data[dt.DataType.String()] = sticktable.DataValue(dt, d, elapsed)
+	}
+
+	return r
+}
+
+// formatText returns a value returned by sticktable.DataValue in the text
+// format of dump, arrays as comma separated list.
+func formatText(v any) string {
+	switch v := v.(type) {
+	case []uint32:
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = strconv.FormatUint(uint64(v[i]), 10)
+		}
+		return strings.Join(s, ",")
+	case []uint64:
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = strconv.FormatUint(v[i], 10)
+		}
+		return strings.Join(s, ",")
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseData parses the value of a data type in the text format of dump.
+// Rates are set as frequency counter reporting the value for one period.
+func parseData(dt sticktable.DataTypeDefinition, s string) (sticktable.MapData, error) {
+	switch v := dt.New().(type) {
+	case *sticktable.UnsignedIntegerData:
+		n, err := strconv.ParseUint(s, 10, 32)
+		*v = sticktable.UnsignedIntegerData(n)
+		return v, err
+	case *sticktable.UnsignedLongLongData:
+		n, err := strconv.ParseUint(s, 10, 64)
+		*v = sticktable.UnsignedLongLongData(n)
+		return v, err
+	case *sticktable.SignedIntegerData:
+		n, err := strconv.ParseInt(s, 10, 32)
+		*v = sticktable.SignedIntegerData(n)
+		return v, err
+	case *sticktable.FreqData:
+		n, err := strconv.ParseUint(s, 10, 64)
+		*v = sticktable.NewFreqData(n)
+		return v, err
+	case *sticktable.DictData:
+		v.Value = []byte(s)
+		return v, nil
+	case *sticktable.UnsignedIntegerArrayData:
+		elements := strings.Split(s, ",")
+		if len(elements) != len(*v) {
+			return nil, fmt.Errorf("got %d elements, want %d", len(elements), len(*v))
+		}
+		for i, e := range elements {
+			n, err := strconv.ParseUint(strings.TrimSpace(e), 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			(*v)[i] = sticktable.UnsignedIntegerData(n)
+		}
+		return v, nil
+	case *sticktable.FreqArrayData:
+		elements := strings.Split(s, ",")
+		if len(elements) != len(*v) {
+			return nil, fmt.Errorf("got %d elements, want %d", len(elements), len(*v))
+		}
+		for i, e := range elements {
+			n, err := strconv.ParseUint(strings.TrimSpace(e), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			(*v)[i] = sticktable.NewFreqData(n)
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported data type %s", dt.DataType)
+	}
+}
@@ -0,0 +1,532 @@
+// Package admin provides an HTTP/JSON API to inspect and modify the stick
+// tables of the HAProxy instances connected to a peers.Peer, for example
+// to reset the counters of a blocked client.
+//
+// The API serves the following endpoints, relative to where it is
+// mounted:
+//
+//	GET    /tables                       tables known by the live sessions
+//	GET    /tables/{table}               a single table
+//	GET    /tables/{table}/entries/{key} an entry
+//	PUT    /tables/{table}/entries/{key} set values of an entry
+//	DELETE /tables/{table}/entries/{key} clear counters and rates
+//
+// Keys are given in the format of "show table", binary keys hex encoded.
+// PUT expects a body like {"data": {"gpc0": 0}, "expire_ms": 60000}. Only
+// the given values are sent, DELETE only sends the cleared values, so the
+// remote peers keep all other values of the entry. Changes are sent to all
+// sessions that know the table, or to a single peer selected with the
+// "peer" query parameter.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/clock"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/registry"
+	"github.com/dropmorepackets/haproxy-go/peers/mirror"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// maxBodySize limits the size of request bodies.
+const maxBodySize = 1 << 20
+
+// API is an http.Handler for the stick tables of the connected peers. Use
+// Handler as HandlerSource of a peers.Peer.
+//
+// The zero value is ready to use.
+type API struct {
+	// Store mirrors the entries received by the sessions. Defaults to a
+	// Store owned by the API. A shared Store can be used to persist the
+	// entries with snapshots.
+	Store *mirror.Store
+
+	once  sync.Once
+	store *mirror.Store
+
+	mu       sync.Mutex
+	sessions registry.Sessions[*session]
+
+	now clock.Func
+}
+
+var _ http.Handler = (*API)(nil)
+
+// Handler returns the handler for a new session.
+func (a *API) Handler() peers.Handler {
+	return &session{api: a, defs: make(map[string]*sticktable.Definition)}
+}
+
+func (a *API) mirror() *mirror.Store {
+	a.once.Do(func() {
+		a.store = a.Store
+		if a.store == nil {
+			a.store = new(mirror.Store)
+		}
+	})
+	return a.store
+}
+
+// target is a session that knows a table, with its definition of it.
+type target struct {
+	peer   string
+	writer *peers.Writer
+	def    *sticktable.Definition
+}
+
+// targets returns the sessions that know the table, sorted by the name of
+// their remote peer.
+func (a *API) targets(table string) []target {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var targets []target
+	for _, s := range a.sessions.All() {
+		if def, ok := s.defs[table]; ok {
+			targets = append(targets, target{peer: s.peer, writer: s.writer, def: def})
+		}
+	}
+
+	slices.SortFunc(targets, func(a, b target) int { return strings.Compare(a.peer, b.peer) })
+	return targets
+}
+
+// tables returns the names of all tables known by the sessions.
+func (a *API) tables() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var names []string
+	for _, s := range a.sessions.All() {
+		for name := range s.defs {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// session is the handler of a single remote peer.
+type session struct {
+	api    *API
+	peer   string
+	writer *peers.Writer
+
+	// defs are the definitions received on the session by table name,
+	// guarded by the mutex of the API.
+	defs map[string]*sticktable.Definition
+}
+
+var (
+	_ peers.Handler           = (*session)(nil)
+	_ peers.DefinitionHandler = (*session)(nil)
+	_ peers.SyncHandler       = (*session)(nil)
+)
+
+func (s *session) HandleHandshake(ctx context.Context, h *peers.Handshake) {
+	s.peer = h.LocalPeerIdentifier
+	s.writer = peers.WriterFromContext(ctx)
+
+	s.api.sessions.Add(s)
+}
+
+func (s *session) HandleDefinition(ctx context.Context, d *sticktable.Definition) {
+	def := d.Clone()
+
+	s.api.mu.Lock()
+	s.defs[def.Name] = def
+	s.api.mu.Unlock()
+
+	s.api.mirror().HandleDefinition(ctx, d)
+}
+
+func (s *session) HandleUpdate(ctx context.Context, u *sticktable.EntryUpdate) {
+	s.api.mirror().HandleUpdate(ctx, u)
+}
+
+func (s *session) HandleSyncRequest(ctx context.Context, w *peers.Writer) error {
+	return s.api.mirror().HandleSyncRequest(ctx, w)
+}
+
+func (s *session) Close() error {
+	s.api.sessions.Remove(s)
+	return nil
+}
+
+// ServeHTTP serves the endpoints described in the package documentation.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		s, err := url.PathUnescape(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		segments = append(segments, s)
+	}
+
+	switch {
+	case len(segments) == 1 && segments[0] == "tables":
+		if allowMethods(w, r, http.MethodGet) {
+			a.listTables(w)
+		}
+	case len(segments) == 2 && segments[0] == "tables":
+		if allowMethods(w, r, http.MethodGet) {
+			a.getTable(w, segments[1])
+		}
+	case len(segments) == 4 && segments[0] == "tables" && segments[2] == "entries":
+		if allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+			a.serveEntry(w, r, segments[1], segments[3])
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// Table is the JSON representation of a table.
+type Table struct {
+	Name      string     `json:"name"`
+	KeyType   string     `json:"key_type"`
+	KeyLength uint64     `json:"key_length"`
+	ExpireMS  uint64     `json:"expire_ms"`
+	DataTypes []DataType `json:"data_types"`
+	// Peers are the names of the remote peers that know the table.
+	Peers []string `json:"peers"`
+	// Entries is the amount of mirrored entries, including expired
+	// entries that were not removed yet.
+	Entries int `json:"entries"`
+}
+
+// DataType is the JSON representation of a data type of a table.
+type DataType struct {
+	Type     string `json:"type"`
+	PeriodMS uint64 `json:"period_ms,omitempty"`
+	Elements uint64 `json:"elements,omitempty"`
+}
+
+// Entry is the JSON representation of an entry. Rates are reported like
+// "show table" does, arrays as JSON arrays and dictionary values as
+// strings.
+type Entry struct {
+	Key string `json:"key"`
+	// ExpireMS is the time until the entry expires, omitted if it never
+	// expires.
+	ExpireMS *uint64        `json:"expire_ms,omitempty"`
+	Data     map[string]any `json:"data"`
+}
+
+func (a *API) table(name string) (Table, bool) {
+	targets := a.targets(name)
+	if len(targets) == 0 {
+		return Table{}, false
+	}
+
+	def := targets[0].def
+	t := Table{
+		Name:      def.Name,
+		KeyType:   def.KeyType.Declaration(),
+		KeyLength: def.KeyLength,
+		ExpireMS:  def.Expiry,
+		DataTypes: make([]DataType, len(def.DataTypes)),
+		Entries:   a.mirror().Len(name),
+	}
+	for i, dt := range def.DataTypes {
+		t.DataTypes[i] = DataType{Type: dt.DataType.String(), PeriodMS: dt.Period, Elements: dt.Elements}
+	}
+	for _, target := range targets {
+		t.Peers = append(t.Peers, target.peer)
+	}
+
+	return t, true
+}
+
+func (a *API) listTables(w http.ResponseWriter) {
+	tables := []Table{}
+	for _, name := range a.tables() {
+		if t, ok := a.table(name); ok {
+			tables = append(tables, t)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, tables)
+}
+
+func (a *API) getTable(w http.ResponseWriter, name string) {
+	t, ok := a.table(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown table %q", name))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (a *API) serveEntry(w http.ResponseWriter, r *http.Request, table, rawKey string) {
+	targets := a.targets(table)
+	if len(targets) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown table %q", table))
+		return
+	}
+	def := targets[0].def
+
+	key, err := def.KeyType.ParseKey(rawKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		e, ok := a.mirror().Lookup(table, key)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown key %q", rawKey))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, a.entry(def, e))
+		return
+	}
+
+	if peer := r.URL.Query().Get("peer"); peer != "" {
+		targets = slices.DeleteFunc(targets, func(t target) bool { return t.peer != peer })
+		if len(targets) == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("peer %q does not know table %q", peer, table))
+			return
+		}
+	}
+
+	u := a.current(def, key)
+	var changed []bool
+	if r.Method == http.MethodDelete {
+		changed = clearData(def, u.Data)
+	} else {
+		var req struct {
+			Data     map[string]json.RawMessage `json:"data"`
+			ExpireMS *uint32                    `json:"expire_ms"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+			return
+		}
+		changed, err = setData(def, u.Data, req.Data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.ExpireMS != nil {
+			u.WithExpiry = true
+			u.Expiry = *req.ExpireMS
+		}
+	}
+
+	resp := struct {
+		Entry Entry    `json:"entry"`
+		Peers []string `json:"peers"`
+	}{Peers: []string{}}
+	var errs []error
+	for _, t := range targets {
+		if err := t.writer.SendEntry(partial(t.def, u, changed)); err != nil {
+			errs = append(errs, fmt.Errorf("sending to %s: %w", t.peer, err))
+			continue
+		}
+		resp.Peers = append(resp.Peers, t.peer)
+	}
+
+	a.mirror().HandleUpdate(r.Context(), u)
+
+	if len(resp.Peers) == 0 {
+		writeError(w, http.StatusBadGateway, errors.Join(errs...))
+		return
+	}
+
+	e, _ := a.mirror().Lookup(table, key)
+	resp.Entry = a.entry(def, e)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// current returns an update of the key with the mirrored values of the
+// entry or empty values if it is unknown.
+func (a *API) current(def *sticktable.Definition, key sticktable.MapKey) *sticktable.EntryUpdate {
+	u := &sticktable.EntryUpdate{StickTable: def, Key: key}
+
+	e, ok := a.mirror().Lookup(def.Name, key)
+	if !ok || len(e.Data) != len(def.DataTypes) {
+		u.Data = make([]sticktable.MapData, len(def.DataTypes))
+		for i, dt := range def.DataTypes {
+			u.Data[i] = dt.New()
+		}
+		return u
+	}
+
+	sticktable.AgeRates(e.Data, a.now.Now().Sub(e.Updated))
+	u.Data = e.Data
+
+	return u
+}
+
+// partial returns the update of the changed data types for the definition
+// of a target. The remote peer only applies the data types of the
+// definition it received last, so it keeps the values of all others.
+func partial(def *sticktable.Definition, u *sticktable.EntryUpdate, changed []bool) *sticktable.EntryUpdate {
+	d := *def
+	d.DataTypes = nil
+
+	p := *u
+	p.StickTable = &d
+	p.Data = nil
+
+	for i, dt := range u.StickTable.DataTypes {
+		if changed[i] {
+			d.DataTypes = append(d.DataTypes, dt)
+			p.Data = append(p.Data, u.Data[i])
+		}
+	}
+
+	return &p
+}
+
+// clearData sets all counters, gpt values and rates to zero and reports
+// which data types were cleared.
+func clearData(def *sticktable.Definition, data []sticktable.MapData) []bool {
+	cleared := make([]bool, len(def.DataTypes))
+	for i, dt := range def.DataTypes {
+		switch dt.DataType {
+		case sticktable.DataTypeServerId, sticktable.DataTypeServerKey, sticktable.DataTypeNumberOfCurrentConnections:
+			// Not a counter, owned by HAProxy.
+		default:
+			data[i] = dt.New()
+			cleared[i] = true
+		}
+	}
+
+	return cleared
+}
+
+// setData sets the values of the data types given by name and reports
+// which data types were set.
+func setData(def *sticktable.Definition, data []sticktable.MapData, values map[string]json.RawMessage) ([]bool, error) {
+	set := make([]bool, len(def.DataTypes))
+	for name, raw := range values {
+		t, err := sticktable.ParseDataType(name)
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(def.DataTypes, func(dt sticktable.DataTypeDefinition) bool { return dt.DataType == t })
+		if i < 0 {
+			return nil, fmt.Errorf("table %s does not store %s", def.Name, t)
+		}
+
+		v, err := decodeData(def.DataTypes[i], raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", t, err)
+		}
+		data[i] = v
+		set[i] = true
+	}
+
+	return set, nil
+}
+
+// decodeData decodes the JSON value of a data type. Rates are set as
+// frequency counter reporting the value for one period.
+func decodeData(dt sticktable.DataTypeDefinition, raw json.RawMessage) (sticktable.MapData, error) {
+	switch v := dt.New().(type) {
+	case *sticktable.UnsignedIntegerData:
+		return v, json.Unmarshal(raw, (*uint32)(v))
+	case *sticktable.UnsignedLongLongData:
+		return v, json.Unmarshal(raw, (*uint64)(v))
+	case *sticktable.SignedIntegerData:
+		return v, json.Unmarshal(raw, (*int32)(v))
+	case *sticktable.FreqData:
+		var rate uint64
+		if err := json.Unmarshal(raw, &rate); err != nil {
+			return nil, err
+		}
+		*v = sticktable.NewFreqData(rate)
+		return v, nil
+	case *sticktable.UnsignedIntegerArrayData:
+		var values []uint32
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, err
+		}
+		if len(values) != len(*v) {
+			return nil, fmt.Errorf("got %d elements, want %d", len(values), len(*v))
+		}
+		for i, value := range values {
+			(*v)[i] = sticktable.UnsignedIntegerData(value)
+		}
+		return v, nil
+	case *sticktable.FreqArrayData:
+		var rates []uint64
+		if err := json.Unmarshal(raw, &rates); err != nil {
+			return nil, err
+		}
+		if len(rates) != len(*v) {
+			return nil, fmt.Errorf("got %d elements, want %d", len(rates), len(*v))
+		}
+		for i, rate := range rates {
+			(*v)[i] = sticktable.NewFreqData(rate)
+		}
+		return v, nil
+	default:
+		return nil, errors.New("not settable")
+	}
+}
+
+// entry returns the JSON representation of a mirrored entry.
+func (a *API) entry(def *sticktable.Definition, e mirror.Entry) Entry {
+	now := a.now.Now()
+	elapsed := now.Sub(e.Updated)
+
+	j := Entry{Key: sticktable.FormatKey(e.Key), Data: make(map[string]any, len(e.Data))}
+	if !e.Expires.IsZero() {
+		ms := uint64(max(e.Expires.Sub(now), 0).Milliseconds())
+		j.ExpireMS = &ms
+	}
+
+	for i, d := range e.Data {
+		if i >= len(def.DataTypes) {
+			break
+		}
+		dt := def.DataTypes[i]
+		j.Data[dt.DataType.String()] = sticktable.DataValue(dt, d, elapsed)
+	}
+
+	return j
+}
@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/peertest"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+const testDeclaration = "table st_src type ip expire 1m store gpt0,gpc0,http_req_rate(10s)"
+
+// do sends a request to the API and decodes the JSON response into v.
+func do(t *testing.T, h http.Handler, method, target, body string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s: unexpected content type %q", method, target, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+func startAPI(t *testing.T) (*API, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	a := &API{}
+	peer := &peers.Peer{BaseContext: ctx, HandlerSource: a.Handler}
+	go peer.Serve(l)
+
+	return a, l.Addr().String()
+}
+
+// waitEntry waits until the API knows the entry.
+func waitEntry(t *testing.T, a *API, target string) Entry {
+	t.Helper()
+	deadline := time.Now().Add(peertest.Timeout)
+	for {
+		var e Entry
+		if do(t, a, http.MethodGet, target, "", &e) == http.StatusOK {
+			return e
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", target)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	a, addr := startAPI(t)
+
+	hap1 := peertest.Dial(t, addr, "hap1", "admin")
+	hap2 := peertest.Dial(t, addr, "hap2", "admin")
+
+	def := peertest.Definition(t, testDeclaration)
+	hap1.SendUpdate(t, peertest.Update(t, def, "192.0.2.1", peertest.Entry{GPT0: 1, GPC0: 7, Rate: sticktable.NewFreqData(20)}))
+	hap2.SendUpdate(t, peertest.Update(t, def, "192.0.2.2", peertest.Entry{GPC0: 1}))
+
+	e := waitEntry(t, a, "/tables/st_src/entries/192.0.2.1")
+	waitEntry(t, a, "/tables/st_src/entries/192.0.2.2")
+
+	expire := uint64(60000)
+	want := Entry{
+		Key:      "192.0.2.1",
+		ExpireMS: &expire,
+		Data:     map[string]any{"gpt0": 1.0, "gpc0": 7.0, "http_req_rate": 20.0},
+	}
+	if diff := cmp.Diff(want, e, cmp.FilterPath(func(p cmp.Path) bool {
+		return p.Last().String() == ".ExpireMS"
+	}, cmp.Ignore())); diff != "" {
+		t.Errorf("entry mismatch (-want +got):\n%s", diff)
+	}
+
+	var tables []Table
+	if code := do(t, a, http.MethodGet, "/tables", "", &tables); code != http.StatusOK {
+		t.Fatalf("listing tables: status %d", code)
+	}
+	wantTables := []Table{{
+		Name:      "st_src",
+		KeyType:   "ip",
+		KeyLength: 4,
+		ExpireMS:  60000,
+		DataTypes: []DataType{
+			{Type: "gpt0"},
+			{Type: "gpc0"},
+			{Type: "http_req_rate", PeriodMS: 10000},
+		},
+		Peers:   []string{"hap1", "hap2"},
+		Entries: 2,
+	}}
+	if diff := cmp.Diff(wantTables, tables); diff != "" {
+		t.Errorf("tables mismatch (-want +got):\n%s", diff)
+	}
+
+	// Unblock the client on hap1 only.
+	var resp struct {
+		Entry Entry    `json:"entry"`
+		Peers []string `json:"peers"`
+	}
+	code := do(t, a, http.MethodPut, "/tables/st_src/entries/192.0.2.1?peer=hap1", `{"data": {"gpc0": 0}}`, &resp)
+	if code != http.StatusOK {
+		t.Fatalf("setting entry: status %d", code)
+	}
+	if diff := cmp.Diff([]string{"hap1"}, resp.Peers); diff != "" {
+		t.Errorf("peers mismatch (-want +got):\n%s", diff)
+	}
+	if resp.Entry.Data["gpc0"] != 0.0 || resp.Entry.Data["gpt0"] != 1.0 {
+		t.Errorf("unexpected entry %v", resp.Entry.Data)
+	}
+
+	// Only the changed value is sent, so values that changed on hap1 in
+	// the meantime are not overwritten by the mirrored ones.
+	u := hap1.ReceiveUpdate(t)
+	if gpc0, ok := u.Uint(sticktable.DataTypeGPC0); !ok || gpc0 != 0 {
+		t.Errorf("expected gpc0 0, got %d", gpc0)
+	}
+	if n := len(u.StickTable.DataTypes); n != 1 {
+		t.Errorf("expected a single data type, got %v", u.StickTable.DataTypes)
+	}
+	hap2.ExpectNothing(t, 50*time.Millisecond)
+
+	// Clearing is sent to all peers knowing the table.
+	code = do(t, a, http.MethodDelete, "/tables/st_src/entries/192.0.2.2", "", &resp)
+	if code != http.StatusOK {
+		t.Fatalf("clearing entry: status %d", code)
+	}
+	for _, c := range []*peertest.Conn{hap1, hap2} {
+		u := c.ReceiveUpdate(t)
+		if u.Key.String() != "192.0.2.2" {
+			t.Errorf("%s: unexpected key %s", c.Name, u.Key)
+		}
+		if gpc0, _ := u.Uint(sticktable.DataTypeGPC0); gpc0 != 0 {
+			t.Errorf("%s: expected gpc0 0, got %d", c.Name, gpc0)
+		}
+	}
+
+	// Teaching the mirrored entries sends all data types again.
+	hap1.SendControl(t, peers.ControlMessageSyncRequest)
+	for i := 0; i < 2; i++ {
+		if u := hap1.ReceiveUpdate(t); len(u.StickTable.DataTypes) != len(def.DataTypes) {
+			t.Errorf("expected all data types, got %v", u.StickTable.DataTypes)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	a, addr := startAPI(t)
+
+	hap1 := peertest.Dial(t, addr, "hap1", "admin")
+	def := peertest.Definition(t, testDeclaration)
+	hap1.SendUpdate(t, peertest.Update(t, def, "192.0.2.1", peertest.Entry{}))
+	waitEntry(t, a, "/tables/st_src/entries/192.0.2.1")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"unknown path", http.MethodGet, "/foo", "", http.StatusNotFound},
+		{"unknown table", http.MethodGet, "/tables/foo", "", http.StatusNotFound},
+		{"unknown table entry", http.MethodGet, "/tables/foo/entries/192.0.2.1", "", http.StatusNotFound},
+		{"unknown key", http.MethodGet, "/tables/st_src/entries/192.0.2.9", "", http.StatusNotFound},
+		{"invalid key", http.MethodGet, "/tables/st_src/entries/foo", "", http.StatusBadRequest},
+		{"method", http.MethodPost, "/tables", "", http.StatusMethodNotAllowed},
+		{"unknown peer", http.MethodPut, "/tables/st_src/entries/192.0.2.1?peer=hap9", `{"data": {}}`, http.StatusNotFound},
+		{"invalid body", http.MethodPut, "/tables/st_src/entries/192.0.2.1", `{`, http.StatusBadRequest},
+		{"unknown data type", http.MethodPut, "/tables/st_src/entries/192.0.2.1", `{"data": {"gpc42": 1}}`, http.StatusBadRequest},
+		{"data type not stored", http.MethodPut, "/tables/st_src/entries/192.0.2.1", `{"data": {"gpc1": 1}}`, http.StatusBadRequest},
+		{"invalid value", http.MethodPut, "/tables/st_src/entries/192.0.2.1", `{"data": {"gpc0": -1}}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if code := do(t, a, tt.method, tt.target, tt.body, &resp); code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, code, resp.Error)
+			}
+			if resp.Error == "" {
+				t.Error("expected error message")
+			}
+		})
+	}
+
+	hap1.ExpectNothing(t, 50*time.Millisecond)
+}
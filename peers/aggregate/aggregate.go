@@ -0,0 +1,402 @@
+// Package aggregate combines the views of several HAProxy instances on the
+// same stick tables. Every instance sends its local values of a key, the
+// Aggregator keeps them per instance and sums them up, for example to
+// enforce a rate limit across all instances.
+package aggregate
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/clock"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/outbox"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/registry"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// sweepInterval is the amount of updates of a table after which its
+// expired values are removed.
+const sweepInterval = 4096
+
+// Aggregator keeps the values of every key per origin, the name of the
+// remote peer from its handshake. Use Handler as HandlerSource of a
+// peers.Peer.
+//
+// Expired values are removed every 4096 updates of a table, like HAProxy
+// purges expired entries. Call Expire to remove them earlier, for example
+// from a ticker if tables receive few updates.
+//
+// Counters, rates and the amount of current connections are summed up.
+// Rates are summed at the time of the lookup and returned as a frequency
+// counter that decays over the period of the table like a rate in
+// HAProxy. All other values are taken from the origin that sent the latest
+// update.
+type Aggregator struct {
+	// Publish maps the name of a table to the name of a table the
+	// aggregates are sent to. Every change of an aggregate is sent to all
+	// connected peers as update of the target table, which needs the same
+	// key and data types. The aggregates must not be sent to the table they
+	// are aggregated from, HAProxy would include them in its next update
+	// and they would be counted twice. Updates of target tables are
+	// ignored.
+	Publish map[string]string
+	// QueueSize is the amount of aggregates queued for publishing per
+	// session, 4096 if zero. Aggregates are sent by a goroutine of every
+	// session, so a slow peer does not stall receiving from the others.
+	// A queued aggregate is replaced by a newer one of the same key, if
+	// the queue is full the oldest aggregate is dropped.
+	QueueSize int
+
+	mu       sync.RWMutex
+	tables   map[string]*table
+	sessions registry.Sessions[*session]
+
+	now clock.Func
+}
+
+type table struct {
+	def     sticktable.Definition
+	entries map[string]*entry
+	updates int
+	// target is the definition of the table the aggregates are
+	// published to, nil if they are not published.
+	target *sticktable.Definition
+}
+
+type entry struct {
+	key     sticktable.MapKey
+	origins map[string]*value
+}
+
+// value is the latest update of an origin.
+type value struct {
+	data     []sticktable.MapData
+	received time.Time
+	expires  time.Time
+}
+
+// Handler returns the handler for a new session.
+func (a *Aggregator) Handler() peers.Handler {
+	return &session{aggregator: a}
+}
+
+func (a *Aggregator) isTarget(name string) bool {
+	for _, target := range a.Publish {
+		if target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// update stores the update of an origin and returns the new aggregate
+// of the key if it is published.
+func (a *Aggregator) update(origin string, u *sticktable.EntryUpdate) (*sticktable.EntryUpdate, error) {
+	if a.isTarget(u.StickTable.Name) {
+		return nil, nil
+	}
+
+	now := a.now.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.tables == nil {
+		a.tables = make(map[string]*table)
+	}
+
+	t, ok := a.tables[u.StickTable.Name]
+	if !ok || !t.def.Compatible(u.StickTable) {
+		t = &table{def: *u.StickTable.Clone(), entries: make(map[string]*entry)}
+		if target, ok := a.Publish[t.def.Name]; ok {
+			t.target = t.def.Clone()
+			t.target.Name = target
+		}
+		a.tables[t.def.Name] = t
+	}
+	t.def.Expiry = u.StickTable.Expiry
+
+	t.updates++
+	if t.updates%sweepInterval == 0 {
+		t.sweep(now)
+	}
+
+	key, err := t.def.EncodeKey(u.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := u.Clone()
+	e, ok := t.entries[key]
+	if !ok {
+		e = &entry{key: c.Key, origins: make(map[string]*value)}
+		t.entries[key] = e
+	}
+
+	v := &value{data: c.Data, received: now}
+	switch {
+	case u.WithExpiry:
+		v.expires = now.Add(time.Duration(u.Expiry) * time.Millisecond)
+	case t.def.Expiry > 0:
+		v.expires = now.Add(time.Duration(t.def.Expiry) * time.Millisecond)
+	}
+	e.origins[origin] = v
+
+	if t.target == nil {
+		return nil, nil
+	}
+
+	agg, _ := e.aggregate(&t.def, now)
+	if agg != nil {
+		agg.StickTable = t.target
+	}
+	return agg, nil
+}
+
+func (v *value) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+// aggregate returns the aggregated values of all origins whose values did
+// not expire and the amount of these origins.
+func (e *entry) aggregate(def *sticktable.Definition, now time.Time) (*sticktable.EntryUpdate, int) {
+	var latest *value
+	var origins int
+	for _, v := range e.origins {
+		if v.expired(now) {
+			continue
+		}
+		origins++
+
+		if latest == nil || v.received.After(latest.received) {
+			latest = v
+		}
+	}
+
+	if latest == nil {
+		return nil, 0
+	}
+
+	// The values that are not summed are taken from the latest update,
+	// the others are replaced by the sum.
+	u := (&sticktable.EntryUpdate{StickTable: def, Key: e.key, Data: latest.data}).Clone()
+	for i, dt := range def.DataTypes {
+		if summed(dt.DataType) {
+			u.Data[i] = dt.New()
+		}
+	}
+
+	for _, v := range e.origins {
+		if v.expired(now) {
+			continue
+		}
+
+		for i, dt := range def.DataTypes {
+			add(dt, u.Data[i], v.data[i], now.Sub(v.received))
+		}
+	}
+
+	return u, origins
+}
+
+// summed reports whether the values of a data type are summed up.
+func summed(t sticktable.DataType) bool {
+	return t.IsCounter() || t.IsDelay() || t == sticktable.DataTypeNumberOfCurrentConnections
+}
+
+// add adds the value v received elapsed ago to the aggregate sum. Rates
+// are added as the previous period of a counter with a current period of
+// age zero, which HAProxy reports as the sum decaying over the period.
+func add(dt sticktable.DataTypeDefinition, sum, v sticktable.MapData, elapsed time.Duration) {
+	if !summed(dt.DataType) {
+		return
+	}
+
+	switch sum := sum.(type) {
+	case *sticktable.UnsignedIntegerData:
+		if v, ok := v.(*sticktable.UnsignedIntegerData); ok {
+			*sum += *v
+		}
+	case *sticktable.UnsignedLongLongData:
+		if v, ok := v.(*sticktable.UnsignedLongLongData); ok {
+			*sum += *v
+		}
+	case *sticktable.UnsignedIntegerArrayData:
+		if v, ok := v.(*sticktable.UnsignedIntegerArrayData); ok && len(*v) == len(*sum) {
+			for i := range *sum {
+				(*sum)[i] += (*v)[i]
+			}
+		}
+	case *sticktable.FreqData:
+		if v, ok := v.(*sticktable.FreqData); ok {
+			addRate(sum, v, dt.PeriodDuration(), elapsed)
+		}
+	case *sticktable.FreqArrayData:
+		if v, ok := v.(*sticktable.FreqArrayData); ok && len(*v) == len(*sum) {
+			for i := range *sum {
+				addRate(&(*sum)[i], &(*v)[i], dt.PeriodDuration(), elapsed)
+			}
+		}
+	}
+}
+
+func addRate(sum, v *sticktable.FreqData, period, elapsed time.Duration) {
+	if period <= 0 {
+		// Without a period only the current period is reported.
+		sum.CurrentPeriod += v.Rate(period, elapsed)
+		return
+	}
+	sum.LastPeriod += v.Rate(period, elapsed)
+}
+
+// Lookup returns the aggregate of the key in the table and the amount of
+// origins it was aggregated from. The aggregate is an update of the table
+// that can be sent with a peers.Writer.
+func (a *Aggregator) Lookup(name string, key sticktable.MapKey) (*sticktable.EntryUpdate, int) {
+	now := a.now.Now()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	t, ok := a.tables[name]
+	if !ok {
+		return nil, 0
+	}
+
+	k, err := t.def.EncodeKey(key)
+	if err != nil {
+		return nil, 0
+	}
+
+	e, ok := t.entries[k]
+	if !ok {
+		return nil, 0
+	}
+
+	u, origins := e.aggregate(&t.def, now)
+	if u == nil {
+		return nil, 0
+	}
+
+	u.StickTable = t.def.Clone()
+	return u, origins
+}
+
+// Origin returns a copy of the latest update of the key in the table
+// received from origin.
+func (a *Aggregator) Origin(name string, key sticktable.MapKey, origin string) (*sticktable.EntryUpdate, bool) {
+	now := a.now.Now()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	t, ok := a.tables[name]
+	if !ok {
+		return nil, false
+	}
+
+	k, err := t.def.EncodeKey(key)
+	if err != nil {
+		return nil, false
+	}
+
+	e, ok := t.entries[k]
+	if !ok {
+		return nil, false
+	}
+
+	v, ok := e.origins[origin]
+	if !ok || v.expired(now) {
+		return nil, false
+	}
+
+	return (&sticktable.EntryUpdate{StickTable: t.def.Clone(), Key: e.key, Data: v.data}).Clone(), true
+}
+
+// Expire removes the expired values of all origins and returns the amount
+// of removed keys.
+func (a *Aggregator) Expire() int {
+	now := a.now.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	for _, t := range a.tables {
+		n += t.sweep(now)
+	}
+
+	return n
+}
+
+// sweep removes the expired values of the table and returns the amount of
+// removed keys.
+func (t *table) sweep(now time.Time) int {
+	var n int
+	for k, e := range t.entries {
+		for origin, v := range e.origins {
+			if v.expired(now) {
+				delete(e.origins, origin)
+			}
+		}
+
+		if len(e.origins) == 0 {
+			delete(t.entries, k)
+			n++
+		}
+	}
+
+	return n
+}
+
+// publish queues the aggregate for all connected peers.
+func (a *Aggregator) publish(u *sticktable.EntryUpdate) {
+	for _, s := range a.sessions.All() {
+		if !s.outbox.Push(u) {
+			log.Printf("publishing aggregate to %s: queue full, dropped oldest aggregate", s.origin)
+		}
+	}
+}
+
+// session is the handler of a single remote peer.
+type session struct {
+	aggregator *Aggregator
+	origin     string
+	outbox     *outbox.Outbox
+}
+
+var _ peers.Handler = (*session)(nil)
+
+func (s *session) HandleHandshake(ctx context.Context, h *peers.Handshake) {
+	s.origin = h.LocalPeerIdentifier
+	s.outbox = outbox.New(s.aggregator.QueueSize)
+
+	w := peers.WriterFromContext(ctx)
+	go func() {
+		if err := s.outbox.Run(ctx, w.SendEntries); err != nil && ctx.Err() == nil {
+			log.Printf("publishing aggregate to %s: %v", s.origin, err)
+		}
+	}()
+
+	s.aggregator.sessions.Add(s)
+}
+
+func (s *session) HandleUpdate(_ context.Context, u *sticktable.EntryUpdate) {
+	agg, err := s.aggregator.update(s.origin, u)
+	if err != nil {
+		log.Printf("aggregating update of %s: %v", s.origin, err)
+		return
+	}
+
+	if agg != nil {
+		s.aggregator.publish(agg)
+	}
+}
+
+func (s *session) Close() error {
+	s.aggregator.sessions.Remove(s)
+	return nil
+}
@@ -0,0 +1,154 @@
+package aggregate
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/peertest"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+const testDeclaration = "table st_src type string expire 1m store gpt0,gpc0,http_req_rate(10s)"
+
+type result struct {
+	GPT0, GPC0 uint32
+	Rate       uint64
+}
+
+func resultOf(u *sticktable.EntryUpdate) result {
+	return result{
+		GPT0: uint32(*u.Data[0].(*sticktable.UnsignedIntegerData)),
+		GPC0: uint32(*u.Data[1].(*sticktable.UnsignedIntegerData)),
+		Rate: u.Data[2].(*sticktable.FreqData).Rate(10*time.Second, 0),
+	}
+}
+
+func TestAggregatorLookup(t *testing.T) {
+	clock := time.UnixMilli(1700000000000)
+	a := &Aggregator{now: func() time.Time { return clock }}
+	def := peertest.Definition(t, testDeclaration)
+	key := sticktable.StringKey("a")
+
+	if _, err := a.update("haproxy_a", peertest.Update(t, def, "a", peertest.Entry{GPT0: 1, GPC0: 5, Rate: sticktable.NewFreqData(10)})); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(time.Second)
+	if _, err := a.update("haproxy_b", peertest.Update(t, def, "a", peertest.Entry{GPT0: 2, GPC0: 3, Rate: sticktable.FreqData{CurrentTick: 5000, CurrentPeriod: 4, LastPeriod: 8}})); err != nil {
+		t.Fatal(err)
+	}
+	// A newer update of an origin replaces its older one.
+	clock = clock.Add(time.Second)
+	if _, err := a.update("haproxy_a", peertest.Update(t, def, "a", peertest.Entry{GPT0: 3, GPC0: 7, Rate: sticktable.NewFreqData(10)})); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(5 * time.Second)
+
+	u, origins := a.Lookup(def.Name, &key)
+	if u == nil {
+		t.Fatal("expected aggregate")
+	}
+	if origins != 2 {
+		t.Errorf("expected 2 origins, got %d", origins)
+	}
+
+	// The current period of haproxy_b is 11s old, so its 4 events are
+	// the past period weighted by the remaining 9s.
+	want := result{GPT0: 3, GPC0: 10, Rate: 10 + 3}
+	if diff := cmp.Diff(want, resultOf(u)); diff != "" {
+		t.Errorf("aggregate mismatch (-want +got):\n%s", diff)
+	}
+
+	b, ok := a.Origin(def.Name, &key, "haproxy_b")
+	if !ok {
+		t.Fatal("expected value of haproxy_b")
+	}
+	if got := resultOf(b).GPC0; got != 3 {
+		t.Errorf("expected gpc0 3 of haproxy_b, got %d", got)
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		clock = clock.Add(54500 * time.Millisecond)
+		u, origins := a.Lookup(def.Name, &key)
+		if origins != 1 || resultOf(u).GPC0 != 7 {
+			t.Errorf("expected gpc0 7 of a single origin, got %d origins", origins)
+		}
+
+		clock = clock.Add(time.Second)
+		if n := a.Expire(); n != 1 {
+			t.Errorf("expected 1 expired key, got %d", n)
+		}
+		if u, _ := a.Lookup(def.Name, &key); u != nil {
+			t.Errorf("expected no aggregate, got %s", u)
+		}
+	})
+}
+
+func TestAggregatorSweep(t *testing.T) {
+	clock := time.UnixMilli(1700000000000)
+	a := &Aggregator{now: func() time.Time { return clock }}
+	def := peertest.Definition(t, testDeclaration)
+
+	if _, err := a.update("haproxy_a", peertest.Update(t, def, "old", peertest.Entry{GPC0: 1})); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(time.Minute)
+
+	// Expired keys are removed without calling Expire once the table
+	// received enough updates.
+	update := peertest.Update(t, def, "new", peertest.Entry{GPC0: 1})
+	for i := 1; i < sweepInterval; i++ {
+		if _, err := a.update("haproxy_a", update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(a.tables[def.Name].entries); n != 1 {
+		t.Errorf("expected 1 key after the sweep, got %d", n)
+	}
+}
+
+func TestAggregatorPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a := &Aggregator{Publish: map[string]string{"st_src": "st_src_global"}}
+	peer := &peers.Peer{BaseContext: ctx, HandlerSource: a.Handler}
+	go peer.Serve(l)
+
+	haproxyA := peertest.Dial(t, l.Addr().String(), "haproxy_a", "aggregator")
+	haproxyB := peertest.Dial(t, l.Addr().String(), "haproxy_b", "aggregator")
+
+	def := peertest.Definition(t, testDeclaration)
+	global := peertest.Definition(t, "table st_src_global type string expire 1m store gpt0,gpc0,http_req_rate(10s)")
+
+	haproxyA.SendUpdate(t, peertest.Update(t, def, "a", peertest.Entry{GPC0: 5}))
+	for _, c := range []*peertest.Conn{haproxyA, haproxyB} {
+		u := c.ReceiveUpdate(t)
+		if u.StickTable.Name != "st_src_global" || resultOf(u).GPC0 != 5 {
+			t.Errorf("%s: expected gpc0 5 of st_src_global, got %s", c.Name, u)
+		}
+	}
+
+	haproxyB.SendUpdate(t, peertest.Update(t, def, "a", peertest.Entry{GPC0: 2}))
+	for _, c := range []*peertest.Conn{haproxyA, haproxyB} {
+		u := c.ReceiveUpdate(t)
+		if resultOf(u).GPC0 != 7 {
+			t.Errorf("%s: expected gpc0 7, got %s", c.Name, u)
+		}
+	}
+
+	// Updates of the target table are not aggregated.
+	haproxyA.SendUpdate(t, peertest.Update(t, global, "a", peertest.Entry{GPC0: 7}))
+	haproxyA.ExpectNothing(t, 50*time.Millisecond)
+}
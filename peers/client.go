@@ -0,0 +1,96 @@
+package peers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
+)
+
+// DialAndServe connects to the remote peer at addr and serves the session
+// like a session accepted by Serve, until the session ends or ctx is done.
+// addr may be a unix socket like unix@/run/peers.sock. remote is the name
+// of the remote peer in its peers section, the local name is Name or the
+// hostname if empty.
+//
+// The handler sees the handshake from the point of view of the remote
+// peer, so LocalPeerIdentifier is the name of the remote peer. Nothing is
+// requested after the handshake, use Writer.SendSyncRequest to be taught
+// the tables of the remote peer. DialAndServe does not reconnect.
+//
+// With TLSConfig the certificate of the remote peer is verified like by
+// tls.Dial and, if CertificatePeers is set, it has to be mapped to the
+// name remote.
+func (a *Peer) DialAndServe(ctx context.Context, addr, remote string) error {
+	if err := a.checkHandler(); err != nil {
+		return err
+	}
+
+	var d interface {
+		DialContext(context.Context, string, string) (net.Conn, error)
+	} = &net.Dialer{}
+	if a.TLSConfig != nil {
+		d = &tls.Dialer{Config: a.TLSConfig}
+	}
+	network, address := socket.Network(addr)
+	nc, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("dialing peer: %w", err)
+	}
+
+	p := a.newSession(ctx, nc, a.newHandler())
+	p.dialed = NewHandshakeFrom(a.Name, remote)
+	if !a.trackSession(p, true) {
+		nc.Close()
+		return ErrPeerClosed
+	}
+
+	return a.serveSession(p, nc)
+}
+
+// clientHandshake sends the handshake of a dialed session and reads the
+// status of the remote peer.
+func (c *protocolClient) clientHandshake() error {
+	c.wmu.Lock()
+	_, err := c.dialed.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("writing handshake: %w", err)
+	}
+
+	var n int64
+	line, err := readHandshakeLine(c.br, &n)
+	if err != nil {
+		return fmt.Errorf("reading status: %w", err)
+	}
+	code, err := strconv.Atoi(line)
+	if err != nil {
+		return fmt.Errorf("malformed status line: %q", line)
+	}
+	if status := HandshakeStatus(code); status != HandshakeStatusHandshakeSucceeded {
+		return fmt.Errorf("rejected by peer %q: %w", c.dialed.RemotePeer, status)
+	}
+
+	if err := c.verifyCertificate(c.dialed.RemotePeer); err != nil {
+		return err
+	}
+
+	// The handler expects the handshake of the remote peer.
+	remote := *c.dialed
+	remote.RemotePeer, remote.LocalPeerIdentifier = c.dialed.LocalPeerIdentifier, c.dialed.RemotePeer
+	remote.ProcessID = 0
+	if v, ok := c.handler.(HandshakeValidator); ok {
+		if err := v.ValidateHandshake(c.ctx, &remote); err != nil {
+			return fmt.Errorf("handler rejected peer %q: %w", remote.LocalPeerIdentifier, err)
+		}
+	}
+	c.handler.HandleHandshake(c.ctx, &remote)
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func TestPeerDialAndServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	def := &sticktable.Definition{
+		Name:      "st_a",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 32,
+	}
+
+	server := &Peer{
+		BaseContext:  ctx,
+		Name:         "server",
+		AllowedPeers: []string{"client"},
+		Handler:      &syncHandler{def: def},
+	}
+	go server.Serve(l)
+
+	handshakes := make(chan Handshake, 1)
+	updates := make(chan string, 1)
+	client := &Peer{
+		Name: "client",
+		Handler: &testHandler{
+			onHandshake: func(ctx context.Context, h *Handshake) {
+				handshakes <- *h
+				if err := WriterFromContext(ctx).SendSyncRequest(); err != nil {
+					t.Errorf("sending sync request: %v", err)
+				}
+			},
+			onUpdate: func(_ context.Context, u *sticktable.EntryUpdate) {
+				updates <- u.StickTable.Name + "/" + u.Key.String()
+			},
+		},
+	}
+
+	clientCtx, clientCancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- client.DialAndServe(clientCtx, l.Addr().String(), "server") }()
+
+	select {
+	case h := <-handshakes:
+		if h.LocalPeerIdentifier != "server" || h.RemotePeer != "client" {
+			t.Errorf("expected handshake of server to client, got %+v", h)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for handshake")
+	}
+
+	select {
+	case u := <-updates:
+		if u != "st_a/key" {
+			t.Errorf("expected st_a/key, got %s", u)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for update")
+	}
+
+	clientCancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error after cancel, got %v", err)
+	}
+}
+
+func TestPeerDialAndServeRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := &Peer{BaseContext: ctx, Name: "server", Handler: &testHandler{}}
+	go server.Serve(l)
+
+	client := &Peer{Name: "client", Handler: &testHandler{}}
+	err = client.DialAndServe(ctx, l.Addr().String(), "other")
+	if !errors.Is(err, HandshakeStatusLocalPeerIdentifierMismatch) {
+		t.Errorf("expected %v, got %v", HandshakeStatusLocalPeerIdentifierMismatch, err)
+	}
+}
@@ -1,5 +1,7 @@
 package peers
 
+import "fmt"
+
 //go:generate stringer -type HandshakeStatus,MessageClass,ControlMessageType,ErrorMessageType,StickTableUpdateMessageType -output=constants_string.go
 
 // HandshakeStatus represents the Handshake States
@@ -29,6 +31,26 @@ const (
 	HandshakeStatusRemotePeerIdentifierMismatch HandshakeStatus = 504
 )
 
+// Error implements the error interface, so a Handler can reject a
+// handshake with a specific status.
+func (s HandshakeStatus) Error() string {
+	return fmt.Sprintf("handshake status %d: %s", int(s), s.String())
+}
+
+// rejects reports whether the status rejects a remote peer.
+func (s HandshakeStatus) rejects() bool {
+	switch s {
+	case HandshakeStatusTryAgainLater,
+		HandshakeStatusProtocolError,
+		HandshakeStatusBadVersion,
+		HandshakeStatusLocalPeerIdentifierMismatch,
+		HandshakeStatusRemotePeerIdentifierMismatch:
+		return true
+	default:
+		return false
+	}
+}
+
 // MessageClass represents the message classes.
 // There exist four classes of messages:
 // +------------+---------------------+--------------+
@@ -0,0 +1,122 @@
+package peers
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// dictCacheSize is the amount of dictionary entries cached per direction of
+// a peer session. Same as PEER_STKT_CACHE_MAX_ENTRIES in HAProxy.
+const dictCacheSize = 128
+
+// dictRxCache stores the dictionary entries received on a peer session.
+// HAProxy sends the value of an entry only once and references it by
+// its ID in all following updates.
+type dictRxCache struct {
+	entries [dictCacheSize][]byte
+}
+
+// resolve stores the value of d in the cache or, when d only carries an ID,
+// fills in the value that was previously received for that ID.
+func (c *dictRxCache) resolve(d *sticktable.DictData) error {
+	// No entry
+	if d.ID == 0 {
+		return nil
+	}
+
+	// IDs sent over the network are numbered from 1.
+	if d.ID > dictCacheSize {
+		return fmt.Errorf("dict entry id out of range: %d", d.ID)
+	}
+
+	// Values are copied in both directions, as the cache and the update
+	// each reuse their buffers.
+	if len(d.Value) > 0 {
+		c.entries[d.ID-1] = append(c.entries[d.ID-1][:0], d.Value...)
+		return nil
+	}
+
+	// HAProxy tolerates references to unknown entries, so do we.
+	d.Value = append(d.Value[:0], c.entries[d.ID-1]...)
+	return nil
+}
+
+// dictTxCache keeps track of the dictionary entries sent on a peer session.
+// Like HAProxy, entries are replaced in a round-robin fashion once the
+// cache is full. Values encoded for a message are pending until the message
+// was written, so the cache only holds values the remote peer learned.
+type dictTxCache struct {
+	ids     map[string]uint64
+	entries [dictCacheSize]string
+	next    int
+	// pending holds the new values encoded since the last commit or
+	// discard, in the order their IDs were assigned.
+	pending [][]byte
+}
+
+// encode returns the representation of d to be sent on the session: only the
+// ID if the value was already sent, otherwise the value with a newly assigned
+// ID. New values are added to the cache by commit. The ID set on d is
+// ignored.
+func (c *dictTxCache) encode(d *sticktable.DictData) sticktable.DictData {
+	cached, known := c.peek(d)
+	if !known && cached.ID != 0 {
+		c.pending = append(c.pending, d.Value)
+	}
+
+	return cached
+}
+
+// peek returns the representation encode would return for d without
+// changing the cache. It reports whether the value was already sent or is
+// pending.
+func (c *dictTxCache) peek(d *sticktable.DictData) (sticktable.DictData, bool) {
+	if len(d.Value) == 0 {
+		return sticktable.DictData{}, false
+	}
+
+	if id, ok := c.ids[string(d.Value)]; ok {
+		return sticktable.DictData{ID: id}, true
+	}
+
+	for i, v := range c.pending {
+		if bytes.Equal(v, d.Value) {
+			return sticktable.DictData{ID: c.id(i)}, true
+		}
+	}
+
+	return sticktable.DictData{ID: c.id(len(c.pending)), Value: d.Value}, false
+}
+
+// id returns the ID of the i-th value added from now on.
+func (c *dictTxCache) id(i int) uint64 {
+	return uint64((c.next+i)%dictCacheSize) + 1
+}
+
+// commit adds the pending values to the cache once the message encoding
+// them was written.
+func (c *dictTxCache) commit() {
+	if len(c.pending) > 0 && c.ids == nil {
+		c.ids = make(map[string]uint64, dictCacheSize)
+	}
+
+	for _, v := range c.pending {
+		if old := c.entries[c.next]; old != "" {
+			delete(c.ids, old)
+		}
+
+		c.entries[c.next] = string(v)
+		c.ids[c.entries[c.next]] = uint64(c.next) + 1
+		c.next = (c.next + 1) % dictCacheSize
+	}
+
+	c.discard()
+}
+
+// discard drops the pending values of a message that was not written.
+func (c *dictTxCache) discard() {
+	clear(c.pending)
+	c.pending = c.pending[:0]
+}
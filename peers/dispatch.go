@@ -0,0 +1,215 @@
+package peers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to an update when the update queue
+// of a session is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading from the session until the handler
+	// made room in the queue. No updates are lost, updates still queued
+	// when the session ends are passed to the handler before it is closed.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued update. Updates still
+	// queued when the session ends are dropped as well.
+	OverflowDropOldest
+	// OverflowCoalesce replaces a queued update for the same table and key
+	// with the newer one, even if the queue is not full. If there is no
+	// such update, the oldest queued update is dropped. Updates still
+	// queued when the session ends are dropped.
+	OverflowCoalesce
+)
+
+// DispatchStats are the counters of the asynchronous update dispatch of
+// all sessions of a Peer.
+type DispatchStats struct {
+	// Queued is the amount of updates put into a queue.
+	Queued uint64
+	// Dropped is the amount of updates dropped because a queue was full.
+	Dropped uint64
+	// Coalesced is the amount of queued updates replaced by a newer
+	// update for the same key.
+	Coalesced uint64
+}
+
+type dispatchStats struct {
+	queued    atomic.Uint64
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+func (s *dispatchStats) load() DispatchStats {
+	return DispatchStats{
+		Queued:    s.queued.Load(),
+		Dropped:   s.dropped.Load(),
+		Coalesced: s.coalesced.Load(),
+	}
+}
+
+// DispatchStats returns the counters of the asynchronous update dispatch.
+func (a *Peer) DispatchStats() DispatchStats {
+	return a.dispatchStats.load()
+}
+
+// updateQueue is the bounded queue of updates of a single session.
+type updateQueue struct {
+	policy OverflowPolicy
+	stats  *dispatchStats
+
+	mu    sync.Mutex
+	items []queuedUpdate
+	head  int
+	size  int
+	// seq is the sequence number of the item at head, used to find
+	// queued updates by key for coalescing.
+	seq  uint64
+	keys map[string]uint64
+	// closed is set once the session ended, later updates are released.
+	closed bool
+
+	notEmpty chan struct{}
+	notFull  chan struct{}
+}
+
+type queuedUpdate struct {
+	u   *pooledUpdate
+	key string
+}
+
+func newUpdateQueue(size int, policy OverflowPolicy, stats *dispatchStats) *updateQueue {
+	q := &updateQueue{
+		policy:   policy,
+		stats:    stats,
+		items:    make([]queuedUpdate, size),
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+
+	if policy == OverflowCoalesce {
+		q.keys = make(map[string]uint64, size)
+	}
+
+	return q
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// offer adds the update to the queue according to the overflow policy.
+// It reports false if the queue is full and the policy is OverflowBlock.
+// Dropped and replaced updates are released.
+func (q *updateQueue) offer(u *pooledUpdate) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		u.release()
+		return true
+	}
+
+	var key string
+	if q.policy == OverflowCoalesce {
+		key = u.StickTable.Name + "\x00" + u.Key.String()
+		if seq, ok := q.keys[key]; ok {
+			item := &q.items[(q.head+int(seq-q.seq))%len(q.items)]
+			item.u.release()
+			item.u = u
+			q.stats.coalesced.Add(1)
+			return true
+		}
+	}
+
+	if q.size == len(q.items) {
+		if q.policy == OverflowBlock {
+			return false
+		}
+
+		q.popLocked().release()
+		q.stats.dropped.Add(1)
+	}
+
+	q.items[(q.head+q.size)%len(q.items)] = queuedUpdate{u: u, key: key}
+	if q.keys != nil {
+		q.keys[key] = q.seq + uint64(q.size)
+	}
+	q.size++
+	q.stats.queued.Add(1)
+
+	signal(q.notEmpty)
+	return true
+}
+
+// push adds the update to the queue and waits for room in the queue if
+// necessary.
+func (q *updateQueue) push(ctx context.Context, u *pooledUpdate) error {
+	for !q.offer(u) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.notFull:
+		}
+	}
+
+	return nil
+}
+
+// pop waits for the next update in the queue.
+func (q *updateQueue) pop(ctx context.Context) (*pooledUpdate, error) {
+	for {
+		q.mu.Lock()
+		if q.size > 0 {
+			u := q.popLocked()
+			q.mu.Unlock()
+
+			signal(q.notFull)
+			return u, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.notEmpty:
+		}
+	}
+}
+
+// close removes all updates from the queue and returns them, oldest first.
+// Updates offered afterwards are released.
+func (q *updateQueue) close() []*pooledUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	updates := make([]*pooledUpdate, 0, q.size)
+	for q.size > 0 {
+		updates = append(updates, q.popLocked())
+	}
+
+	return updates
+}
+
+// popLocked removes the oldest update. Caller MUST hold the mutex.
+func (q *updateQueue) popLocked() *pooledUpdate {
+	item := q.items[q.head]
+	q.items[q.head] = queuedUpdate{}
+
+	if q.keys != nil && q.keys[item.key] == q.seq {
+		delete(q.keys, item.key)
+	}
+
+	q.head = (q.head + 1) % len(q.items)
+	q.size--
+	q.seq++
+
+	return item.u
+}
@@ -0,0 +1,301 @@
+package peers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func testQueueUpdate(def *sticktable.Definition, key string, value uint32) *pooledUpdate {
+	k := sticktable.StringKey(key)
+	v := sticktable.UnsignedIntegerData(value)
+	return &pooledUpdate{
+		EntryUpdate: sticktable.EntryUpdate{
+			StickTable: def,
+			Key:        &k,
+			Data:       []sticktable.MapData{&v},
+		},
+		table: &rxTable{def: def},
+	}
+}
+
+func testSendUpdate(def *sticktable.Definition, key string, value uint32) *sticktable.EntryUpdate {
+	return &testQueueUpdate(def, key, value).EntryUpdate
+}
+
+func popAll(t *testing.T, q *updateQueue) []string {
+	t.Helper()
+
+	var got []string
+	for {
+		q.mu.Lock()
+		size := q.size
+		q.mu.Unlock()
+		if size == 0 {
+			return got
+		}
+
+		u, err := q.pop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s=%s", u.Key, u.Data[0]))
+	}
+}
+
+func TestUpdateQueue(t *testing.T) {
+	def := &sticktable.Definition{Name: "queue"}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		var stats dispatchStats
+		q := newUpdateQueue(2, OverflowDropOldest, &stats)
+		for i, key := range []string{"a", "b", "c"} {
+			if !q.offer(testQueueUpdate(def, key, uint32(i))) {
+				t.Fatal("offer rejected update")
+			}
+		}
+
+		if got := fmt.Sprint(popAll(t, q)); got != "[b=1 c=2]" {
+			t.Errorf("unexpected queue content %s", got)
+		}
+		if s := stats.load(); s.Dropped != 1 || s.Queued != 3 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		var stats dispatchStats
+		q := newUpdateQueue(2, OverflowCoalesce, &stats)
+		for i, key := range []string{"a", "b", "a", "c", "c"} {
+			if !q.offer(testQueueUpdate(def, key, uint32(i))) {
+				t.Fatal("offer rejected update")
+			}
+		}
+
+		if got := fmt.Sprint(popAll(t, q)); got != "[b=1 c=4]" {
+			t.Errorf("unexpected queue content %s", got)
+		}
+		if s := stats.load(); s.Dropped != 1 || s.Coalesced != 2 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+
+		// Keys of popped updates must not be coalesced anymore.
+		q.offer(testQueueUpdate(def, "c", 5))
+		if got := fmt.Sprint(popAll(t, q)); got != "[c=5]" {
+			t.Errorf("unexpected queue content %s", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		var stats dispatchStats
+		q := newUpdateQueue(1, OverflowBlock, &stats)
+		if !q.offer(testQueueUpdate(def, "a", 0)) {
+			t.Fatal("offer rejected update")
+		}
+		if q.offer(testQueueUpdate(def, "b", 1)) {
+			t.Fatal("offer accepted update into full queue")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := q.push(ctx, testQueueUpdate(def, "b", 1)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected push to block until deadline, got %v", err)
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- q.push(context.Background(), testQueueUpdate(def, "b", 1))
+		}()
+
+		if _, err := q.pop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fmt.Sprint(popAll(t, q)); got != "[b=1]" {
+			t.Errorf("unexpected queue content %s", got)
+		}
+	})
+}
+
+// TestCloseFullQueue verifies that the updates queued when a session is
+// closed are passed or dropped before the handler is closed.
+func TestCloseFullQueue(t *testing.T) {
+	def := &sticktable.Definition{Name: "queue"}
+
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		want    string
+		dropped uint64
+	}{
+		{"block", OverflowBlock, "[a b c]", 0},
+		{"drop oldest", OverflowDropOldest, "[a]", 2},
+		{"coalesce", OverflowCoalesce, "[a]", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := &Peer{UpdateQueueSize: 2, UpdateQueueOverflow: tt.policy}
+
+			var got []string
+			closed := make(chan struct{})
+			started := make(chan struct{})
+			h := &closeHandler{closed: closed}
+			h.onUpdate = func(ctx context.Context, u *sticktable.EntryUpdate) {
+				select {
+				case <-closed:
+					t.Error("update handled after the handler was closed")
+				default:
+				}
+				got = append(got, u.Key.String())
+
+				// The first update blocks the dispatcher until the session
+				// ends, so the following ones fill the queue.
+				if len(got) == 1 {
+					close(started)
+					<-ctx.Done()
+				}
+			}
+			c := newProtocolClient(context.Background(), peer, &bytes.Buffer{}, h, &sync.Mutex{}, nil)
+
+			if err := c.dispatchUpdate(testQueueUpdate(def, "a", 0)); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			for i, key := range []string{"b", "c"} {
+				if err := c.dispatchUpdate(testQueueUpdate(def, key, uint32(i+1))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-closed:
+			default:
+				t.Error("handler was not closed")
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("expected updates %s, got %v", tt.want, got)
+			}
+			if s := peer.DispatchStats(); s.Dropped != tt.dropped {
+				t.Errorf("expected %d dropped updates, got %+v", tt.dropped, s)
+			}
+
+			// Updates received after the session ended are not queued.
+			if err := c.dispatchUpdate(testQueueUpdate(def, "d", 3)); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("expected no more updates, got %v", got)
+			}
+		})
+	}
+}
+
+// TestAsyncDispatchSlowHandler verifies that a blocked handler does not stall
+// reading from the session when asynchronous dispatch is enabled.
+func TestAsyncDispatchSlowHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	peer := &Peer{
+		BaseContext:         ctx,
+		DeadPeerTimeout:     200 * time.Millisecond,
+		UpdateQueueSize:     2,
+		UpdateQueueOverflow: OverflowDropOldest,
+		Handler: HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+			signal(started)
+			<-release
+			received <- u.Key.String()
+		}),
+	}
+	go peer.Serve(l)
+
+	conn := helperDialPeer(t, l.Addr().String(), "peer_a", "peer_b")
+	defer conn.Close()
+
+	w := newWriter(conn, &sync.Mutex{})
+	def := &sticktable.Definition{
+		Name:      "slow",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 32,
+		DataTypes: []sticktable.DataTypeDefinition{{DataType: sticktable.DataTypeGPC0}},
+	}
+	if err := w.SendTableDefinition(def); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first update blocks the handler, the following ones overflow
+	// the queue while the session keeps reading.
+	for i := 0; i < 10; i++ {
+		if err := w.SendEntry(testSendUpdate(def, fmt.Sprintf("key_%d", i), uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			select {
+			case <-started:
+			case <-ctx.Done():
+				t.Fatal("timeout waiting for handler")
+			}
+		}
+	}
+
+	for peer.DispatchStats().Queued < 10 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timeout waiting for updates to be queued: %+v", peer.DispatchStats())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Keep the session alive for longer than the dead peer timeout while
+	// the handler is still blocked.
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte{byte(MessageClassControl), byte(ControlMessageHeartbeat)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(release)
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case k := <-received:
+			got = append(got, k)
+		case <-ctx.Done():
+			t.Fatalf("timeout waiting for updates, got %v", got)
+		}
+	}
+
+	if fmt.Sprint(got[1:]) != "[key_8 key_9]" {
+		t.Errorf("expected the latest updates to be kept, got %v", got)
+	}
+	if s := peer.DispatchStats(); s.Dropped != 7 {
+		t.Errorf("expected 7 dropped updates, got %+v", s)
+	}
+}
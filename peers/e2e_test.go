@@ -67,6 +67,77 @@ backend st_src_global
 	})
 }
 
+func TestE2EArrayDataTypes(t *testing.T) {
+	updates := make(chan *sticktable.EntryUpdate, 64)
+	a := Peer{Handler: HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+		updates <- u
+	})}
+
+	l := testutil.TCPListener(t)
+	go a.Serve(l)
+
+	cfg := testutil.HAProxyConfig{
+		FrontendPort: fmt.Sprintf("%d", testutil.TCPPort(t)),
+		CustomFrontendConfig: `
+	http-request track-sc0 src table st_arrays
+	http-request sc-inc-gpc(1,0)
+`,
+		CustomConfig: `
+backend st_arrays
+	stick-table type ip size 1m expire 10m store gpc(3),gpc_rate(3,10s) peers mypeers
+`,
+		PeerAddr: l.Addr().String(),
+	}
+
+	t.Run("receive arrays", func(t *testing.T) {
+		cfg.Run(t)
+
+		for i := 0; i < 5; i++ {
+			resp, err := http.Get("http://127.0.0.1:" + cfg.FrontendPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		tm := time.NewTimer(5 * time.Second)
+		defer tm.Stop()
+		for {
+			var u *sticktable.EntryUpdate
+			select {
+			case u = <-updates:
+			case <-tm.C:
+				t.Fatal("timeout")
+			}
+
+			log.Println(u)
+
+			for _, dt := range u.StickTable.DataTypes {
+				if dt.Elements != 3 {
+					t.Fatalf("expected 3 elements for %s, got %d", dt.DataType, dt.Elements)
+				}
+			}
+
+			gpc := u.Data[0].(*sticktable.UnsignedIntegerArrayData)
+			gpcRate := u.Data[1].(*sticktable.FreqArrayData)
+			if len(*gpc) != 3 || len(*gpcRate) != 3 {
+				t.Fatalf("expected arrays of 3 elements, got %d and %d", len(*gpc), len(*gpcRate))
+			}
+
+			if (*gpc)[0] != 0 || (*gpc)[2] != 0 {
+				t.Fatalf("expected only gpc[1] to be incremented, got %v", gpc)
+			}
+
+			if (*gpc)[1] == 5 {
+				if (*gpcRate)[1].CurrentPeriod != 5 {
+					t.Errorf("expected gpc_rate[1] of 5, got %v", (*gpcRate)[1].String())
+				}
+				return
+			}
+		}
+	})
+}
+
 func TestE2EWriter(t *testing.T) {
 	writerCh := make(chan *Writer, 1)
 	a := Peer{HandlerSource: func() Handler {
@@ -4,8 +4,11 @@ go 1.21
 
 replace github.com/dropmorepackets/haproxy-go => ../../../
 
+replace github.com/dropmorepackets/haproxy-go/peers/exporter => ../../exporter
+
 require (
 	github.com/dropmorepackets/haproxy-go v0.0.2
+	github.com/dropmorepackets/haproxy-go/peers/exporter v0.0.0-00010101000000-000000000000
 	github.com/prometheus/client_golang v1.17.0
 )
 
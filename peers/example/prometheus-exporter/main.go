@@ -1,47 +1,35 @@
 package main
 
 import (
-	"context"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/dropmorepackets/haproxy-go/peers"
-	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+	"github.com/dropmorepackets/haproxy-go/peers/exporter"
+	"github.com/dropmorepackets/haproxy-go/peers/mirror"
 )
 
-var metric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: "haproxy",
-	Subsystem: "stick_table",
-	Name:      "data",
-	Help:      "",
-}, []string{"table", "type", "key"})
-
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	go http.ListenAndServe(":8081", promhttp.Handler())
+	var store mirror.Store
+	prometheus.MustRegister(exporter.NewCollector(&store, exporter.Options{
+		Default: exporter.TableOptions{MaxKeys: 1000},
+	}))
 
-	err := peers.ListenAndServe(":21000", peers.HandlerFunc(func(_ context.Context, update *sticktable.EntryUpdate) {
-		for i, d := range update.Data {
-			dt := update.StickTable.DataTypes[i].DataType
-			switch d := d.(type) {
-			case *sticktable.FreqData:
-				metric.WithLabelValues(update.StickTable.Name, dt.String(), update.Key.String()).Set(float64(d.LastPeriod))
-			case *sticktable.SignedIntegerData:
-				metric.WithLabelValues(update.StickTable.Name, dt.String(), update.Key.String()).Set(float64(*d))
-			case *sticktable.UnsignedIntegerData:
-				metric.WithLabelValues(update.StickTable.Name, dt.String(), update.Key.String()).Set(float64(*d))
-			case *sticktable.UnsignedLongLongData:
-				metric.WithLabelValues(update.StickTable.Name, dt.String(), update.Key.String()).Set(float64(*d))
-			}
+	go func() {
+		for range time.Tick(time.Minute) {
+			store.Expire()
 		}
-	}))
+	}()
+
+	go http.ListenAndServe(":8081", promhttp.Handler())
 
-	if err != nil {
+	if err := peers.ListenAndServe(":21000", &store); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,7 +1,7 @@
 // push is an example that demonstrates how to push stick table entries
 // to HAProxy over an existing peer connection. When HAProxy connects to
 // this peer, the handler uses WriterFromContext to obtain a Writer and
-// sends a table definition followed by entry updates.
+// sends entry updates. The Writer sends the table definition on its own.
 package main
 
 import (
@@ -22,31 +22,26 @@ func main() {
 		// Get the writer for this connection to push entries back.
 		w := peers.WriterFromContext(ctx)
 
-		// Define the stick table we want to push to.
-		// Matches: stick-table type ip size 200k expire 5m store gpc0 peers local-peers
-		tableDef := &sticktable.Definition{
-			StickTableID: 0,
-			Name:         "my_blocklist",
-			KeyType:      sticktable.KeyTypeIPv4Address,
-			KeyLength:    4,
-			DataTypes: []sticktable.DataTypeDefinition{
-				{DataType: sticktable.DataTypeGPC0},
-			},
-			Expiry: 300000, // 5 minutes in ms
+		// Define the stick table we want to push to, as declared in the
+		// peers section of HAProxy.
+		tableDef, err := sticktable.ParseDefinition("table my_blocklist type ip size 200k expire 5m store gpc0")
+		if err != nil {
+			log.Printf("error parsing table: %v", err)
+			return
 		}
 
-		if err := w.SendTableDefinition(tableDef); err != nil {
-			log.Printf("error sending table definition: %v", err)
+		// Push an entry marking an IP as blocked (gpc0 = 1).
+		b := sticktable.NewEntryBuilder(tableDef)
+		if err := b.SetUint(sticktable.DataTypeGPC0, 1); err != nil {
+			log.Printf("error setting gpc0: %v", err)
 			return
 		}
 
-		// Push an entry marking an IP as blocked (gpc0 = 1).
 		key := sticktable.IPv4AddressKey(netip.MustParseAddr("10.0.0.1"))
-		gpc0 := sticktable.UnsignedIntegerData(1)
-		entry := &sticktable.EntryUpdate{
-			StickTable: tableDef,
-			Key:        &key,
-			Data:       []sticktable.MapData{&gpc0},
+		entry, err := b.Build(&key)
+		if err != nil {
+			log.Printf("error building entry: %v", err)
+			return
 		}
 
 		if err := w.SendEntry(entry); err != nil {
@@ -0,0 +1,268 @@
+// Package exporter exports mirrored stick tables as Prometheus metrics.
+//
+// The Collector reads the entries of a table store, like mirror.Store, on
+// every scrape. Series of expired entries disappear with the entries, the
+// amount of series per table can be capped to the top entries.
+package exporter
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dropmorepackets/haproxy-go/peers/internal/clock"
+	"github.com/dropmorepackets/haproxy-go/peers/mirror"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// Store is the source of the exported stick tables. It is implemented by
+// *mirror.Store.
+type Store interface {
+	Tables() []sticktable.Definition
+	Range(table string, fn func(mirror.Entry) bool)
+}
+
+var _ Store = (*mirror.Store)(nil)
+
+// TableOptions configure the export of a table.
+type TableOptions struct {
+	// MaxKeys caps the amount of exported keys. If the table has more
+	// entries, only the keys with the highest value of TopBy are
+	// exported. All keys are exported if zero.
+	MaxKeys int
+	// TopBy is the data type keys are ranked by if MaxKeys is exceeded.
+	// Defaults to the first data type of the table with a numeric value.
+	// Arrays are ranked by the sum of their elements.
+	TopBy *sticktable.DataType
+}
+
+// Options configure a Collector.
+type Options struct {
+	// Namespace and Subsystem prefix the metric names. They default to
+	// "haproxy" and "stick_table".
+	Namespace string
+	Subsystem string
+
+	// Tables configures the export per table name. Tables without options
+	// use Default.
+	Tables  map[string]TableOptions
+	Default TableOptions
+	// Skip excludes tables from the export.
+	Skip func(table string) bool
+
+	// KeyLabels are the names of the labels of a key. Defaults to "key".
+	KeyLabels []string
+	// KeyLabelValues returns the values of KeyLabels for a key of a
+	// table. Entries are skipped if it returns nil. Entries with the same
+	// label values are exported as one series with the sum of their
+	// values. Defaults to the string representation of the key.
+	KeyLabelValues func(table string, key sticktable.MapKey) []string
+}
+
+// Collector is a prometheus.Collector for stick tables. Every numeric value
+// of an entry is exported as series of haproxy_stick_table_data, labeled by
+// the table, the data type and the key. Rates are computed from the
+// frequency counters like HAProxy does.
+type Collector struct {
+	store Store
+	opts  Options
+
+	data    *prometheus.Desc
+	entries *prometheus.Desc
+
+	now clock.Func
+}
+
+// NewCollector returns a Collector of the tables of store.
+func NewCollector(store Store, opts Options) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "haproxy"
+	}
+	if opts.Subsystem == "" {
+		opts.Subsystem = "stick_table"
+	}
+	if opts.KeyLabels == nil {
+		opts.KeyLabels = []string{"key"}
+	}
+	if opts.KeyLabelValues == nil {
+		opts.KeyLabelValues = func(_ string, key sticktable.MapKey) []string {
+			return []string{key.String()}
+		}
+	}
+
+	return &Collector{
+		store: store,
+		opts:  opts,
+		data: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "data"),
+			"Value of a stick-table entry, rates are events per period of the data type.",
+			append([]string{"table", "type"}, opts.KeyLabels...),
+			nil,
+		),
+		entries: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "entries"),
+			"Amount of entries of a stick table, including entries that are not exported.",
+			[]string{"table"},
+			nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.data
+	ch <- c.entries
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now.Now()
+
+	for _, def := range c.store.Tables() {
+		if c.opts.Skip != nil && c.opts.Skip(def.Name) {
+			continue
+		}
+
+		opts, ok := c.opts.Tables[def.Name]
+		if !ok {
+			opts = c.opts.Default
+		}
+
+		entries := c.collectTable(ch, &def, opts, now)
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(entries), def.Name)
+	}
+}
+
+// series are the values of an entry.
+type series struct {
+	labels []string
+	values []value
+	score  float64
+}
+
+type value struct {
+	dataType string
+	value    float64
+}
+
+// add sums the values of o, an entry of the same table with the same
+// labels.
+func (s *series) add(o series) {
+	s.score += o.score
+	for i := range s.values {
+		s.values[i].value += o.values[i].value
+	}
+}
+
+// collectTable sends the series of the table and returns the amount of
+// entries.
+func (c *Collector) collectTable(ch chan<- prometheus.Metric, def *sticktable.Definition, opts TableOptions, now time.Time) int {
+	topBy := topIndex(def, opts.TopBy)
+
+	var entries int
+	var all []series
+	// index holds the position of the series by their joined labels, as
+	// keys may map to the same labels.
+	index := make(map[string]int)
+	c.store.Range(def.Name, func(e mirror.Entry) bool {
+		entries++
+
+		labels := c.opts.KeyLabelValues(def.Name, e.Key)
+		if labels == nil {
+			return true
+		}
+
+		s := series{labels: labels}
+		for i, dt := range def.DataTypes {
+			values := values(dt, e.Data[i], now.Sub(e.Updated))
+			if i == topBy {
+				for _, v := range values {
+					s.score += v.value
+				}
+			}
+			s.values = append(s.values, values...)
+		}
+
+		id := strings.Join(labels, "\xff")
+		if i, ok := index[id]; ok {
+			all[i].add(s)
+			return true
+		}
+		index[id] = len(all)
+		all = append(all, s)
+
+		return true
+	})
+
+	if opts.MaxKeys > 0 && len(all) > opts.MaxKeys {
+		slices.SortFunc(all, func(a, b series) int {
+			return cmp.Compare(b.score, a.score)
+		})
+		all = all[:opts.MaxKeys]
+	}
+
+	for _, s := range all {
+		for _, v := range s.values {
+			labels := append([]string{def.Name, v.dataType}, s.labels...)
+			ch <- prometheus.MustNewConstMetric(c.data, prometheus.GaugeValue, v.value, labels...)
+		}
+	}
+
+	return entries
+}
+
+// topIndex returns the index of the data type entries are ranked by.
+func topIndex(def *sticktable.Definition, topBy *sticktable.DataType) int {
+	for i, dt := range def.DataTypes {
+		if topBy != nil && dt.DataType == *topBy {
+			return i
+		}
+		if topBy == nil && numeric(dt.DataType) {
+			return i
+		}
+	}
+	return -1
+}
+
+// numeric reports whether a data type has a numeric value.
+func numeric(t sticktable.DataType) bool {
+	return t != sticktable.DataTypeServerKey
+}
+
+// values returns the numeric values of the data. Array elements are
+// exported with their index, like gpc(0). The current tick of frequency
+// counters is elapsed old.
+func values(dt sticktable.DataTypeDefinition, d sticktable.MapData, elapsed time.Duration) []value {
+	name := dt.DataType.String()
+
+	switch v := sticktable.DataValue(dt, d, elapsed).(type) {
+	case uint32:
+		return []value{{name, float64(v)}}
+	case uint64:
+		return []value{{name, float64(v)}}
+	case int32:
+		return []value{{name, float64(v)}}
+	case []uint32:
+		return elementValues(name, v)
+	case []uint64:
+		return elementValues(name, v)
+	default:
+		return nil
+	}
+}
+
+func elementValues[T uint32 | uint64](name string, elements []T) []value {
+	v := make([]value, len(elements))
+	for i, e := range elements {
+		v[i] = value{elementName(name, i), float64(e)}
+	}
+	return v
+}
+
+func elementName(name string, i int) string {
+	return name + "(" + strconv.Itoa(i) + ")"
+}
@@ -0,0 +1,248 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dropmorepackets/haproxy-go/peers/mirror"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// testStore is a Store with fixed entries.
+type testStore struct {
+	defs    []sticktable.Definition
+	entries map[string][]mirror.Entry
+}
+
+func (s *testStore) Tables() []sticktable.Definition { return s.defs }
+
+func (s *testStore) Range(table string, fn func(mirror.Entry) bool) {
+	for _, e := range s.entries[table] {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+var start = time.UnixMilli(1700000000000)
+
+func testEntry(key string, gpc0 uint32, rate sticktable.FreqData, gpc ...sticktable.UnsignedIntegerData) mirror.Entry {
+	k := sticktable.StringKey(key)
+	v := sticktable.UnsignedIntegerData(gpc0)
+	arr := sticktable.UnsignedIntegerArrayData(gpc)
+	return mirror.Entry{
+		Key:     &k,
+		Data:    []sticktable.MapData{&v, &rate, &sticktable.DictData{}, &arr},
+		Updated: start,
+	}
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		defs: []sticktable.Definition{{
+			Name:      "st_src",
+			KeyType:   sticktable.KeyTypeString,
+			KeyLength: 32,
+			DataTypes: []sticktable.DataTypeDefinition{
+				{DataType: sticktable.DataTypeGPC0},
+				{DataType: sticktable.DataTypeHttpRequestsRate, Counter: 1, Period: 10000},
+				{DataType: sticktable.DataTypeServerKey},
+				{DataType: sticktable.DataTypeGPCArray, Elements: 2},
+			},
+		}},
+		entries: map[string][]mirror.Entry{
+			"st_src": {
+				testEntry("a", 1, sticktable.FreqData{CurrentPeriod: 4, LastPeriod: 10}, 1, 2),
+				testEntry("b", 3, sticktable.NewFreqData(1), 3, 4),
+				testEntry("c", 2, sticktable.NewFreqData(2), 5, 6),
+			},
+		},
+	}
+}
+
+// gather collects the metrics and returns them as sorted lines.
+func gather(t *testing.T, c *Collector) []string {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			lines = append(lines, fmt.Sprintf("%s{%s} %g", f.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue()))
+		}
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(newTestStore(), Options{})
+	c.now = func() time.Time { return start.Add(5 * time.Second) }
+
+	got := gather(t, c)
+	want := []string{
+		"haproxy_stick_table_data{key=a,table=st_src,type=gpc(0)} 1",
+		"haproxy_stick_table_data{key=a,table=st_src,type=gpc(1)} 2",
+		"haproxy_stick_table_data{key=a,table=st_src,type=gpc0} 1",
+		// The previous period of 10 is weighted by the remaining 5s.
+		"haproxy_stick_table_data{key=a,table=st_src,type=http_req_rate} 9",
+		"haproxy_stick_table_data{key=b,table=st_src,type=gpc(0)} 3",
+		"haproxy_stick_table_data{key=b,table=st_src,type=gpc(1)} 4",
+		"haproxy_stick_table_data{key=b,table=st_src,type=gpc0} 3",
+		"haproxy_stick_table_data{key=b,table=st_src,type=http_req_rate} 1",
+		"haproxy_stick_table_data{key=c,table=st_src,type=gpc(0)} 5",
+		"haproxy_stick_table_data{key=c,table=st_src,type=gpc(1)} 6",
+		"haproxy_stick_table_data{key=c,table=st_src,type=gpc0} 2",
+		"haproxy_stick_table_data{key=c,table=st_src,type=http_req_rate} 2",
+		"haproxy_stick_table_entries{table=st_src} 3",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCollectorOptions(t *testing.T) {
+	rate := sticktable.DataTypeHttpRequestsRate
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "top by first numeric type",
+			opts: Options{Default: TableOptions{MaxKeys: 2}},
+			want: []string{"b", "c"},
+		},
+		{
+			name: "top by data type",
+			opts: Options{Tables: map[string]TableOptions{
+				"st_src": {MaxKeys: 1, TopBy: &rate},
+			}},
+			want: []string{"a"},
+		},
+		{
+			name: "key labels",
+			opts: Options{
+				KeyLabels: []string{"client"},
+				KeyLabelValues: func(_ string, key sticktable.MapKey) []string {
+					if key.String() == "b" {
+						return nil
+					}
+					return []string{"client_" + key.String()}
+				},
+			},
+			want: []string{"client_a", "client_c"},
+		},
+		{
+			name: "skip",
+			opts: Options{Skip: func(table string) bool { return table == "st_src" }},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(newTestStore(), tt.opts)
+			c.now = func() time.Time { return start }
+
+			keys := map[string]bool{}
+			for _, line := range gather(t, c) {
+				if !strings.HasPrefix(line, "haproxy_stick_table_data{") {
+					continue
+				}
+				labels := line[strings.Index(line, "{")+1 : strings.Index(line, ",")]
+				keys[labels[strings.Index(labels, "=")+1:]] = true
+			}
+
+			var got []string
+			for k := range keys {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected keys %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCollectorCollidingLabels(t *testing.T) {
+	// All keys map to the same label, which must not produce duplicate
+	// series.
+	c := NewCollector(newTestStore(), Options{
+		KeyLabels: []string{"bucket"},
+		KeyLabelValues: func(_ string, key sticktable.MapKey) []string {
+			if key.String() == "c" {
+				return []string{"other"}
+			}
+			return []string{"all"}
+		},
+		Default: TableOptions{MaxKeys: 1},
+	})
+	c.now = func() time.Time { return start.Add(5 * time.Second) }
+
+	got := gather(t, c)
+	want := []string{
+		"haproxy_stick_table_data{bucket=all,table=st_src,type=gpc(0)} 4",
+		"haproxy_stick_table_data{bucket=all,table=st_src,type=gpc(1)} 6",
+		"haproxy_stick_table_data{bucket=all,table=st_src,type=gpc0} 4",
+		"haproxy_stick_table_data{bucket=all,table=st_src,type=http_req_rate} 10",
+		"haproxy_stick_table_entries{table=st_src} 3",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCollectorMirrorExpiry(t *testing.T) {
+	var store mirror.Store
+	c := NewCollector(&store, Options{})
+
+	def := &sticktable.Definition{
+		Name:      "st_src",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 32,
+		DataTypes: []sticktable.DataTypeDefinition{{DataType: sticktable.DataTypeGPC0}},
+	}
+	key := sticktable.StringKey("a")
+	v := sticktable.UnsignedIntegerData(1)
+	store.HandleUpdate(context.Background(), &sticktable.EntryUpdate{
+		StickTable: def,
+		Key:        &key,
+		Data:       []sticktable.MapData{&v},
+		WithExpiry: true,
+		Expiry:     50,
+	})
+
+	if got := len(gather(t, c)); got != 2 {
+		t.Fatalf("expected a series and the amount of entries, got %d metrics", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	want := []string{"haproxy_stick_table_entries{table=st_src} 0"}
+	if got := gather(t, c); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %v after expiry, got %v", want, got)
+	}
+}
@@ -7,7 +7,14 @@ import (
 )
 
 type Handler interface {
+	// HandleUpdate is called for every received entry update. The update
+	// is reused after HandleUpdate returned if Peer.ReuseUpdates is set,
+	// use EntryUpdate.Clone to retain it then.
 	HandleUpdate(context.Context, *sticktable.EntryUpdate)
+	// HandleHandshake is called after the handshake of a remote peer was
+	// accepted and the status reply was exchanged, so the Writer of the
+	// session may be used. Messages of the remote peer are handled once
+	// HandleHandshake returned.
 	HandleHandshake(context.Context, *Handshake)
 	Close() error
 }
@@ -22,6 +29,39 @@ func (h HandlerFunc) HandleUpdate(ctx context.Context, u *sticktable.EntryUpdate
 	h(ctx, u)
 }
 
+// HandshakeValidator can be implemented by a Handler to reject remote
+// peers. ValidateHandshake is called before HandleHandshake for handshakes
+// that passed the checks of the Peer. Returning an error rejects the peer,
+// a HandshakeStatus error is sent as reply, any other error as
+// HandshakeStatusRemotePeerIdentifierMismatch. Statuses that do not reject
+// a peer, like HandshakeStatusHandshakeSucceeded, are sent as
+// HandshakeStatusProtocolError.
+type HandshakeValidator interface {
+	ValidateHandshake(context.Context, *Handshake) error
+}
+
+// DefinitionHandler can be implemented by a Handler to be notified of the
+// stick-table definitions received on a session.
+type DefinitionHandler interface {
+	HandleDefinition(context.Context, *sticktable.Definition)
+}
+
+type DefinitionHandlerFunc func(context.Context, *sticktable.Definition)
+
+func (h DefinitionHandlerFunc) HandleDefinition(ctx context.Context, d *sticktable.Definition) {
+	h(ctx, d)
+}
+
+// SyncHandler can be implemented by a Handler to teach its state to a
+// remote peer that requests a full synchronization, for example HAProxy
+// after a restart. HandleSyncRequest sends the entries using the Writer of
+// the session. The synchronization is reported as finished if it returns
+// nil, otherwise as partial.
+type SyncHandler interface {
+	HandleSyncRequest(context.Context, *Writer) error
+}
+
 var (
-	_ Handler = (HandlerFunc)(nil)
+	_ Handler           = (HandlerFunc)(nil)
+	_ DefinitionHandler = (DefinitionHandlerFunc)(nil)
 )
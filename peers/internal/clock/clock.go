@@ -0,0 +1,17 @@
+// Package clock provides the current time to the handlers of the peers
+// packages, so tests can control it.
+package clock
+
+import "time"
+
+// Func returns the current time. The zero value uses time.Now, tests set
+// it to a function returning the time they need.
+type Func func() time.Time
+
+// Now returns the current time.
+func (f Func) Now() time.Time {
+	if f == nil {
+		return time.Now()
+	}
+	return f()
+}
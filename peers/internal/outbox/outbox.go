@@ -0,0 +1,108 @@
+// Package outbox queues the updates a handler shared by all sessions of a
+// peers.Peer sends to a single session. The updates are written by a
+// goroutine of the receiving session, so a slow remote peer does not stall
+// reading on the session the updates originate from.
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// DefaultSize is the amount of queued updates if no size is set.
+const DefaultSize = 4096
+
+// Outbox is a bounded queue of entry updates. Every update carries the full
+// entry, so a queued update is replaced by a newer one of the same table
+// and key. If the outbox is full, the oldest update is dropped.
+type Outbox struct {
+	size int
+
+	mu      sync.Mutex
+	order   []string
+	updates map[string]*sticktable.EntryUpdate
+
+	notify chan struct{}
+}
+
+// New returns an Outbox of up to size updates, DefaultSize if zero.
+func New(size int) *Outbox {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	return &Outbox{
+		size:    size,
+		updates: make(map[string]*sticktable.EntryUpdate),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues the update. It reports false if the oldest queued update was
+// dropped to make room. The update must not be modified afterwards.
+func (o *Outbox) Push(u *sticktable.EntryUpdate) bool {
+	key := u.StickTable.Name + "\x00" + u.Key.String()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.updates[key]; ok {
+		o.updates[key] = u
+		return true
+	}
+
+	kept := true
+	if len(o.order) == o.size {
+		delete(o.updates, o.order[0])
+		o.order = o.order[1:]
+		kept = false
+	}
+
+	o.order = append(o.order, key)
+	o.updates[key] = u
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+
+	return kept
+}
+
+// Run sends the queued updates with send, oldest first and in batches,
+// until ctx is done or send fails.
+func (o *Outbox) Run(ctx context.Context, send func([]*sticktable.EntryUpdate) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-o.notify:
+		}
+
+		batch := o.take()
+		if len(batch) == 0 {
+			continue
+		}
+		if err := send(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// take removes all queued updates and returns them, oldest first.
+func (o *Outbox) take() []*sticktable.EntryUpdate {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	batch := make([]*sticktable.EntryUpdate, len(o.order))
+	for i, key := range o.order {
+		batch[i] = o.updates[key]
+	}
+
+	clear(o.updates)
+	o.order = o.order[:0]
+
+	return batch
+}
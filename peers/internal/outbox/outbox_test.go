@@ -0,0 +1,87 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func testUpdate(def *sticktable.Definition, key string, value uint32) *sticktable.EntryUpdate {
+	k := sticktable.StringKey(key)
+	v := sticktable.UnsignedIntegerData(value)
+	return &sticktable.EntryUpdate{StickTable: def, Key: &k, Data: []sticktable.MapData{&v}}
+}
+
+func format(batch []*sticktable.EntryUpdate) string {
+	var s []string
+	for _, u := range batch {
+		s = append(s, fmt.Sprintf("%s:%s=%s", u.StickTable.Name, u.Key, u.Data[0]))
+	}
+	return fmt.Sprint(s)
+}
+
+func TestOutbox(t *testing.T) {
+	a := &sticktable.Definition{Name: "st_a"}
+	b := &sticktable.Definition{Name: "st_b"}
+
+	o := New(3)
+	for _, u := range []*sticktable.EntryUpdate{
+		testUpdate(a, "x", 1),
+		testUpdate(b, "x", 2),
+		// Replaces the queued update of the same table and key.
+		testUpdate(a, "x", 3),
+		testUpdate(a, "y", 4),
+	} {
+		if !o.Push(u) {
+			t.Fatalf("unexpected drop of %s", u)
+		}
+	}
+
+	// The outbox is full, the oldest update is dropped.
+	if o.Push(testUpdate(a, "z", 5)) {
+		t.Error("expected the oldest update to be dropped")
+	}
+
+	if got, want := format(o.take()), "[st_b:x=2 st_a:y=4 st_a:z=5]"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got := o.take(); len(got) != 0 {
+		t.Errorf("expected empty outbox, got %s", format(got))
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	def := &sticktable.Definition{Name: "st_a"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	o := New(0)
+	batches := make(chan string)
+	errSend := errors.New("send failed")
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Run(ctx, func(batch []*sticktable.EntryUpdate) error {
+			batches <- format(batch)
+			return errSend
+		})
+	}()
+
+	o.Push(testUpdate(def, "x", 1))
+	select {
+	case got := <-batches:
+		if want := "[st_a:x=1]"; got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for batch")
+	}
+
+	if err := <-done; !errors.Is(err, errSend) {
+		t.Errorf("expected the send error, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package peertest
+
+import (
+	"testing"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// Definition parses the declaration of a table with
+// sticktable.ParseDefinition and fails the test if it is invalid. The data
+// types are ordered like on the wire, so the definition survives a round
+// trip.
+func Definition(tb testing.TB, decl string) *sticktable.Definition {
+	tb.Helper()
+	def, err := sticktable.ParseDefinition(decl)
+	if err != nil {
+		tb.Fatalf("parsing definition: %v", err)
+	}
+	return def
+}
+
+// Entry holds the values of an update built by Update. Values of data
+// types the table does not store are ignored.
+type Entry struct {
+	GPT0 uint32
+	GPC0 uint32
+	// Rate is the value of all frequency counters like http_req_rate.
+	Rate sticktable.FreqData
+	// Server is the value of server_key, sent with the dictionary entry
+	// ServerID.
+	Server   string
+	ServerID uint64
+	// Expiry is sent with the update if greater than zero.
+	Expiry uint32
+}
+
+// Update returns an update of def with the values of e. The key is parsed
+// with the key type of def.
+func Update(tb testing.TB, def *sticktable.Definition, key string, e Entry) *sticktable.EntryUpdate {
+	tb.Helper()
+	k, err := def.KeyType.ParseKey(key)
+	if err != nil {
+		tb.Fatalf("parsing key: %v", err)
+	}
+
+	b := sticktable.NewEntryBuilder(def)
+	for _, dt := range def.DataTypes {
+		switch dt.DataType {
+		case sticktable.DataTypeGPT0:
+			err = b.SetUint(dt.DataType, e.GPT0)
+		case sticktable.DataTypeGPC0:
+			err = b.SetUint(dt.DataType, e.GPC0)
+		case sticktable.DataTypeServerKey:
+			err = b.Set(dt.DataType, &sticktable.DictData{ID: e.ServerID, Value: []byte(e.Server)})
+		default:
+			if _, ok := dt.New().(*sticktable.FreqData); !ok {
+				tb.Fatalf("unsupported data type %s", dt.DataType)
+			}
+			err = b.SetFreq(dt.DataType, e.Rate)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	u, err := b.Build(k)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	u.WithExpiry = e.Expiry > 0
+	u.Expiry = e.Expiry
+
+	return u
+}
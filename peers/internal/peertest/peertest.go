@@ -0,0 +1,253 @@
+// Package peertest provides a minimal remote peer to test handlers of a
+// peers.Peer over the network.
+package peertest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// Timeout is the time Receive waits for a message.
+const Timeout = 5 * time.Second
+
+// Conn is a connection to a peers.Peer after a successful handshake.
+type Conn struct {
+	net.Conn
+	Name string
+
+	br       *bufio.Reader
+	tableIDs map[string]uint64
+	updateID uint32
+
+	defs map[uint64]*sticktable.Definition
+	last *sticktable.Definition
+}
+
+// Message is a received entry update or control message. Heartbeats are
+// not returned.
+type Message struct {
+	Update  *sticktable.EntryUpdate
+	Control peers.ControlMessageType
+}
+
+// Dial connects to the peer at addr as the peer local and fails the test
+// if the handshake is not successful. The connection is closed at the end
+// of the test.
+func Dial(tb testing.TB, addr, local, remote string) *Conn {
+	tb.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatalf("dialing peer: %v", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	if _, err := peers.NewHandshakeFrom(local, remote).WriteTo(conn); err != nil {
+		tb.Fatalf("writing handshake: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	var status int
+	if _, err := fmt.Fscanf(br, "%d\n", &status); err != nil {
+		tb.Fatalf("reading handshake status: %v", err)
+	}
+	if peers.HandshakeStatus(status) != peers.HandshakeStatusHandshakeSucceeded {
+		tb.Fatalf("handshake failed with status %d", status)
+	}
+
+	return &Conn{
+		Conn:     conn,
+		Name:     local,
+		br:       br,
+		tableIDs: make(map[string]uint64),
+		defs:     make(map[uint64]*sticktable.Definition),
+	}
+}
+
+// SendControl sends a control message.
+func (c *Conn) SendControl(tb testing.TB, t peers.ControlMessageType) {
+	tb.Helper()
+	if _, err := c.Write([]byte{byte(peers.MessageClassControl), byte(t)}); err != nil {
+		tb.Fatalf("%s: writing control message: %v", c.Name, err)
+	}
+}
+
+// SendUpdate sends the definition of the table of the update followed by
+// the update.
+func (c *Conn) SendUpdate(tb testing.TB, u *sticktable.EntryUpdate) {
+	tb.Helper()
+	id, ok := c.tableIDs[u.StickTable.Name]
+	if !ok {
+		id = uint64(len(c.tableIDs) + 1)
+		c.tableIDs[u.StickTable.Name] = id
+	}
+
+	def := *u.StickTable
+	def.StickTableID = id
+	b := make([]byte, def.Size())
+	if _, err := def.Marshal(b); err != nil {
+		tb.Fatalf("%s: encoding definition: %v", c.Name, err)
+	}
+	c.write(tb, peers.StickTableUpdateMessageTypeStickTableDefinition, b)
+
+	c.updateID++
+	e := *u
+	e.StickTable = &def
+	e.WithLocalUpdateID = true
+	e.LocalUpdateID = c.updateID
+
+	msgType := peers.StickTableUpdateMessageTypeEntryUpdate
+	if e.WithExpiry {
+		msgType = peers.StickTableUpdateMessageTypeUpdateTimed
+	}
+
+	b = make([]byte, e.Size())
+	if _, err := e.Marshal(b); err != nil {
+		tb.Fatalf("%s: encoding update: %v", c.Name, err)
+	}
+	c.write(tb, msgType, b)
+}
+
+func (c *Conn) write(tb testing.TB, msgType peers.StickTableUpdateMessageType, data []byte) {
+	tb.Helper()
+	msg := []byte{byte(peers.MessageClassStickTableUpdates), byte(msgType)}
+	msg = append(msg, make([]byte, encoding.VarintSize(uint64(len(data))))...)
+	if _, err := encoding.PutVarint(msg[2:], uint64(len(data))); err != nil {
+		tb.Fatal(err)
+	}
+	msg = append(msg, data...)
+
+	if _, err := c.Write(msg); err != nil {
+		tb.Fatalf("%s: writing message: %v", c.Name, err)
+	}
+}
+
+// Receive waits for the next entry update or control message.
+func (c *Conn) Receive(tb testing.TB) Message {
+	tb.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(Timeout))
+
+	m, err := c.next()
+	if err != nil {
+		tb.Fatalf("%s: %v", c.Name, err)
+	}
+	return m
+}
+
+// ReceiveUpdate waits for the next entry update and fails the test on
+// other messages.
+func (c *Conn) ReceiveUpdate(tb testing.TB) *sticktable.EntryUpdate {
+	tb.Helper()
+	m := c.Receive(tb)
+	if m.Update == nil {
+		tb.Fatalf("%s: expected entry update, got %s", c.Name, m.Control)
+	}
+	return m.Update
+}
+
+// ExpectNothing fails the test if an entry update or control message is
+// received within d.
+func (c *Conn) ExpectNothing(tb testing.TB, d time.Duration) {
+	tb.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(d))
+
+	m, err := c.next()
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+	case err != nil:
+		tb.Fatalf("%s: %v", c.Name, err)
+	case m.Update != nil:
+		tb.Fatalf("%s: unexpected update %s", c.Name, m.Update)
+	default:
+		tb.Fatalf("%s: unexpected %s", c.Name, m.Control)
+	}
+}
+
+func (c *Conn) next() (Message, error) {
+	for {
+		class, msgType, data, err := c.read()
+		if err != nil {
+			return Message{}, err
+		}
+
+		switch class {
+		case peers.MessageClassControl:
+			if t := peers.ControlMessageType(msgType); t != peers.ControlMessageHeartbeat {
+				return Message{Control: t}, nil
+			}
+			continue
+		case peers.MessageClassStickTableUpdates:
+		default:
+			return Message{}, fmt.Errorf("unexpected message class %s", class)
+		}
+
+		switch t := peers.StickTableUpdateMessageType(msgType); t {
+		case peers.StickTableUpdateMessageTypeStickTableDefinition:
+			var def sticktable.Definition
+			if _, err := def.Unmarshal(data); err != nil {
+				return Message{}, fmt.Errorf("decoding definition: %w", err)
+			}
+			c.defs[def.StickTableID] = &def
+			c.last = &def
+		case peers.StickTableUpdateMessageTypeStickTableSwitch:
+			id, _, err := encoding.Varint(data)
+			if err != nil {
+				return Message{}, fmt.Errorf("decoding switch: %w", err)
+			}
+			c.last = c.defs[id]
+		case peers.StickTableUpdateMessageTypeEntryUpdate,
+			peers.StickTableUpdateMessageTypeIncrementalEntryUpdate,
+			peers.StickTableUpdateMessageTypeUpdateTimed,
+			peers.StickTableUpdateMessageTypeIncrementalEntryUpdateTimed:
+			if c.last == nil {
+				return Message{}, fmt.Errorf("%s without table definition", t)
+			}
+
+			u := &sticktable.EntryUpdate{
+				StickTable: c.last,
+				WithLocalUpdateID: t == peers.StickTableUpdateMessageTypeEntryUpdate ||
+					t == peers.StickTableUpdateMessageTypeUpdateTimed,
+				WithExpiry: t == peers.StickTableUpdateMessageTypeUpdateTimed ||
+					t == peers.StickTableUpdateMessageTypeIncrementalEntryUpdateTimed,
+			}
+			if _, err := u.Unmarshal(data); err != nil {
+				return Message{}, fmt.Errorf("decoding update: %w", err)
+			}
+			return Message{Update: u}, nil
+		default:
+			return Message{}, fmt.Errorf("unexpected message %s", t)
+		}
+	}
+}
+
+func (c *Conn) read() (peers.MessageClass, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	// Only messages with a type of at least 128 carry data.
+	if header[1] < 128 {
+		return peers.MessageClass(header[0]), header[1], nil, nil
+	}
+
+	length, err := encoding.ReadVarint(c.br)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return peers.MessageClass(header[0]), header[1], data, nil
+}
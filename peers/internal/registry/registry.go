@@ -0,0 +1,43 @@
+// Package registry tracks the sessions of a handler that is shared by all
+// sessions of a peers.Peer.
+package registry
+
+import "sync"
+
+// Sessions is a set of sessions that is safe for concurrent use. The zero
+// value is ready to use.
+type Sessions[S comparable] struct {
+	mu  sync.Mutex
+	set map[S]struct{}
+}
+
+// Add adds a session, usually once its handshake succeeded.
+func (r *Sessions[S]) Add(s S) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.set == nil {
+		r.set = make(map[S]struct{})
+	}
+	r.set[s] = struct{}{}
+}
+
+// Remove removes a session, usually once it was closed.
+func (r *Sessions[S]) Remove(s S) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.set, s)
+}
+
+// All returns the sessions in no particular order.
+func (r *Sessions[S]) All() []S {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]S, 0, len(r.set))
+	for s := range r.set {
+		all = append(all, s)
+	}
+	return all
+}
@@ -1,10 +1,12 @@
 package peers
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 // Handshake is composed by these fields:
@@ -24,43 +26,185 @@ type Handshake struct {
 	RelativeProcessID   int
 }
 
+const (
+	protocolIdentifier = "HAProxyS"
+	protocolVersion    = "2.1"
+	// protocolMajorVersion is the major version of the protocol that
+	// has to match in the handshake, protocolMinorVersion the highest
+	// supported minor version.
+	protocolMajorVersion = 2
+	protocolMinorVersion = 1
+)
+
 // NewHandshake returns a basic handshake to be used for connecting to
 // haproxy peers. It is filled with all necessary information except the remote
 // peer hostname.
 func NewHandshake(remotePeer string) *Handshake {
+	return NewHandshakeFrom("", remotePeer)
+}
+
+// NewHandshakeFrom is like NewHandshake but sends the handshake as the
+// local peer name. An empty local peer name defaults to the hostname,
+// like HAProxy does for its localpeer.
+func NewHandshakeFrom(localPeer, remotePeer string) *Handshake {
+	if localPeer == "" {
+		localPeer, _ = os.Hostname()
+	}
+
 	return &Handshake{
-		ProtocolIdentifier: "HAProxyS",
-		Version:            "2.1",
-		RemotePeer:         remotePeer,
-		LocalPeerIdentifier: func() string {
-			s, _ := os.Hostname()
-			return s
-		}(),
-		ProcessID:         os.Getpid(),
-		RelativeProcessID: 0,
+		ProtocolIdentifier:  protocolIdentifier,
+		Version:             protocolVersion,
+		RemotePeer:          remotePeer,
+		LocalPeerIdentifier: localPeer,
+		ProcessID:           os.Getpid(),
+		RelativeProcessID:   0,
+	}
+}
+
+// validate checks the handshake of a remote peer that connected to the
+// local peer name and returns the status to reply with. An empty local
+// peer name accepts any name, empty allowed peers accept any remote peer.
+func (h *Handshake) validate(localPeer string, allowedPeers []string) HandshakeStatus {
+	if h.ProtocolIdentifier != protocolIdentifier {
+		return HandshakeStatusProtocolError
+	}
+
+	// Like HAProxy, peers with a higher minor version are rejected, as
+	// they may send messages that are not supported.
+	major, minor, ok := parseVersion(h.Version)
+	if !ok || major != protocolMajorVersion || minor > protocolMinorVersion {
+		return HandshakeStatusBadVersion
+	}
+
+	if localPeer != "" && h.RemotePeer != localPeer {
+		return HandshakeStatusLocalPeerIdentifierMismatch
+	}
+
+	if len(allowedPeers) > 0 && !slices.Contains(allowedPeers, h.LocalPeerIdentifier) {
+		return HandshakeStatusRemotePeerIdentifierMismatch
+	}
+
+	return HandshakeStatusHandshakeSucceeded
+}
+
+// parseVersion parses a protocol version of the form major.minor.
+func parseVersion(v string) (major, minor int, ok bool) {
+	ma, mi, found := strings.Cut(v, ".")
+	if !found {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(ma)
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(mi)
+	if err != nil {
+		return 0, 0, false
 	}
+	return major, minor, true
 }
 
+// maxHandshakeLineLength is the maximum length of a handshake line,
+// including the line feed.
+const maxHandshakeLineLength = 512
+
+// ReadFrom reads the three lines of a handshake. It never reads beyond the
+// last line feed, so the stream can be used for the binary messages that
+// follow. The returned count is the exact amount of bytes consumed.
 func (h *Handshake) ReadFrom(r io.Reader) (n int64, err error) {
-	scanner := bufio.NewScanner(r)
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &singleByteReader{r: r}
+	}
 
-	scanner.Scan()
-	_, err = fmt.Sscanf(scanner.Text(), "%s %s", &h.ProtocolIdentifier, &h.Version)
+	line, err := readHandshakeLine(br, &n)
 	if err != nil {
-		return -1, err
+		return n, fmt.Errorf("reading protocol line: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return n, fmt.Errorf("malformed protocol line: %q", line)
 	}
+	h.ProtocolIdentifier, h.Version = fields[0], fields[1]
 
-	scanner.Scan()
-	h.RemotePeer = scanner.Text()
+	line, err = readHandshakeLine(br, &n)
+	if err != nil {
+		return n, fmt.Errorf("reading remote peer line: %w", unexpectedEOF(err))
+	}
+	fields = strings.Fields(line)
+	if len(fields) != 1 {
+		return n, fmt.Errorf("malformed remote peer line: %q", line)
+	}
+	h.RemotePeer = fields[0]
 
-	scanner.Scan()
-	_, err = fmt.Sscanf(scanner.Text(), "%s %d %d", &h.LocalPeerIdentifier, &h.ProcessID, &h.RelativeProcessID)
+	line, err = readHandshakeLine(br, &n)
 	if err != nil {
-		return -1, err
+		return n, fmt.Errorf("reading local peer line: %w", unexpectedEOF(err))
+	}
+	fields = strings.Fields(line)
+	if len(fields) != 3 {
+		return n, fmt.Errorf("malformed local peer line: %q", line)
+	}
+	h.LocalPeerIdentifier = fields[0]
+
+	if h.ProcessID, err = strconv.Atoi(fields[1]); err != nil {
+		return n, fmt.Errorf("malformed process id %q: %w", fields[1], err)
+	}
+
+	if h.RelativeProcessID, err = strconv.Atoi(fields[2]); err != nil {
+		return n, fmt.Errorf("malformed relative process id %q: %w", fields[2], err)
+	}
+
+	return n, nil
+}
+
+// readHandshakeLine reads a single line without the line feed and adds the
+// bytes consumed to n. Lines longer than maxHandshakeLineLength are rejected.
+func readHandshakeLine(r io.ByteReader, n *int64) (string, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if len(line) > 0 {
+				return "", unexpectedEOF(err)
+			}
+			return "", err
+		}
+		*n++
+
+		if c == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+
+		if len(line) >= maxHandshakeLineLength-1 {
+			return "", fmt.Errorf("line exceeds %d bytes", maxHandshakeLineLength)
+		}
+		line = append(line, c)
+	}
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF for streams that
+// ended in the middle of a handshake.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
+	return err
+}
 
-	//TODO: find out how many bytes where read.
-	return -1, scanner.Err()
+// singleByteReader reads from an io.Reader one byte at a time, so no data
+// beyond the handshake is consumed from readers without io.ByteReader.
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(s.r, s.buf[:]); err != nil {
+		return 0, err
+	}
+	return s.buf[0], nil
 }
 
 func (h *Handshake) WriteTo(w io.Writer) (nw int64, err error) {
@@ -0,0 +1,138 @@
+package peers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandshakeReadFrom(t *testing.T) {
+	t.Run("does not over-read", func(t *testing.T) {
+		hello := "HAProxyS 2.1\ngo_peer\nhaproxy_peer 1234 0\n"
+		binary := []byte{byte(MessageClassControl), byte(ControlMessageSyncRequest)}
+
+		br := bufio.NewReader(io.MultiReader(strings.NewReader(hello), bytes.NewReader(binary)))
+
+		var h Handshake
+		n, err := h.ReadFrom(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(len(hello)) {
+			t.Errorf("expected %d bytes read, got %d", len(hello), n)
+		}
+
+		want := Handshake{
+			ProtocolIdentifier:  "HAProxyS",
+			Version:             "2.1",
+			RemotePeer:          "go_peer",
+			LocalPeerIdentifier: "haproxy_peer",
+			ProcessID:           1234,
+		}
+		if diff := cmp.Diff(want, h); diff != "" {
+			t.Errorf("ReadFrom() mismatch (-want +got):\n%s", diff)
+		}
+
+		rest, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, binary) {
+			t.Errorf("expected remaining %v, got %v", binary, rest)
+		}
+	})
+
+	t.Run("plain reader", func(t *testing.T) {
+		r := strings.NewReader("HAProxyS 2.1\ngo_peer\nhaproxy_peer 1234 0\nbinary")
+
+		var h Handshake
+		if _, err := h.ReadFrom(io.LimitReader(r, 1<<10)); err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Len() != len("binary") {
+			t.Errorf("expected %d bytes left, got %d", len("binary"), r.Len())
+		}
+	})
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"missing protocol version", "HAProxyS\ngo_peer\nhaproxy_peer 1234 0\n"},
+		{"missing remote peer", "HAProxyS 2.1\n\nhaproxy_peer 1234 0\n"},
+		{"spaces in remote peer", "HAProxyS 2.1\ngo peer\nhaproxy_peer 1234 0\n"},
+		{"missing process id", "HAProxyS 2.1\ngo_peer\nhaproxy_peer\n"},
+		{"invalid process id", "HAProxyS 2.1\ngo_peer\nhaproxy_peer abc 0\n"},
+		{"truncated", "HAProxyS 2.1\ngo_peer\nhaproxy_peer 1234 0"},
+		{"line too long", "HAProxyS 2.1\n" + strings.Repeat("a", maxHandshakeLineLength) + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Handshake
+			n, err := h.ReadFrom(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			if n > int64(len(tt.input)) {
+				t.Errorf("read %d bytes from %d bytes input", n, len(tt.input))
+			}
+		})
+	}
+
+	t.Run("truncated is unexpected EOF", func(t *testing.T) {
+		var h Handshake
+		_, err := h.ReadFrom(strings.NewReader("HAProxyS 2.1\ngo_peer\n"))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected unexpected EOF, got %v", err)
+		}
+	})
+}
+
+func FuzzHandshakeReadFrom(f *testing.F) {
+	f.Add([]byte("HAProxyS 2.1\ngo_peer\nhaproxy_peer 1234 0\n"))
+	f.Add([]byte("HAProxyS 2.1\r\ngo_peer\r\nhaproxy_peer 1234 0\r\n\x00\x04"))
+	f.Add([]byte("HAProxyS 2.1\n\n\n"))
+	f.Add([]byte("\n\n\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+
+		var h Handshake
+		n, err := h.ReadFrom(r)
+		if n != int64(len(data)-r.Len()) {
+			t.Fatalf("reported %d bytes read, consumed %d", n, len(data)-r.Len())
+		}
+		if err != nil {
+			return
+		}
+
+		if n > 0 && data[n-1] != '\n' {
+			t.Fatalf("consumed bytes beyond the last line feed: %q", data[:n])
+		}
+
+		// A successfully parsed handshake has to survive a round trip.
+		var buf bytes.Buffer
+		if _, err := h.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var out Handshake
+		if _, err := out.ReadFrom(&buf); err != nil {
+			t.Fatalf("reading written handshake %q: %v", buf.String(), err)
+		}
+
+		if diff := cmp.Diff(h, out); diff != "" {
+			t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package mirror
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+)
+
+// A snapshot is encoded as
+//
+//	magic "HAPS" | version byte | varint creation time (unix ms)
+//	varint table count
+//	per table:
+//	  varint length | definition in wire format
+//	  varint entry count
+//	  per entry:
+//	    varint expiry (remaining ms + 1, 0 if it never expires)
+//	    varint length | key and data in wire format
+//	crc32 (IEEE, big endian) of everything before
+//
+// Dictionary values are always written with their value, so a snapshot
+// does not depend on the dictionary cache of a session. The current tick
+// of frequency counters is relative to the creation time.
+const (
+	snapshotMagic   = "HAPS"
+	snapshotVersion = 1
+)
+
+var (
+	// ErrSnapshotVersion is returned when reading a snapshot written in
+	// an unsupported version.
+	ErrSnapshotVersion = errors.New("mirror: unsupported snapshot version")
+	// ErrSnapshotCorrupt is returned when reading a malformed snapshot.
+	ErrSnapshotCorrupt = errors.New("mirror: corrupt snapshot")
+)
+
+// WriteSnapshot writes all entries that did not expire yet to w.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	b, err := s.encodeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func (s *Store) encodeSnapshot() ([]byte, error) {
+	now := s.now.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := append([]byte(snapshotMagic), snapshotVersion)
+	b = appendVarint(b, uint64(now.UnixMilli()))
+	b = appendVarint(b, uint64(len(s.tables)))
+
+	var buf []byte
+	for _, t := range s.tables {
+		def := t.def.Clone()
+		buf = grow(buf, def.Size())
+		n, err := def.Marshal(buf)
+		if err != nil {
+			return nil, fmt.Errorf("encoding definition of %s: %w", def.Name, err)
+		}
+		b = appendVarint(b, uint64(n))
+		b = append(b, buf[:n]...)
+
+		var live uint64
+		for _, e := range t.entries {
+			if !e.expired(now) {
+				live++
+			}
+		}
+		b = appendVarint(b, live)
+
+		for _, e := range t.entries {
+			if e.expired(now) {
+				continue
+			}
+
+			var expiry uint64
+			if !e.expires.IsZero() {
+				expiry = uint64(e.remaining(now)) + 1
+			}
+			b = appendVarint(b, expiry)
+
+			u := sticktable.EntryUpdate{
+				StickTable: def,
+				Key:        e.key,
+				Data:       snapshotData(e.data, now.Sub(e.updated)),
+			}
+			buf = grow(buf, u.Size())
+			n, err := u.Marshal(buf)
+			if err != nil {
+				return nil, fmt.Errorf("encoding entry of %s: %w", def.Name, err)
+			}
+			b = appendVarint(b, uint64(n))
+			b = append(b, buf[:n]...)
+		}
+	}
+
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// snapshotData returns a copy of the data that is relative to the time
+// the snapshot is written and does not depend on a session: Frequency
+// counters are advanced by their age and dictionary entries do not keep
+// the ID of the session. Entries without a known value are written as
+// empty.
+func snapshotData(data []sticktable.MapData, age time.Duration) []sticktable.MapData {
+	c := (&sticktable.EntryUpdate{Data: data}).Clone().Data
+	sticktable.AgeRates(c, age)
+
+	for _, d := range c {
+		if dict, ok := d.(*sticktable.DictData); ok {
+			dict.ID = 0
+			if len(dict.Value) > 0 {
+				dict.ID = 1
+			}
+		}
+	}
+	return c
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var scratch [10]byte
+	n, _ := encoding.PutVarint(scratch[:], v)
+	return append(b, scratch[:n]...)
+}
+
+// ReadSnapshot replaces the content of the store with the snapshot read
+// from r. The time passed since the snapshot was written is subtracted
+// from the expiry of its entries, expired entries are dropped. The store
+// is left unchanged if the snapshot can not be read.
+func (s *Store) ReadSnapshot(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	tables, err := s.decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tables = tables
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Store) decodeSnapshot(b []byte) (map[string]*table, error) {
+	if len(b) < len(snapshotMagic)+1+4 || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, ErrSnapshotCorrupt
+	}
+	if v := b[len(snapshotMagic)]; v != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, v)
+	}
+
+	sum := binary.BigEndian.Uint32(b[len(b)-4:])
+	b = b[:len(b)-4]
+	if crc32.ChecksumIEEE(b) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	d := snapshotDecoder{b: b, off: len(snapshotMagic) + 1}
+
+	created := time.UnixMilli(int64(d.varint()))
+	// Entries continue to expire while the snapshot is on disk.
+	now := s.now.Now()
+	elapsed := max(now.Sub(created), 0)
+
+	count := d.varint()
+	tables := make(map[string]*table)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		t := &table{entries: make(map[string]*entry)}
+		raw := d.bytes()
+		if d.err != nil {
+			break
+		}
+		if _, err := t.def.Unmarshal(raw); err != nil {
+			d.err = err
+			break
+		}
+
+		entries := d.varint()
+		for j := uint64(0); j < entries && d.err == nil; j++ {
+			expiry := d.varint()
+			raw := d.bytes()
+			if d.err != nil {
+				break
+			}
+
+			u := sticktable.EntryUpdate{StickTable: &t.def}
+			if _, err := u.Unmarshal(raw); err != nil {
+				d.err = err
+				break
+			}
+
+			// Frequency counters were advanced to the creation of the
+			// snapshot.
+			e := &entry{key: u.Key, data: u.Data, updated: created}
+			if expiry > 0 {
+				remaining := time.Duration(expiry-1)*time.Millisecond - elapsed
+				if remaining <= 0 {
+					continue
+				}
+				e.expires = now.Add(remaining)
+			}
+
+			t.entries[string(raw[:u.Key.Size(t.def.KeyLength)])] = e
+		}
+
+		if d.err == nil {
+			tables[t.def.Name] = t
+		}
+	}
+
+	if d.err == nil && d.off != len(d.b) {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.b)-d.off)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, d.err)
+	}
+
+	return tables, nil
+}
+
+// snapshotDecoder reads the fields of a snapshot and keeps the first
+// error.
+type snapshotDecoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *snapshotDecoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n, err := encoding.Varint(d.b[d.off:])
+	d.off += n
+	d.err = err
+	return v
+}
+
+func (d *snapshotDecoder) bytes() []byte {
+	n := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)-d.off) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.b[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b
+}
+
+// SaveSnapshot atomically replaces the file at path with a snapshot of
+// the store.
+func (s *Store) SaveSnapshot(path string) error {
+	b, err := s.encodeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing snapshot: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// LoadSnapshot replaces the content of the store with the snapshot at
+// path. The returned error wraps fs.ErrNotExist if there is no snapshot.
+func (s *Store) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.ReadSnapshot(f)
+}
+
+// RunSnapshots removes expired entries and saves a snapshot to path every
+// interval until ctx is done. A last snapshot is saved before it returns.
+// Failed snapshots are logged and retried at the next interval.
+func (s *Store) RunSnapshots(ctx context.Context, path string, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.Expire()
+			return s.SaveSnapshot(path)
+		case <-t.C:
+			s.Expire()
+			if err := s.SaveSnapshot(path); err != nil {
+				log.Printf("saving snapshot: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers/internal/peertest"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s, clock := newTestStore()
+	ctx := context.Background()
+
+	def := *peertest.Definition(t, testDeclaration)
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3, Expiry: 1000}))
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "b", peertest.Entry{GPC0: 2, Rate: sticktable.NewFreqData(2), Server: "srv_b", ServerID: 3, Expiry: 5000}))
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "expired", peertest.Entry{GPC0: 3, Rate: sticktable.NewFreqData(3), Server: "srv_expired", ServerID: 3, Expiry: 100}))
+	clock.t = clock.t.Add(200 * time.Millisecond)
+
+	empty := *peertest.Definition(t, testDeclaration)
+	empty.Name = "st_empty"
+	s.HandleDefinition(ctx, &empty)
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is loaded 2s later, so a expired on disk.
+	loaded := &Store{now: func() time.Time { return clock.t.Add(2 * time.Second) }}
+	if err := loaded.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(s.Tables(), loaded.Tables()); diff != "" {
+		t.Errorf("Tables() mismatch (-want +got):\n%s", diff)
+	}
+
+	if n := loaded.Len(def.Name); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+
+	k := sticktable.StringKey("b")
+	got, ok := loaded.Lookup(def.Name, &k)
+	if !ok {
+		t.Fatal("expected entry b")
+	}
+
+	want, _ := s.Lookup(def.Name, &k)
+	if !got.Expires.Equal(want.Expires) {
+		t.Errorf("expected expiry %s, got %s", want.Expires, got.Expires)
+	}
+
+	// Frequency counters are relative to the creation of the snapshot
+	// and dictionary values do not keep the ID of the session.
+	if !got.Updated.Equal(clock.t) {
+		t.Errorf("expected update time %s, got %s", clock.t, got.Updated)
+	}
+	want.Data[1] = &sticktable.FreqData{CurrentTick: 200, CurrentPeriod: 2}
+	want.Data[2] = &sticktable.DictData{ID: 1, Value: []byte("srv_b")}
+	opts := cmp.Comparer(func(a, b sticktable.FreqData) bool { return a == b })
+	if diff := cmp.Diff(want.Data, got.Data, opts); diff != "" {
+		t.Errorf("entry data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	s, _ := newTestStore()
+	def := *peertest.Definition(t, testDeclaration)
+	s.HandleUpdate(context.Background(), peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3}))
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	modify := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte(nil), valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrSnapshotCorrupt},
+		{"magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), ErrSnapshotCorrupt},
+		{"version", modify(func(b []byte) []byte { b[4] = 2; return b }), ErrSnapshotVersion},
+		{"checksum", modify(func(b []byte) []byte { b[len(b)-5] ^= 1; return b }), ErrSnapshotCorrupt},
+		{"truncated", modify(func(b []byte) []byte { return b[:len(b)-8] }), ErrSnapshotCorrupt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := &Store{}
+			loaded.HandleUpdate(context.Background(), peertest.Update(t, &def, "kept", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_kept", ServerID: 3}))
+
+			err := loaded.ReadSnapshot(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+
+			if n := loaded.Len(def.Name); n != 1 {
+				t.Errorf("expected store to be unchanged, got %d entries", n)
+			}
+		})
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tables.snap")
+
+	var s Store
+	if err := s.LoadSnapshot(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	def := *peertest.Definition(t, testDeclaration)
+	def.Expiry = 0
+	s.HandleUpdate(context.Background(), peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.RunSnapshots(ctx, path, time.Hour)
+	}()
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded Store
+	if err := loaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	k := sticktable.StringKey("a")
+	e, ok := loaded.Lookup(def.Name, &k)
+	if !ok {
+		t.Fatal("expected entry a")
+	}
+	if !e.Expires.IsZero() {
+		t.Errorf("expected entry without expiry, got %s", e.Expires)
+	}
+
+	matches, err := filepath.Glob(path + ".tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("expected temporary files to be removed, got %v", matches)
+	}
+}
@@ -0,0 +1,336 @@
+// Package mirror keeps a local copy of the stick tables received from
+// remote peers. The copy can be persisted to disk as snapshot and is
+// taught back to HAProxy when it requests a full synchronization, so the
+// tables survive a restart of both HAProxy and the mirror.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/clock"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// syncBatchSize is the amount of entries sent with a single call to
+// Writer.SendEntries when teaching a remote peer.
+const syncBatchSize = 1024
+
+// Store is a peers.Handler that mirrors all received stick tables. A
+// single Store is meant to be shared by all sessions of a Peer.
+//
+// The zero value is ready to use.
+type Store struct {
+	mu     sync.RWMutex
+	tables map[string]*table
+
+	now clock.Func
+
+	// keyBuf is the scratch buffer to encode keys. Caller MUST hold the
+	// write lock.
+	keyBuf []byte
+}
+
+type table struct {
+	def     sticktable.Definition
+	entries map[string]*entry
+}
+
+type entry struct {
+	key  sticktable.MapKey
+	data []sticktable.MapData
+	// expires is the time the entry expires at, zero if it never expires.
+	expires time.Time
+	// updated is the time the entry was received.
+	updated time.Time
+}
+
+// Entry is a mirrored stick-table entry.
+type Entry struct {
+	Key  sticktable.MapKey
+	Data []sticktable.MapData
+	// Expires is the time the entry expires at, zero if it never expires.
+	Expires time.Time
+	// Updated is the time the entry was received. The current tick of
+	// frequency counters is relative to it, so the time passed since has
+	// to be passed to FreqData.Rate.
+	Updated time.Time
+}
+
+var (
+	_ peers.Handler           = (*Store)(nil)
+	_ peers.DefinitionHandler = (*Store)(nil)
+	_ peers.SyncHandler       = (*Store)(nil)
+)
+
+// HandleUpdate stores a copy of the update. The entry expires after the
+// expiry of the update or, if it has none, after the expiry of its table.
+func (s *Store) HandleUpdate(_ context.Context, u *sticktable.EntryUpdate) {
+	now := s.now.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tableLocked(u.StickTable)
+
+	key, err := s.encodeKeyLocked(&t.def, u.Key)
+	if err != nil {
+		return
+	}
+
+	c := u.Clone()
+	e := &entry{key: c.Key, data: c.Data, updated: now}
+	switch {
+	case u.WithExpiry:
+		e.expires = now.Add(time.Duration(u.Expiry) * time.Millisecond)
+	case t.def.Expiry > 0:
+		e.expires = now.Add(time.Duration(t.def.Expiry) * time.Millisecond)
+	}
+
+	t.entries[key] = e
+}
+
+// HandleDefinition registers the table, so it is known even before the
+// first update is received.
+func (s *Store) HandleDefinition(_ context.Context, d *sticktable.Definition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tableLocked(d)
+}
+
+func (s *Store) HandleHandshake(context.Context, *peers.Handshake) {}
+
+// Close is a no-op, the Store outlives the sessions it is used by.
+func (s *Store) Close() error { return nil }
+
+// tableLocked returns the table of the definition and creates it if
+// necessary. The entries of a known table are dropped if the key or data
+// types of its definition changed. Caller MUST hold the write lock.
+func (s *Store) tableLocked(d *sticktable.Definition) *table {
+	if s.tables == nil {
+		s.tables = make(map[string]*table)
+	}
+
+	t, ok := s.tables[d.Name]
+	if ok && t.def.Compatible(d) {
+		t.def.Expiry = d.Expiry
+		return t
+	}
+
+	t = &table{
+		def:     *d.Clone(),
+		entries: make(map[string]*entry),
+	}
+	s.tables[d.Name] = t
+
+	return t
+}
+
+// encodeKeyLocked returns the wire encoding of the key, used to identify
+// entries. Caller MUST hold the write lock.
+func (s *Store) encodeKeyLocked(d *sticktable.Definition, k sticktable.MapKey) (string, error) {
+	b, err := d.AppendKey(s.keyBuf[:0], k)
+	if err != nil {
+		return "", err
+	}
+	s.keyBuf = b
+
+	return string(b), nil
+}
+
+// Tables returns the definitions of all mirrored tables sorted by name.
+func (s *Store) Tables() []sticktable.Definition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	defs := make([]sticktable.Definition, 0, len(s.tables))
+	for _, t := range s.tables {
+		defs = append(defs, *t.def.Clone())
+	}
+
+	slices.SortFunc(defs, func(a, b sticktable.Definition) int {
+		switch {
+		case a.Name < b.Name:
+			return -1
+		case a.Name > b.Name:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return defs
+}
+
+// Definition returns the definition of the table.
+func (s *Store) Definition(name string) (sticktable.Definition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tables[name]
+	if !ok {
+		return sticktable.Definition{}, false
+	}
+
+	return *t.def.Clone(), true
+}
+
+// Lookup returns a copy of the entry of the table with the key, if it
+// did not expire yet.
+func (s *Store) Lookup(name string, key sticktable.MapKey) (Entry, bool) {
+	now := s.now.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tables[name]
+	if !ok {
+		return Entry{}, false
+	}
+
+	k, err := s.encodeKeyLocked(&t.def, key)
+	if err != nil {
+		return Entry{}, false
+	}
+
+	e, ok := t.entries[k]
+	if !ok || e.expired(now) {
+		return Entry{}, false
+	}
+
+	return e.export(&t.def), true
+}
+
+// Range calls fn with a copy of every entry of the table that did not
+// expire yet, in no particular order. Range stops if fn returns false.
+// The Store must not be modified by fn.
+func (s *Store) Range(name string, fn func(Entry) bool) {
+	now := s.now.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tables[name]
+	if !ok {
+		return
+	}
+
+	for _, e := range t.entries {
+		if e.expired(now) {
+			continue
+		}
+		if !fn(e.export(&t.def)) {
+			return
+		}
+	}
+}
+
+// Len returns the amount of entries of the table, including expired
+// entries that were not removed yet.
+func (s *Store) Len(name string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.tables[name]; ok {
+		return len(t.entries)
+	}
+	return 0
+}
+
+// Expire removes all expired entries and returns their amount.
+func (s *Store) Expire() int {
+	now := s.now.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, t := range s.tables {
+		for k, e := range t.entries {
+			if e.expired(now) {
+				delete(t.entries, k)
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// remaining returns the time until the entry expires in milliseconds.
+func (e *entry) remaining(now time.Time) uint32 {
+	d := e.expires.Sub(now).Milliseconds()
+	switch {
+	case d < 0:
+		return 0
+	case d > int64(^uint32(0)):
+		return ^uint32(0)
+	default:
+		return uint32(d)
+	}
+}
+
+func (e *entry) update(def *sticktable.Definition, now time.Time) *sticktable.EntryUpdate {
+	u := &sticktable.EntryUpdate{
+		StickTable: def,
+		Key:        e.key,
+		Data:       e.data,
+	}
+	if !e.expires.IsZero() {
+		u.WithExpiry = true
+		u.Expiry = e.remaining(now)
+	}
+	return u
+}
+
+func (e *entry) export(def *sticktable.Definition) Entry {
+	c := (&sticktable.EntryUpdate{StickTable: def, Key: e.key, Data: e.data}).Clone()
+	return Entry{Key: c.Key, Data: c.Data, Expires: e.expires, Updated: e.updated}
+}
+
+// HandleSyncRequest teaches all entries that did not expire yet to the
+// remote peer, with their remaining expiry and the age of frequency
+// counters.
+func (s *Store) HandleSyncRequest(ctx context.Context, w *peers.Writer) error {
+	now := s.now.Now()
+
+	// The entries are copied, so updates can be received while the
+	// remote peer is taught.
+	var updates []*sticktable.EntryUpdate
+	s.mu.RLock()
+	for _, t := range s.tables {
+		def := t.def.Clone()
+		for _, e := range t.entries {
+			if e.expired(now) {
+				continue
+			}
+			u := e.update(def, now).Clone()
+			sticktable.AgeRates(u.Data, now.Sub(e.updated))
+			updates = append(updates, u)
+		}
+	}
+	s.mu.RUnlock()
+
+	for len(updates) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := min(len(updates), syncBatchSize)
+		if err := w.SendEntries(updates[:n]); err != nil {
+			return fmt.Errorf("sending entries: %w", err)
+		}
+		updates = updates[n:]
+	}
+
+	return nil
+}
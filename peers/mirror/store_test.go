@@ -0,0 +1,182 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/peertest"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+const testDeclaration = "table st_src type string expire 1m store gpc0,http_req_rate(10s),server_key"
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time { return c.t }
+
+func newTestStore() (*Store, *testClock) {
+	c := &testClock{t: time.UnixMilli(1700000000000)}
+	return &Store{now: c.now}, c
+}
+
+func gpc0(t *testing.T, s *Store, key string) (uint32, bool) {
+	t.Helper()
+	k := sticktable.StringKey(key)
+	e, ok := s.Lookup("st_src", &k)
+	if !ok {
+		return 0, false
+	}
+	return uint32(*e.Data[0].(*sticktable.UnsignedIntegerData)), true
+}
+
+func TestStoreUpdates(t *testing.T) {
+	s, clock := newTestStore()
+	ctx := context.Background()
+
+	def := *peertest.Definition(t, testDeclaration)
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3, Expiry: 1000}))
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "b", peertest.Entry{GPC0: 2, Rate: sticktable.NewFreqData(2), Server: "srv_b", ServerID: 3}))
+
+	u := peertest.Update(t, &def, "a", peertest.Entry{GPC0: 3, Rate: sticktable.NewFreqData(3), Server: "srv_a", ServerID: 3, Expiry: 1000})
+	s.HandleUpdate(ctx, u)
+	// The store must not share the reused update of the session.
+	*u.Data[0].(*sticktable.UnsignedIntegerData) = 4
+
+	if v, ok := gpc0(t, s, "a"); !ok || v != 3 {
+		t.Errorf("expected gpc0 3 for a, got %d (%v)", v, ok)
+	}
+
+	t.Run("expiry of update", func(t *testing.T) {
+		clock.t = clock.t.Add(time.Second)
+		if _, ok := gpc0(t, s, "a"); ok {
+			t.Error("expected a to be expired")
+		}
+	})
+
+	t.Run("expiry of table", func(t *testing.T) {
+		if _, ok := gpc0(t, s, "b"); !ok {
+			t.Error("expected b to be present")
+		}
+		clock.t = clock.t.Add(59 * time.Second)
+		if _, ok := gpc0(t, s, "b"); ok {
+			t.Error("expected b to be expired")
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		if n := s.Expire(); n != 2 {
+			t.Errorf("expected 2 expired entries, got %d", n)
+		}
+		if n := s.Len(def.Name); n != 0 {
+			t.Errorf("expected no entries, got %d", n)
+		}
+	})
+}
+
+func TestStoreDefinitions(t *testing.T) {
+	s, _ := newTestStore()
+	ctx := context.Background()
+
+	def := *peertest.Definition(t, testDeclaration)
+	def.StickTableID = 5
+	s.HandleDefinition(ctx, &def)
+
+	got, ok := s.Definition(def.Name)
+	if !ok {
+		t.Fatal("expected definition")
+	}
+	want := *peertest.Definition(t, testDeclaration)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Definition() mismatch (-want +got):\n%s", diff)
+	}
+
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3}))
+
+	t.Run("compatible definition keeps entries", func(t *testing.T) {
+		changed := def
+		changed.Expiry = 1000
+		s.HandleDefinition(ctx, &changed)
+		if n := s.Len(def.Name); n != 1 {
+			t.Errorf("expected 1 entry, got %d", n)
+		}
+	})
+
+	t.Run("changed data types drop entries", func(t *testing.T) {
+		changed := def
+		changed.DataTypes = changed.DataTypes[:1]
+		s.HandleDefinition(ctx, &changed)
+		if n := s.Len(def.Name); n != 0 {
+			t.Errorf("expected no entries, got %d", n)
+		}
+	})
+
+	other := *peertest.Definition(t, testDeclaration)
+	other.Name = "st_a"
+	s.HandleDefinition(ctx, &other)
+
+	var names []string
+	for _, d := range s.Tables() {
+		names = append(names, d.Name)
+	}
+	if diff := cmp.Diff([]string{"st_a", "st_src"}, names); diff != "" {
+		t.Errorf("Tables() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStoreSyncRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, clock := newTestStore()
+	def := *peertest.Definition(t, testDeclaration)
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "a", peertest.Entry{GPC0: 1, Rate: sticktable.NewFreqData(1), Server: "srv_a", ServerID: 3, Expiry: 1000}))
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "b", peertest.Entry{GPC0: 2, Rate: sticktable.NewFreqData(2), Server: "srv_b", ServerID: 3}))
+	s.HandleUpdate(ctx, peertest.Update(t, &def, "expired", peertest.Entry{GPC0: 3, Rate: sticktable.NewFreqData(3), Server: "srv_expired", ServerID: 3, Expiry: 100}))
+	clock.t = clock.t.Add(400 * time.Millisecond)
+
+	peer := &peers.Peer{BaseContext: ctx, Handler: s}
+	go peer.Serve(l)
+
+	conn := peertest.Dial(t, l.Addr().String(), "haproxy", "mirror")
+	conn.SendControl(t, peers.ControlMessageSyncRequest)
+
+	var got *sticktable.Definition
+	expiries := map[string]uint32{}
+	for {
+		m := conn.Receive(t)
+		if m.Update == nil {
+			if m.Control != peers.ControlMessageSyncFinished {
+				t.Fatalf("expected sync finished, got %s", m.Control)
+			}
+			break
+		}
+
+		got = m.Update.StickTable
+		expiries[m.Update.Key.String()] = m.Update.Expiry
+	}
+
+	if got == nil || got.Name != def.Name {
+		t.Errorf("expected entries of %s, got %v", def.Name, got)
+	}
+
+	// Entries without their own expiry were stored with the expiry of
+	// the table.
+	want := map[string]uint32{"a": 600, "b": 59600}
+	if diff := cmp.Diff(want, expiries); diff != "" {
+		t.Errorf("taught entries mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,244 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// TableMux is a Handler that routes stick-table updates to other handlers
+// by the name of the table. Patterns use the syntax of path.Match, so a
+// single handler can serve a group of tables like "st_rate_*".
+//
+// An update is routed to the handler registered for the exact table name,
+// otherwise to the handler of the first matching pattern in registration
+// order and as last resort to the catch-all handler. Updates of tables
+// without a handler are dropped.
+//
+// Handshakes and Close are passed on to every registered handler, once per
+// registration.
+type TableMux struct {
+	mu       sync.RWMutex
+	exact    map[string]Handler
+	patterns []muxEntry
+	defs     []muxDefinitionEntry
+	catchAll Handler
+
+	// routes caches the handler for a table name, it is reset whenever
+	// a handler is registered.
+	routes map[string]Handler
+}
+
+type muxEntry struct {
+	pattern string
+	handler Handler
+}
+
+type muxDefinitionEntry struct {
+	pattern string
+	handler DefinitionHandler
+}
+
+// NewTableMux allocates and returns a new TableMux.
+func NewTableMux() *TableMux {
+	return &TableMux{
+		exact:  make(map[string]Handler),
+		routes: make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for the tables matching pattern. If the
+// handler implements DefinitionHandler it also receives the definitions of
+// these tables. Handle panics if the pattern is invalid or already
+// registered.
+func (m *TableMux) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("peers: nil handler")
+	}
+	mustValidPattern(pattern)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.exact[pattern]; ok {
+		panic("peers: multiple registrations for " + pattern)
+	}
+	for _, e := range m.patterns {
+		if e.pattern == pattern {
+			panic("peers: multiple registrations for " + pattern)
+		}
+	}
+
+	if isPattern(pattern) {
+		m.patterns = append(m.patterns, muxEntry{pattern: pattern, handler: handler})
+	} else {
+		m.exact[pattern] = handler
+	}
+	clear(m.routes)
+}
+
+// HandleFunc registers the handler function for the tables matching pattern.
+func (m *TableMux) HandleFunc(pattern string, handler func(context.Context, *sticktable.EntryUpdate)) {
+	m.Handle(pattern, HandlerFunc(handler))
+}
+
+// HandleCatchAll registers the handler for all tables without a matching
+// pattern.
+func (m *TableMux) HandleCatchAll(handler Handler) {
+	if handler == nil {
+		panic("peers: nil handler")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.catchAll = handler
+	clear(m.routes)
+}
+
+// SubscribeDefinitions registers the handler for the definitions of the
+// tables matching pattern. Unlike updates, definitions are passed to every
+// matching subscription.
+func (m *TableMux) SubscribeDefinitions(pattern string, handler DefinitionHandler) {
+	if handler == nil {
+		panic("peers: nil handler")
+	}
+	mustValidPattern(pattern)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.defs = append(m.defs, muxDefinitionEntry{pattern: pattern, handler: handler})
+}
+
+// Handler returns the handler for the table name or nil if there is none.
+func (m *TableMux) Handler(table string) Handler {
+	m.mu.RLock()
+	h, ok := m.routes[table]
+	m.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h = m.match(table)
+	m.routes[table] = h
+	return h
+}
+
+// match returns the handler for the table name. Caller MUST hold the mutex.
+func (m *TableMux) match(table string) Handler {
+	if h, ok := m.exact[table]; ok {
+		return h
+	}
+
+	for _, e := range m.patterns {
+		// The pattern was validated on registration.
+		if ok, _ := path.Match(e.pattern, table); ok {
+			return e.handler
+		}
+	}
+
+	return m.catchAll
+}
+
+func (m *TableMux) HandleUpdate(ctx context.Context, u *sticktable.EntryUpdate) {
+	if h := m.Handler(u.StickTable.Name); h != nil {
+		h.HandleUpdate(ctx, u)
+	}
+}
+
+func (m *TableMux) HandleDefinition(ctx context.Context, d *sticktable.Definition) {
+	if dh, ok := m.Handler(d.Name).(DefinitionHandler); ok {
+		dh.HandleDefinition(ctx, d)
+	}
+
+	m.mu.RLock()
+	defs := m.defs
+	m.mu.RUnlock()
+
+	for _, e := range defs {
+		if ok, _ := path.Match(e.pattern, d.Name); ok {
+			e.handler.HandleDefinition(ctx, d)
+		}
+	}
+}
+
+// ValidateHandshake rejects the remote peer if any registered handler
+// implementing HandshakeValidator rejects it.
+func (m *TableMux) ValidateHandshake(ctx context.Context, h *Handshake) error {
+	for _, handler := range m.handlers() {
+		if v, ok := handler.(HandshakeValidator); ok {
+			if err := v.ValidateHandshake(ctx, h); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *TableMux) HandleHandshake(ctx context.Context, h *Handshake) {
+	for _, handler := range m.handlers() {
+		handler.HandleHandshake(ctx, h)
+	}
+}
+
+func (m *TableMux) Close() error {
+	var errs []error
+	for _, handler := range m.handlers() {
+		errs = append(errs, handler.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// handlers returns all registered handlers.
+func (m *TableMux) handlers() []Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	handlers := make([]Handler, 0, len(m.exact)+len(m.patterns)+1)
+	for _, h := range m.exact {
+		handlers = append(handlers, h)
+	}
+	for _, e := range m.patterns {
+		handlers = append(handlers, e.handler)
+	}
+	if m.catchAll != nil {
+		handlers = append(handlers, m.catchAll)
+	}
+
+	return handlers
+}
+
+func isPattern(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+func mustValidPattern(pattern string) {
+	if pattern == "" {
+		panic("peers: empty pattern")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic(fmt.Sprintf("peers: invalid pattern %q: %v", pattern, err))
+	}
+}
+
+var (
+	_ Handler            = (*TableMux)(nil)
+	_ DefinitionHandler  = (*TableMux)(nil)
+	_ HandshakeValidator = (*TableMux)(nil)
+)
@@ -0,0 +1,145 @@
+package peers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+func TestTableMuxRouting(t *testing.T) {
+	var got []string
+	record := func(name string) HandlerFunc {
+		return func(_ context.Context, u *sticktable.EntryUpdate) {
+			got = append(got, name+":"+u.StickTable.Name)
+		}
+	}
+
+	m := NewTableMux()
+	m.Handle("st_rate_*", record("pattern"))
+	m.Handle("st_rate_global", record("exact"))
+	m.Handle("st_*", record("prefix"))
+	m.HandleCatchAll(record("catchall"))
+
+	for _, table := range []string{"st_rate_global", "st_rate_src", "st_block", "other"} {
+		m.HandleUpdate(context.Background(), &sticktable.EntryUpdate{
+			StickTable: &sticktable.Definition{Name: table},
+		})
+	}
+
+	want := []string{
+		"exact:st_rate_global",
+		"pattern:st_rate_src",
+		"prefix:st_block",
+		"catchall:other",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestTableMuxInvalidRegistrations(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(m *TableMux)
+	}{
+		{"invalid pattern", func(m *TableMux) { m.Handle("st_[", HandlerFunc(nil)) }},
+		{"empty pattern", func(m *TableMux) { m.Handle("", HandlerFunc(nil)) }},
+		{"nil handler", func(m *TableMux) { m.Handle("st", nil) }},
+		{"duplicate", func(m *TableMux) {
+			m.Handle("st_*", HandlerFunc(nil))
+			m.Handle("st_*", HandlerFunc(nil))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			tt.fn(NewTableMux())
+		})
+	}
+}
+
+func TestTableMuxDefinitions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	definitions := make(chan string, 10)
+	updates := make(chan string, 10)
+
+	m := NewTableMux()
+	m.HandleFunc("st_a", func(_ context.Context, u *sticktable.EntryUpdate) {
+		updates <- u.StickTable.Name
+	})
+	m.SubscribeDefinitions("st_*", DefinitionHandlerFunc(func(_ context.Context, d *sticktable.Definition) {
+		definitions <- d.Name
+	}))
+
+	peer := &Peer{BaseContext: ctx, Handler: m}
+	go peer.Serve(l)
+
+	conn := helperDialPeer(t, l.Addr().String(), "peer_a", "peer_b")
+	defer conn.Close()
+
+	w := newWriter(conn, &sync.Mutex{})
+
+	for _, name := range []string{"st_a", "st_b"} {
+		def := &sticktable.Definition{
+			Name:      name,
+			KeyType:   sticktable.KeyTypeString,
+			KeyLength: 32,
+		}
+		if err := w.SendTableDefinition(def); err != nil {
+			t.Fatal(err)
+		}
+
+		key := sticktable.StringKey("key")
+		if err := w.SendEntry(&sticktable.EntryUpdate{StickTable: def, Key: &key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"st_a", "st_b"} {
+		select {
+		case got := <-definitions:
+			if got != want {
+				t.Errorf("expected definition of %q, got %q", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for definition")
+		}
+	}
+
+	select {
+	case got := <-updates:
+		if got != "st_a" {
+			t.Errorf("expected update of st_a, got %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for update")
+	}
+
+	select {
+	case got := <-updates:
+		t.Errorf("unexpected update of %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
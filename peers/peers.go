@@ -2,10 +2,17 @@ package peers
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
 )
 
 type Peer struct {
@@ -13,15 +20,75 @@ type Peer struct {
 	HandlerSource func() Handler
 	BaseContext   context.Context
 	Addr          string
+
+	// Name is the name of this peer in the HAProxy peers section. Remote
+	// peers addressing a different name are rejected. Any name is accepted
+	// if empty.
+	Name string
+	// AllowedPeers is the list of remote peer names allowed to connect.
+	// All remote peers are allowed if empty.
+	AllowedPeers []string
+
+	// TLSConfig enables TLS for accepted and dialed sessions if set, like
+	// the ssl option of a peer in HAProxy. Set ClientAuth to verify the
+	// certificates of remote peers, which are available to the handler
+	// with PeerCertificate.
+	TLSConfig *tls.Config
+	// CertificatePeers maps the identities of verified certificates to
+	// the names of the peers that may use them. The identities of a
+	// certificate are its common name and DNS names. If set, remote peers
+	// are rejected unless their name is mapped from an identity of their
+	// certificate.
+	CertificatePeers map[string][]string
+	// SocketMode is the permission of the unix socket opened by
+	// ListenAndServe if Addr is a unix socket. The umask applies if zero.
+	SocketMode fs.FileMode
+
+	// HeartbeatInterval is the interval heartbeat messages are sent in.
+	// Defaults to 3s like HAProxy.
+	HeartbeatInterval time.Duration
+	// DeadPeerTimeout is the time after which a remote peer that did not
+	// send any message is considered dead and its session is closed.
+	// Defaults to 5s like HAProxy.
+	DeadPeerTimeout time.Duration
+
+	// UpdateQueueSize enables the asynchronous dispatch of updates if
+	// greater than zero. Updates are queued per session and passed to the
+	// handler by a separate goroutine, so a slow handler does not stall
+	// reading and heartbeats of the session.
+	UpdateQueueSize int
+	// UpdateQueueOverflow is the policy applied when the update queue of a
+	// session is full.
+	UpdateQueueOverflow OverflowPolicy
+	// ReuseUpdates reuses received updates once HandleUpdate returned, so
+	// receiving does not allocate in steady state. Handlers must not retain
+	// the update or its key and data then, use EntryUpdate.Clone instead.
+	// Updates are allocated for every message if false.
+	ReuseUpdates bool
+
+	dispatchStats dispatchStats
+
+	initOnce   sync.Once
+	mu         sync.Mutex
+	inShutdown atomic.Bool
+	listeners  map[net.Listener]struct{}
+	sessions   map[*protocolClient]struct{}
+	sessionsWG sync.WaitGroup
 }
 
+// ErrPeerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown.
+var ErrPeerClosed = errors.New("peers: Peer closed")
+
 func ListenAndServe(addr string, handler Handler) error {
 	a := Peer{Addr: addr, Handler: handler}
 	return a.ListenAndServe()
 }
 
+// ListenAndServe listens on Addr and serves the sessions. Addr may be a
+// unix socket like unix@/run/peers.sock, see socket.Network.
 func (a *Peer) ListenAndServe() error {
-	l, err := net.Listen("tcp", a.Addr)
+	l, err := socket.Listen(a.Addr, a.SocketMode)
 	if err != nil {
 		return fmt.Errorf("opening listener: %w", err)
 	}
@@ -30,51 +97,201 @@ func (a *Peer) ListenAndServe() error {
 	return a.Serve(l)
 }
 
+// Serve accepts sessions on l until BaseContext is done or Shutdown is
+// called. Serve may be called concurrently for several listeners.
 func (a *Peer) Serve(l net.Listener) error {
-	a.Addr = l.Addr().String()
-	if a.BaseContext == nil {
-		a.BaseContext = context.Background()
-	}
+	a.initOnce.Do(func() {
+		a.Addr = l.Addr().String()
+		if a.BaseContext == nil {
+			a.BaseContext = context.Background()
+		}
+	})
 
 	go func() {
 		<-a.BaseContext.Done()
 		l.Close()
 	}()
 
-	if a.Handler != nil && a.HandlerSource != nil {
-		return fmt.Errorf("cannot set Handler and HandlerSource at the same time")
+	if err := a.checkHandler(); err != nil {
+		return err
 	}
 
-	if a.Handler != nil {
-		a.HandlerSource = func() Handler {
-			return a.Handler
-		}
+	if !a.trackListener(l, true) {
+		return ErrPeerClosed
 	}
+	defer a.trackListener(l, false)
 
 	for {
 		nc, err := l.Accept()
 		if err != nil {
+			if a.inShutdown.Load() {
+				return ErrPeerClosed
+			}
 			return fmt.Errorf("accepting conn: %w", err)
 		}
 
-		// Wrap the context to provide access to the underlying connection.
-		// TODO(tim): Do we really want this?
-		ctx := context.WithValue(a.BaseContext, connectionKey, nc)
-		wmu := &sync.Mutex{}
-		w := newWriter(nc, wmu)
-		ctx = context.WithValue(ctx, writerKey, w)
-		p := newProtocolClient(ctx, nc, a.HandlerSource(), wmu, w.bufferedWriter())
-		go func() {
-			defer nc.Close()
-			defer p.Close()
+		if a.TLSConfig != nil {
+			nc = tls.Server(nc, a.TLSConfig)
+		}
 
-			if err := p.Serve(); err != nil && err != p.ctx.Err() {
+		p := a.newSession(a.BaseContext, nc, a.newHandler())
+		if !a.trackSession(p, true) {
+			nc.Close()
+			return ErrPeerClosed
+		}
+
+		go func() {
+			if err := a.serveSession(p, nc); err != nil {
 				log.Println(err)
 			}
 		}()
 	}
 }
 
+// ServeListeners serves all listeners, for example those returned by
+// socket.Systemd. It returns the error of the first listener failing and
+// closes the others.
+func (a *Peer) ServeListeners(listeners []net.Listener) error {
+	return socket.ServeAll(listeners, a.Serve)
+}
+
+// checkHandler returns an error unless exactly one of Handler and
+// HandlerSource is set.
+func (a *Peer) checkHandler() error {
+	switch {
+	case a.Handler != nil && a.HandlerSource != nil:
+		return fmt.Errorf("cannot set Handler and HandlerSource at the same time")
+	case a.Handler == nil && a.HandlerSource == nil:
+		return fmt.Errorf("no Handler or HandlerSource set")
+	default:
+		return nil
+	}
+}
+
+// newHandler returns the handler of a new session, Handler or one
+// returned by HandlerSource. The fields must be checked by checkHandler.
+func (a *Peer) newHandler() Handler {
+	if a.Handler != nil {
+		return a.Handler
+	}
+	return a.HandlerSource()
+}
+
+// newSession returns the session on the connection.
+func (a *Peer) newSession(ctx context.Context, nc net.Conn, handler Handler) *protocolClient {
+	// Wrap the context to provide access to the underlying connection.
+	// TODO(tim): Do we really want this?
+	ctx = context.WithValue(ctx, connectionKey, nc)
+	wmu := &sync.Mutex{}
+	w := newWriter(nc, wmu)
+	ctx = context.WithValue(ctx, writerKey, w)
+	p := newProtocolClient(ctx, a, nc, handler, wmu, w.bufferedWriter())
+
+	// Closing the connection unblocks the read loop once the
+	// session ends, for example when the remote peer is dead.
+	context.AfterFunc(p.ctx, func() {
+		nc.Close()
+	})
+
+	return p
+}
+
+// serveSession serves a tracked session until it ends. The error is nil if
+// the session was closed locally or by the remote peer.
+func (a *Peer) serveSession(p *protocolClient, nc net.Conn) error {
+	defer a.trackSession(p, false)
+	defer nc.Close()
+	defer p.Close()
+
+	if err := p.tlsHandshake(); err != nil {
+		return err
+	}
+
+	if err := p.Serve(); err != nil && err != p.ctx.Err() {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the peer. It closes all listeners, then
+// flushes the pending writes of all sessions and closes them. Shutdown
+// waits for the sessions to end or until ctx is done.
+func (a *Peer) Shutdown(ctx context.Context) error {
+	a.inShutdown.Store(true)
+
+	a.mu.Lock()
+	var err error
+	for l := range a.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	sessions := make([]*protocolClient, 0, len(a.sessions))
+	for p := range a.sessions {
+		sessions = append(sessions, p)
+	}
+	a.mu.Unlock()
+
+	for _, p := range sessions {
+		// Errors of single sessions are not relevant for the shutdown,
+		// they are closed either way.
+		_ = p.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.sessionsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Peer) trackListener(l net.Listener, add bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if add {
+		if a.inShutdown.Load() {
+			return false
+		}
+		if a.listeners == nil {
+			a.listeners = make(map[net.Listener]struct{})
+		}
+		a.listeners[l] = struct{}{}
+	} else {
+		delete(a.listeners, l)
+	}
+
+	return true
+}
+
+func (a *Peer) trackSession(p *protocolClient, add bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if add {
+		if a.inShutdown.Load() {
+			return false
+		}
+		if a.sessions == nil {
+			a.sessions = make(map[*protocolClient]struct{})
+		}
+		a.sessions[p] = struct{}{}
+		a.sessionsWG.Add(1)
+	} else {
+		delete(a.sessions, p)
+		a.sessionsWG.Done()
+	}
+
+	return true
+}
+
 type contextKey string
 
 const (
@@ -0,0 +1,353 @@
+package peers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
+)
+
+// helperHandshakeStatus sends the handshake to the peer listening on addr
+// and returns the status it replied with. addr is in the syntax of
+// socket.Network.
+func helperHandshakeStatus(t *testing.T, addr string, h *Handshake) HandshakeStatus {
+	t.Helper()
+	network, address := socket.Network(addr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatalf("dialing peer: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = h.WriteTo(conn); err != nil {
+		t.Fatalf("writing handshake: %v", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading handshake status: %v", err)
+	}
+
+	var status int
+	if _, err = fmt.Sscanf(line, "%d\n", &status); err != nil {
+		t.Fatalf("parsing status %q: %v", line, err)
+	}
+
+	return HandshakeStatus(status)
+}
+
+func TestPeerHandshakeValidation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer := &Peer{
+		BaseContext:  ctx,
+		Name:         "go_peer",
+		AllowedPeers: []string{"haproxy_peer", "vetoed_peer", "succeeded_peer"},
+		HandlerSource: func() Handler {
+			return &vetoHandler{}
+		},
+	}
+	go peer.Serve(l)
+
+	tests := []struct {
+		name   string
+		modify func(h *Handshake)
+		want   HandshakeStatus
+	}{
+		{"valid", func(h *Handshake) {}, HandshakeStatusHandshakeSucceeded},
+		{"minor version", func(h *Handshake) { h.Version = "2.0" }, HandshakeStatusHandshakeSucceeded},
+		{"protocol identifier", func(h *Handshake) { h.ProtocolIdentifier = "HAProxyX" }, HandshakeStatusProtocolError},
+		{"version", func(h *Handshake) { h.Version = "3.0" }, HandshakeStatusBadVersion},
+		{"higher minor version", func(h *Handshake) { h.Version = "2.2" }, HandshakeStatusBadVersion},
+		{"malformed version", func(h *Handshake) { h.Version = "2" }, HandshakeStatusBadVersion},
+		{"local peer name", func(h *Handshake) { h.RemotePeer = "other_peer" }, HandshakeStatusLocalPeerIdentifierMismatch},
+		{"remote peer name", func(h *Handshake) { h.LocalPeerIdentifier = "unknown_peer" }, HandshakeStatusRemotePeerIdentifierMismatch},
+		{"handler veto", func(h *Handshake) { h.LocalPeerIdentifier = "vetoed_peer" }, HandshakeStatusTryAgainLater},
+		{"handler veto with success status", func(h *Handshake) { h.LocalPeerIdentifier = "succeeded_peer" }, HandshakeStatusProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandshakeFrom("haproxy_peer", "go_peer")
+			tt.modify(h)
+
+			if got := helperHandshakeStatus(t, l.Addr().String(), h); got != tt.want {
+				t.Errorf("expected status %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// vetoHandler rejects the handshakes of the peers named vetoed_peer and
+// succeeded_peer, the latter with a status that does not reject a peer.
+type vetoHandler struct {
+	testHandler
+}
+
+func (h *vetoHandler) ValidateHandshake(_ context.Context, hs *Handshake) error {
+	switch hs.LocalPeerIdentifier {
+	case "vetoed_peer":
+		return HandshakeStatusTryAgainLater
+	case "succeeded_peer":
+		return HandshakeStatusHandshakeSucceeded
+	}
+	return nil
+}
+
+func TestPeerWriteInHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer := &Peer{
+		BaseContext: ctx,
+		HandlerSource: func() Handler {
+			return &testHandler{
+				onHandshake: func(ctx context.Context, h *Handshake) {
+					if err := WriterFromContext(ctx).SendSyncRequest(); err != nil {
+						t.Errorf("sending sync request: %v", err)
+					}
+				},
+			}
+		},
+	}
+	go peer.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := NewHandshakeFrom("haproxy_peer", "go_peer").WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The status reply precedes the messages sent by the handler.
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading handshake status: %v", err)
+	}
+	if want := fmt.Sprintf("%d\n", HandshakeStatusHandshakeSucceeded); line != want {
+		t.Fatalf("expected status %q, got %q", want, line)
+	}
+
+	msg := make([]byte, 2)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		t.Fatalf("reading sync request: %v", err)
+	}
+	if want := []byte{byte(MessageClassControl), byte(ControlMessageSyncRequest)}; !bytes.Equal(msg, want) {
+		t.Errorf("expected sync request %v, got %v", want, msg)
+	}
+}
+
+func TestPeerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closed := make(chan struct{})
+	peer := &Peer{
+		BaseContext: ctx,
+		HandlerSource: func() Handler {
+			return &closeHandler{closed: closed}
+		},
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- peer.Serve(l)
+	}()
+
+	conn := helperDialPeer(t, l.Addr().String(), "haproxy_peer", "go_peer")
+	defer conn.Close()
+
+	if err := peer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("expected ErrPeerClosed, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for Serve to return")
+	}
+
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for handler to be closed")
+	}
+
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("expected connection to be closed cleanly, got %v", err)
+	}
+
+	if err := peer.Serve(l); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("expected ErrPeerClosed after shutdown, got %v", err)
+	}
+}
+
+func TestPeerServeListeners(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixAddr := "unix@" + filepath.Join(t.TempDir(), "peers.sock")
+	unix, err := socket.Listen(unixAddr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handler is shared by all listeners and must not be replaced by the
+	// first call to Serve.
+	peer := &Peer{BaseContext: ctx, Name: "go_peer", Handler: &testHandler{}}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- peer.ServeListeners([]net.Listener{tcp, unix})
+	}()
+
+	for _, addr := range []string{tcp.Addr().String(), unixAddr} {
+		h := NewHandshakeFrom("haproxy_peer", "go_peer")
+		if got := helperHandshakeStatus(t, addr, h); got != HandshakeStatusHandshakeSucceeded {
+			t.Errorf("%s: expected status %s, got %s", addr, HandshakeStatusHandshakeSucceeded, got)
+		}
+	}
+
+	if err := peer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("expected ErrPeerClosed, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for ServeListeners to return")
+	}
+}
+
+func TestPeerHandlerSource(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	// Only sessions create handlers, listeners do not.
+	var handlers atomic.Int32
+	peer := &Peer{BaseContext: ctx, HandlerSource: func() Handler {
+		handlers.Add(1)
+		return &testHandler{}
+	}}
+	go peer.ServeListeners(listeners)
+
+	for _, l := range listeners {
+		h := NewHandshakeFrom("haproxy_peer", "go_peer")
+		if got := helperHandshakeStatus(t, l.Addr().String(), h); got != HandshakeStatusHandshakeSucceeded {
+			t.Errorf("expected status %s, got %s", HandshakeStatusHandshakeSucceeded, got)
+		}
+	}
+
+	if err := peer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := handlers.Load(); n != 2 {
+		t.Errorf("expected 2 handlers, got %d", n)
+	}
+}
+
+func TestPeerTimers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closed := make(chan struct{})
+	peer := &Peer{
+		BaseContext:       ctx,
+		HeartbeatInterval: 10 * time.Millisecond,
+		DeadPeerTimeout:   100 * time.Millisecond,
+		HandlerSource: func() Handler {
+			return &closeHandler{closed: closed}
+		},
+	}
+	go peer.Serve(l)
+
+	conn := helperDialPeer(t, l.Addr().String(), "haproxy_peer", "go_peer")
+	defer conn.Close()
+
+	start := time.Now()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dead peer was closed after %s", elapsed)
+	}
+
+	heartbeat := []byte{byte(MessageClassControl), byte(ControlMessageHeartbeat)}
+	if len(b) < 2*len(heartbeat) || !bytes.Equal(b[:2], heartbeat) {
+		t.Errorf("expected heartbeats before closing, got %v", b)
+	}
+
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for handler to be closed")
+	}
+}
+
+// closeHandler signals when the handler of a session is closed.
+type closeHandler struct {
+	testHandler
+	closed chan struct{}
+}
+
+func (h *closeHandler) Close() error {
+	close(h.closed)
+	return nil
+}
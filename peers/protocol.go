@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 )
 
 type protocolClient struct {
+	peer      *Peer
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	rw        io.ReadWriter
@@ -23,32 +25,73 @@ type protocolClient struct {
 	bw        *bufio.Writer
 	wmu       *sync.Mutex
 
-	nextHeartbeat       *time.Ticker
-	lastMessageTimer    *time.Timer
-	lastTableDefinition *sticktable.Definition
-	lastEntryUpdate     *sticktable.EntryUpdate
+	closeOnce        sync.Once
+	nextHeartbeat    *time.Ticker
+	lastMessageTimer *time.Timer
+	lastTable        *rxTable
+	dictCache        dictRxCache
+
+	// tables holds the received table definitions by their ID, so
+	// repeated definitions of a table are decoded without allocations.
+	tables       map[uint64]*rxTable
+	rxDefinition sticktable.Definition
 
 	handler Handler
+	// dialed is the handshake sent to the remote peer, only set if the
+	// session was established by DialAndServe.
+	dialed *Handshake
+	// queue is only set for asynchronous dispatch of updates, dispatched
+	// is closed once its dispatcher stopped.
+	queue      *updateQueue
+	dispatched chan struct{}
 }
 
-func newProtocolClient(ctx context.Context, rw io.ReadWriter, handler Handler, wmu *sync.Mutex, bw *bufio.Writer) *protocolClient {
+func newProtocolClient(ctx context.Context, peer *Peer, rw io.ReadWriter, handler Handler, wmu *sync.Mutex, bw *bufio.Writer) *protocolClient {
 	var c protocolClient
+	c.peer = peer
 	c.rw = rw
 	c.br = bufio.NewReader(rw)
 	c.bw = bw
 	c.handler = handler
 	c.wmu = wmu
 	c.ctx, c.ctxCancel = context.WithCancel(ctx)
+
+	if peer.UpdateQueueSize > 0 {
+		c.queue = newUpdateQueue(peer.UpdateQueueSize, peer.UpdateQueueOverflow, &peer.dispatchStats)
+		c.dispatched = make(chan struct{})
+		go c.dispatch()
+	}
+
 	return &c
 }
 
+// Close ends the session and closes the handler. It is safe to call Close
+// multiple times and concurrently, only the first call closes the handler.
+// The handler is closed after the dispatcher stopped and the update queue
+// was drained, so HandleUpdate is not called concurrently or afterwards.
 func (c *protocolClient) Close() error {
-	defer c.ctxCancel()
-	if c.ctx.Err() != nil {
-		return c.ctx.Err()
-	}
+	err := c.ctx.Err()
+	c.closeOnce.Do(func() {
+		c.ctxCancel()
+		if c.queue != nil {
+			<-c.dispatched
+			c.drain()
+		}
+		err = c.handler.Close()
+	})
+	return err
+}
+
+// shutdown flushes pending writes before closing the session.
+func (c *protocolClient) shutdown() error {
+	c.wmu.Lock()
+	err := c.bw.Flush()
+	c.wmu.Unlock()
 
-	return c.handler.Close()
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (c *protocolClient) lockedWrite(data []byte) (int, error) {
@@ -64,28 +107,92 @@ func (c *protocolClient) lockedWrite(data []byte) (int, error) {
 func (c *protocolClient) peerHandshake() error {
 	var h Handshake
 	if _, err := h.ReadFrom(c.br); err != nil {
+		// The reply is best effort, as the connection is closed anyway.
+		_ = c.writeHandshakeStatus(HandshakeStatusProtocolError)
 		return err
 	}
 
-	c.handler.HandleHandshake(c.ctx, &h)
+	status := h.validate(c.peer.Name, c.peer.AllowedPeers)
+	if status != HandshakeStatusHandshakeSucceeded {
+		_ = c.writeHandshakeStatus(status)
+		return fmt.Errorf("rejected peer %q: %w", h.LocalPeerIdentifier, status)
+	}
 
-	if _, err := c.lockedWrite([]byte(fmt.Sprintf("%d\n", HandshakeStatusHandshakeSucceeded))); err != nil {
+	if err := c.verifyCertificate(h.LocalPeerIdentifier); err != nil {
+		_ = c.writeHandshakeStatus(HandshakeStatusRemotePeerIdentifierMismatch)
+		return err
+	}
+
+	if v, ok := c.handler.(HandshakeValidator); ok {
+		if err := v.ValidateHandshake(c.ctx, &h); err != nil {
+			switch {
+			case !errors.As(err, &status):
+				status = HandshakeStatusRemotePeerIdentifierMismatch
+			case !status.rejects():
+				// The peer is rejected either way, a successful status
+				// would only make it retry against a closed session.
+				status = HandshakeStatusProtocolError
+			}
+			_ = c.writeHandshakeStatus(status)
+			return fmt.Errorf("handler rejected peer %q: %w", h.LocalPeerIdentifier, err)
+		}
+	}
+
+	// The reply is sent before the handler is called, so updates it sends
+	// with the Writer of the session follow it.
+	if err := c.writeHandshakeStatus(HandshakeStatusHandshakeSucceeded); err != nil {
 		return fmt.Errorf("handshake failed: %v", err)
 	}
 
+	c.handler.HandleHandshake(c.ctx, &h)
+
 	return nil
 }
 
+// writeHandshakeStatus writes the status reply to a handshake.
+func (c *protocolClient) writeHandshakeStatus(status HandshakeStatus) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := fmt.Fprintf(c.bw, "%d\n", status); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+const (
+	// defaultHeartbeatInterval is the interval HAProxy sends heartbeat
+	// messages in when there is no stick-table to synchronize.
+	defaultHeartbeatInterval = 3 * time.Second
+	// defaultDeadPeerTimeout is the time after which HAProxy considers a
+	// peer that did not send any message as no more alive.
+	defaultDeadPeerTimeout = 5 * time.Second
+)
+
+func (c *protocolClient) heartbeatInterval() time.Duration {
+	if c.peer.HeartbeatInterval > 0 {
+		return c.peer.HeartbeatInterval
+	}
+	return defaultHeartbeatInterval
+}
+
+func (c *protocolClient) deadPeerTimeout() time.Duration {
+	if c.peer.DeadPeerTimeout > 0 {
+		return c.peer.DeadPeerTimeout
+	}
+	return defaultDeadPeerTimeout
+}
+
 func (c *protocolClient) resetHeartbeat() {
 	// a peer sends heartbeat messages to peers it is
 	// connected to after periods of 3s of inactivity (i.e. when there is no
 	// stick-table to synchronize for 3s).
 	if c.nextHeartbeat == nil {
-		c.nextHeartbeat = time.NewTicker(time.Second * 3)
+		c.nextHeartbeat = time.NewTicker(c.heartbeatInterval())
 		return
 	}
 
-	c.nextHeartbeat.Reset(time.Second * 3)
+	c.nextHeartbeat.Reset(c.heartbeatInterval())
 }
 
 func (c *protocolClient) resetLastMessage() {
@@ -96,15 +203,23 @@ func (c *protocolClient) resetLastMessage() {
 	// which closes the session and then tries to reconnect to the peer which
 	// has just disappeared.
 	if c.lastMessageTimer == nil {
-		c.lastMessageTimer = time.NewTimer(time.Second * 5)
+		c.lastMessageTimer = time.NewTimer(c.deadPeerTimeout())
 		return
 	}
 
-	c.lastMessageTimer.Reset(time.Second * 5)
+	c.lastMessageTimer.Reset(c.deadPeerTimeout())
 }
 
 func (c *protocolClient) heartbeat() {
-	for range c.nextHeartbeat.C {
+	defer c.nextHeartbeat.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.nextHeartbeat.C:
+		}
+
 		_, err := c.lockedWrite([]byte{byte(MessageClassControl), byte(ControlMessageHeartbeat)})
 		if err != nil {
 			_ = c.Close()
@@ -114,14 +229,23 @@ func (c *protocolClient) heartbeat() {
 }
 
 func (c *protocolClient) lastMessage() {
-	<-c.lastMessageTimer.C
-	log.Println("last message timer expired: closing connection")
-	_ = c.Close()
+	defer c.lastMessageTimer.Stop()
+
+	select {
+	case <-c.ctx.Done():
+	case <-c.lastMessageTimer.C:
+		log.Println("last message timer expired: closing connection")
+		_ = c.Close()
+	}
 }
 
 func (c *protocolClient) Serve() error {
-	if err := c.peerHandshake(); err != nil {
-		return fmt.Errorf("handshake: %v", err)
+	handshake := c.peerHandshake
+	if c.dialed != nil {
+		handshake = c.clientHandshake
+	}
+	if err := handshake(); err != nil {
+		return fmt.Errorf("handshake: %w", err)
 	}
 
 	c.resetHeartbeat()
@@ -129,9 +253,10 @@ func (c *protocolClient) Serve() error {
 	go c.heartbeat()
 	go c.lastMessage()
 
-	for {
-		var m rawMessage
+	m := acquireMessage()
+	defer releaseMessage(m)
 
+	for {
 		if _, err := m.ReadFrom(c.br); err != nil {
 			if c.ctx.Err() != nil {
 				return c.ctx.Err()
@@ -145,7 +270,11 @@ func (c *protocolClient) Serve() error {
 		}
 
 		c.resetLastMessage()
-		if err := c.messageHandler(&m); err != nil {
+		if err := c.messageHandler(m); err != nil {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
+			}
+
 			return fmt.Errorf("message handler: %v", err)
 		}
 	}
@@ -169,6 +298,33 @@ type byteReader interface {
 	io.Reader
 }
 
+// maxPooledMessageSize is the capacity up to which message buffers are
+// put back into the pool, so a single large message does not pin memory.
+const maxPooledMessageSize = 64 << 10
+
+var messagePool = sync.Pool{
+	New: func() any {
+		return &rawMessage{}
+	},
+}
+
+func acquireMessage() *rawMessage {
+	return messagePool.Get().(*rawMessage)
+}
+
+func releaseMessage(m *rawMessage) {
+	if cap(m.Data) > maxPooledMessageSize {
+		m.Data = nil
+	}
+	m.Data = m.Data[:0]
+	m.MessageClass = 0
+	m.MessageType = 0
+
+	messagePool.Put(m)
+}
+
+// rawMessage is a single message of the peers protocol. Its data is only
+// valid until the next call to ReadFrom, as the buffer is reused.
 type rawMessage struct {
 	Data []byte
 
@@ -178,14 +334,23 @@ type rawMessage struct {
 
 func (m *rawMessage) ReadFrom(r byteReader) (int64, error) {
 	// All the messages are made at least of a two bytes length header.
-	header := make([]byte, 2)
-	n, err := io.ReadFull(r, header)
+	class, err := r.ReadByte()
 	if err != nil {
-		return int64(n), err
+		return 0, err
 	}
 
-	m.MessageClass = MessageClass(header[0])
-	m.MessageType = header[1]
+	messageType, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 1, err
+	}
+
+	n := 2
+	m.MessageClass = MessageClass(class)
+	m.MessageType = messageType
+	m.Data = m.Data[:0]
 
 	var readData int
 	// All messages with type >= 128 have a payload
@@ -195,7 +360,10 @@ func (m *rawMessage) ReadFrom(r byteReader) (int64, error) {
 			return int64(n), fmt.Errorf("failed decoding data length: %v", err)
 		}
 
-		m.Data = make([]byte, dataLength)
+		if uint64(cap(m.Data)) < dataLength {
+			m.Data = make([]byte, dataLength)
+		}
+		m.Data = m.Data[:dataLength]
 		readData, err = io.ReadFull(r, m.Data)
 		if err != nil {
 			return int64(n + readData), fmt.Errorf("failed reading message data: %v", err)
@@ -222,7 +390,16 @@ func (t ErrorMessageType) OnMessage(m *rawMessage, c *protocolClient) error {
 func (t ControlMessageType) OnMessage(m *rawMessage, c *protocolClient) error {
 	switch t {
 	case ControlMessageSyncRequest:
-		_, _ = c.lockedWrite([]byte{byte(MessageClassControl), byte(ControlMessageSyncPartial)})
+		sh, ok := c.handler.(SyncHandler)
+		w, _ := c.ctx.Value(writerKey).(*Writer)
+		if !ok || w == nil {
+			_, _ = c.lockedWrite([]byte{byte(MessageClassControl), byte(ControlMessageSyncPartial)})
+			return nil
+		}
+
+		// Teaching may take a while, reading has to continue meanwhile to
+		// receive the heartbeats of the remote peer.
+		go c.teach(sh, w)
 		return nil
 	case ControlMessageSyncFinished:
 		return nil
@@ -237,18 +414,46 @@ func (t ControlMessageType) OnMessage(m *rawMessage, c *protocolClient) error {
 	}
 }
 
+// teach passes a synchronization request to the handler and reports the
+// result to the remote peer once all entries were sent.
+func (c *protocolClient) teach(sh SyncHandler, w *Writer) {
+	status := ControlMessageSyncFinished
+	if err := sh.HandleSyncRequest(c.ctx, w); err != nil {
+		log.Printf("sync request: %v", err)
+		status = ControlMessageSyncPartial
+	}
+
+	if _, err := c.lockedWrite([]byte{byte(MessageClassControl), byte(status)}); err != nil {
+		_ = c.Close()
+	}
+}
+
 func (t StickTableUpdateMessageType) OnMessage(m *rawMessage, c *protocolClient) error {
 	switch t {
 	case StickTableUpdateMessageTypeStickTableDefinition:
-		var std sticktable.Definition
-		if _, err := std.Unmarshal(m.Data); err != nil {
+		table, err := c.receiveDefinition(m.Data)
+		if err != nil {
 			return err
 		}
-		c.lastTableDefinition = &std
+		c.lastTable = table
+
+		if dh, ok := c.handler.(DefinitionHandler); ok {
+			dh.HandleDefinition(c.ctx, table.def)
+		}
 
 		return nil
 	case StickTableUpdateMessageTypeStickTableSwitch:
-		log.Printf("not implemented: %s", t)
+		id, _, err := encoding.Varint(m.Data)
+		if err != nil {
+			return fmt.Errorf("decoding table id: %w", err)
+		}
+
+		table, ok := c.tables[id]
+		if !ok {
+			return fmt.Errorf("switch to unknown table id: %d", id)
+		}
+		c.lastTable = table
+
 		return nil
 	case StickTableUpdateMessageTypeUpdateAcknowledge:
 		// HAProxy sends ack messages after receiving our pushed updates.
@@ -266,17 +471,13 @@ func (t StickTableUpdateMessageType) OnMessage(m *rawMessage, c *protocolClient)
 		return fmt.Errorf("unknown stick-table update message type: %s", t)
 	}
 
-	if c.lastTableDefinition == nil {
+	if c.lastTable == nil {
 		return fmt.Errorf("cannot process entry update without table definition")
 	}
 
-	e := sticktable.EntryUpdate{
-		StickTable: c.lastTableDefinition,
-	}
-
-	if c.lastEntryUpdate != nil {
-		e.LocalUpdateID = c.lastEntryUpdate.LocalUpdateID + 1
-	}
+	u := c.lastTable.acquire()
+	e := &u.EntryUpdate
+	e.LocalUpdateID = c.lastTable.nextUpdateID
 
 	switch t {
 	case StickTableUpdateMessageTypeEntryUpdate:
@@ -290,12 +491,171 @@ func (t StickTableUpdateMessageType) OnMessage(m *rawMessage, c *protocolClient)
 	}
 
 	if _, err := e.Unmarshal(m.Data); err != nil {
+		u.release()
 		return err
 	}
 
-	c.lastEntryUpdate = &e
+	for _, d := range e.Data {
+		if d, ok := d.(*sticktable.DictData); ok {
+			if err := c.dictCache.resolve(d); err != nil {
+				u.release()
+				return err
+			}
+		}
+	}
+
+	c.lastTable.nextUpdateID = e.LocalUpdateID + 1
 
-	c.handler.HandleUpdate(c.ctx, &e)
+	return c.dispatchUpdate(u)
+}
+
+// rxTable is a table definition received on a session. It pools the
+// updates of the table, so their key and data are reused.
+type rxTable struct {
+	def     *sticktable.Definition
+	updates sync.Pool
+	// nextUpdateID is the update ID of incremental updates, which omit
+	// it when it follows the previous update of the table.
+	nextUpdateID uint32
+}
+
+// pooledUpdate is an update received on a session that returns into the
+// pool of its table once it was handled.
+type pooledUpdate struct {
+	sticktable.EntryUpdate
+	table *rxTable
+}
+
+func (t *rxTable) acquire() *pooledUpdate {
+	u, _ := t.updates.Get().(*pooledUpdate)
+	if u == nil {
+		u = &pooledUpdate{table: t}
+	}
+	u.StickTable = t.def
+
+	return u
+}
+
+func (u *pooledUpdate) release() {
+	u.WithLocalUpdateID = false
+	u.LocalUpdateID = 0
+	u.WithExpiry = false
+	u.Expiry = 0
+
+	u.table.updates.Put(u)
+}
+
+// handled releases the update after it was passed to the handler, unless
+// the handler may retain it.
+func (c *protocolClient) handled(u *pooledUpdate) {
+	if c.peer.ReuseUpdates {
+		u.release()
+	}
+}
+
+// receiveDefinition decodes a table definition. A definition equal to the
+// one previously received for the same table ID is returned as is, so
+// handlers can rely on the pointer to identify a table.
+func (c *protocolClient) receiveDefinition(b []byte) (*rxTable, error) {
+	if c.tables == nil {
+		c.tables = make(map[uint64]*rxTable)
+	}
+
+	// Decoding into the known definition of the table keeps its name
+	// from being allocated again.
+	d := &c.rxDefinition
+	if id, _, err := encoding.Varint(b); err == nil {
+		if known, ok := c.tables[id]; ok {
+			d.Name = known.def.Name
+		}
+	}
+
+	if _, err := d.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	known, ok := c.tables[d.StickTableID]
+	if ok && definitionsEqual(known.def, d) {
+		return known, nil
+	}
+
+	std := *d
+	std.DataTypes = slices.Clone(d.DataTypes)
+	table := &rxTable{def: &std}
+	if ok {
+		// Like HAProxy, a redefined table continues its update IDs.
+		table.nextUpdateID = known.nextUpdateID
+	}
+	c.tables[std.StickTableID] = table
+
+	return table, nil
+}
+
+// definitionsEqual reports whether the definitions are equal apart from
+// their table ID.
+func definitionsEqual(a, b *sticktable.Definition) bool {
+	return a.Name == b.Name &&
+		a.KeyType == b.KeyType &&
+		a.KeyLength == b.KeyLength &&
+		a.Expiry == b.Expiry &&
+		slices.Equal(a.DataTypes, b.DataTypes)
+}
+
+// dispatchUpdate passes the update to the handler, either directly or
+// through the update queue of the session. The update is released once the
+// handler returned if the peer reuses updates.
+func (c *protocolClient) dispatchUpdate(u *pooledUpdate) error {
+	if c.queue == nil {
+		c.handler.HandleUpdate(c.ctx, &u.EntryUpdate)
+		c.handled(u)
+		return nil
+	}
+
+	if c.queue.offer(u) {
+		return nil
+	}
+
+	// Reading stalls until the handler made room in the queue, which must
+	// not be mistaken for a dead remote peer.
+	c.lastMessageTimer.Stop()
+	defer c.resetLastMessage()
+
+	if err := c.queue.push(c.ctx, u); err != nil {
+		u.release()
+		return err
+	}
 
 	return nil
 }
+
+// dispatch passes queued updates to the handler until the session ends.
+func (c *protocolClient) dispatch() {
+	defer close(c.dispatched)
+
+	// Updates still queued once the session ended are left to drain.
+	for c.ctx.Err() == nil {
+		u, err := c.queue.pop(c.ctx)
+		if err != nil {
+			return
+		}
+
+		c.handler.HandleUpdate(c.ctx, &u.EntryUpdate)
+		c.handled(u)
+	}
+}
+
+// drain empties the update queue of a closed session. The remaining
+// updates are still passed to the handler with OverflowBlock, as no updates
+// are lost then, and dropped with any other policy.
+func (c *protocolClient) drain() {
+	for _, u := range c.queue.close() {
+		if c.queue.policy != OverflowBlock {
+			c.queue.stats.dropped.Add(1)
+			u.release()
+			continue
+		}
+
+		c.handler.HandleUpdate(c.ctx, &u.EntryUpdate)
+		c.handled(u)
+	}
+}
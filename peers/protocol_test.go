@@ -0,0 +1,290 @@
+package peers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+	"github.com/dropmorepackets/haproxy-go/pkg/testutil"
+)
+
+func TestReceiveWithoutAllocations(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	defs := []*sticktable.Definition{
+		{
+			StickTableID: 1,
+			Name:         "st_a",
+			KeyType:      sticktable.KeyTypeString,
+			KeyLength:    32,
+			DataTypes: []sticktable.DataTypeDefinition{
+				{DataType: sticktable.DataTypeGPC0},
+				{DataType: sticktable.DataTypeHttpRequestsRate, Counter: 1, Period: 10000},
+				{DataType: sticktable.DataTypeServerKey},
+			},
+		},
+		{
+			StickTableID: 2,
+			Name:         "st_b",
+			KeyType:      sticktable.KeyTypeBinary,
+			KeyLength:    4,
+			DataTypes: []sticktable.DataTypeDefinition{
+				{DataType: sticktable.DataTypeGPCArray, Elements: 2},
+			},
+		},
+	}
+
+	key := sticktable.StringKey("key")
+	gpc0 := sticktable.UnsignedIntegerData(1)
+	rate := sticktable.NewFreqData(2)
+	dict := sticktable.DictData{Value: []byte("server")}
+	binKey := sticktable.BinaryKey{1, 2, 3, 4}
+	gpc := sticktable.UnsignedIntegerArrayData{3, 4}
+
+	for i := 0; i < 2; i++ {
+		if err := w.SendTableDefinition(defs[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.SendEntry(&sticktable.EntryUpdate{
+			StickTable: defs[0],
+			Key:        &key,
+			Data:       []sticktable.MapData{&gpc0, &rate, &dict},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.SendTableDefinition(defs[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.SendEntry(&sticktable.EntryUpdate{
+			StickTable: defs[1],
+			Key:        &binKey,
+			Data:       []sticktable.MapData{&gpc},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var updates int
+	c := newProtocolClient(context.Background(), &Peer{ReuseUpdates: true}, &stream, HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+		updates++
+	}), &sync.Mutex{}, nil)
+	defer c.Close()
+
+	data := stream.Bytes()
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+	m := acquireMessage()
+	defer releaseMessage(m)
+
+	receive := func() {
+		r.Reset(data)
+		br.Reset(r)
+		for br.Buffered() > 0 || r.Len() > 0 {
+			if _, err := m.ReadFrom(br); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := c.messageHandler(m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+
+	// The first pass allocates the definitions and the dictionary cache.
+	receive()
+	if updates != 4 {
+		t.Fatalf("expected 4 updates, got %d", updates)
+	}
+
+	testutil.WithoutAllocations(t, receive)
+}
+
+func TestReceiveRetainsUpdates(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	def := &sticktable.Definition{
+		StickTableID: 1,
+		Name:         "st_a",
+		KeyType:      sticktable.KeyTypeString,
+		KeyLength:    32,
+		DataTypes: []sticktable.DataTypeDefinition{
+			{DataType: sticktable.DataTypeServerKey},
+		},
+	}
+	if err := w.SendTableDefinition(def); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key_a", "key_b"} {
+		k := sticktable.StringKey(key)
+		d := sticktable.DictData{Value: []byte("server_" + key)}
+		if err := w.SendEntry(&sticktable.EntryUpdate{
+			StickTable: def,
+			Key:        &k,
+			Data:       []sticktable.MapData{&d},
+			WithExpiry: true,
+			Expiry:     1000,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := stream.Bytes()
+
+	tests := []struct {
+		name  string
+		peer  *Peer
+		clone bool
+		// reused is set if the retained updates were reset once the
+		// handler returned.
+		reused bool
+	}{
+		{"default", &Peer{}, false, false},
+		{"reuse", &Peer{ReuseUpdates: true}, false, true},
+		{"reuse with clone", &Peer{ReuseUpdates: true}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates []*sticktable.EntryUpdate
+			c := newProtocolClient(context.Background(), tt.peer, bytes.NewBuffer(data), HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+				if tt.clone {
+					u = u.Clone()
+				}
+				updates = append(updates, u)
+			}), &sync.Mutex{}, nil)
+			defer c.Close()
+
+			m := acquireMessage()
+			defer releaseMessage(m)
+			for {
+				if _, err := m.ReadFrom(c.br); err != nil {
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					t.Fatal(err)
+				}
+				if err := c.messageHandler(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(updates) != 2 {
+				t.Fatalf("expected 2 updates, got %d", len(updates))
+			}
+			for i, key := range []string{"key_a", "key_b"} {
+				// Whether a released update was already handed out
+				// again depends on the pool, its reset does not.
+				if reused := updates[i].Expiry == 0; reused != tt.reused {
+					t.Errorf("update %d: expected reused %t", i, tt.reused)
+				}
+				if tt.reused {
+					continue
+				}
+
+				if got := updates[i].Key.String(); got != key {
+					t.Errorf("update %d: expected key %q, got %q", i, key, got)
+				}
+				if got := string(updates[i].Data[0].(*sticktable.DictData).Value); got != "server_"+key {
+					t.Errorf("update %d: expected value %q, got %q", i, "server_"+key, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncRequest(t *testing.T) {
+	def := &sticktable.Definition{
+		Name:      "st_a",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 32,
+	}
+
+	tests := []struct {
+		name    string
+		handler Handler
+		entries int
+		want    ControlMessageType
+	}{
+		{"without sync handler", &testHandler{}, 0, ControlMessageSyncPartial},
+		{"failing sync handler", &syncHandler{err: errors.New("failed")}, 0, ControlMessageSyncPartial},
+		{"sync handler", &syncHandler{def: def}, 1, ControlMessageSyncFinished},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			peer := &Peer{BaseContext: ctx, Handler: tt.handler}
+			go peer.Serve(l)
+
+			conn := helperDialPeer(t, l.Addr().String(), "peer_a", "peer_b")
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Write([]byte{byte(MessageClassControl), byte(ControlMessageSyncRequest)}); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries int
+			br := bufio.NewReader(conn)
+			for {
+				var m rawMessage
+				if _, err := m.ReadFrom(br); err != nil {
+					t.Fatal(err)
+				}
+
+				if m.MessageClass == MessageClassStickTableUpdates &&
+					StickTableUpdateMessageType(m.MessageType) == StickTableUpdateMessageTypeEntryUpdate {
+					entries++
+				}
+
+				if m.MessageClass != MessageClassControl || ControlMessageType(m.MessageType) == ControlMessageHeartbeat {
+					continue
+				}
+
+				if got := ControlMessageType(m.MessageType); got != tt.want {
+					t.Errorf("expected %s, got %s", tt.want, got)
+				}
+				break
+			}
+
+			if entries != tt.entries {
+				t.Errorf("expected %d entries before the reply, got %d", tt.entries, entries)
+			}
+		})
+	}
+}
+
+// syncHandler teaches a single entry of def or fails with err.
+type syncHandler struct {
+	testHandler
+	def *sticktable.Definition
+	err error
+}
+
+func (h *syncHandler) HandleSyncRequest(_ context.Context, w *Writer) error {
+	if h.err != nil {
+		return h.err
+	}
+
+	key := sticktable.StringKey("key")
+	return w.SendEntry(&sticktable.EntryUpdate{StickTable: h.def, Key: &key})
+}
@@ -0,0 +1,395 @@
+// Package relay replicates stick tables between HAProxy clusters. Every
+// cluster has its own peers section with the relay as one of its peers,
+// the relay forwards the updates received from one cluster to all other
+// clusters.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/clock"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/outbox"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/registry"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// sweepInterval is the amount of updates of a table after which its
+// expired entries are removed.
+const sweepInterval = 4096
+
+// ConflictRule decides how the value of an update is merged with the
+// value known from other clusters.
+type ConflictRule int
+
+const (
+	// RuleLatest takes the value of the latest update.
+	RuleLatest ConflictRule = iota
+	// RuleMax keeps the greater value. Arrays are merged per element.
+	// Values that can not be compared are handled like RuleLatest.
+	//
+	// A counter reset to a lower value never replicates under RuleMax, for
+	// example clearing gpc0 to unblock a client. Use RuleLatest for
+	// counters that are reset.
+	RuleMax
+)
+
+// DefaultRule returns RuleMax for counters and RuleLatest for all other
+// data types, like gpt and rates.
+func DefaultRule(t sticktable.DataType) ConflictRule {
+	if t.IsCounter() {
+		return RuleMax
+	}
+	return RuleLatest
+}
+
+// Relay is the state shared by the sessions of all clusters. Use Handler
+// as HandlerSource of a peers.Peer.
+//
+// Updates are only forwarded if they change the merged value of an entry
+// and never to the cluster they originate from. Updates echoed by a
+// cluster do not change the merged value, so they do not loop between
+// clusters.
+//
+// The tables shared between clusters need the same key and data types.
+type Relay struct {
+	// Cluster returns the cluster of a remote peer. Defaults to the name
+	// of the remote peer, which makes every peer its own cluster.
+	Cluster func(*peers.Handshake) string
+	// Tables maps the table names of a cluster to the names shared across
+	// all clusters, by cluster. Tables without mapping are shared under
+	// their own name.
+	Tables map[string]map[string]string
+	// Rules overrides DefaultRule per data type.
+	Rules map[sticktable.DataType]ConflictRule
+	// QueueSize is the amount of updates queued for forwarding per
+	// session, 4096 if zero. Updates are sent by a goroutine of every
+	// session, so a slow cluster does not stall receiving from the others.
+	// A queued update is replaced by a newer one of the same entry, if the
+	// queue is full the oldest update is dropped.
+	QueueSize int
+
+	mu       sync.Mutex
+	sessions registry.Sessions[*session]
+	tables   map[string]*table
+
+	now clock.Func
+}
+
+type table struct {
+	def     sticktable.Definition
+	entries map[string]*entry
+	updates int
+}
+
+type entry struct {
+	key  sticktable.MapKey
+	data []sticktable.MapData
+	// origin is the cluster of the latest update that changed the entry.
+	origin  string
+	expires time.Time
+}
+
+// Handler returns the handler for a new session.
+func (r *Relay) Handler() peers.Handler {
+	return &session{relay: r}
+}
+
+func (r *Relay) rule(t sticktable.DataType) ConflictRule {
+	if rule, ok := r.Rules[t]; ok {
+		return rule
+	}
+	return DefaultRule(t)
+}
+
+// sharedName returns the name shared across clusters of a table.
+func (r *Relay) sharedName(cluster, name string) string {
+	if shared, ok := r.Tables[cluster][name]; ok {
+		return shared
+	}
+	return name
+}
+
+// localName returns the name of a shared table in a cluster.
+func (r *Relay) localName(cluster, shared string) string {
+	for name, s := range r.Tables[cluster] {
+		if s == shared {
+			return name
+		}
+	}
+	return shared
+}
+
+// merge merges the update of a cluster into the shared table. It returns
+// a copy of the merged entry or nil if the entry did not change.
+func (r *Relay) merge(cluster string, u *sticktable.EntryUpdate) (*sticktable.EntryUpdate, error) {
+	now := r.now.Now()
+	shared := r.sharedName(cluster, u.StickTable.Name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tables == nil {
+		r.tables = make(map[string]*table)
+	}
+
+	t, ok := r.tables[shared]
+	if !ok || !t.def.Compatible(u.StickTable) {
+		t = &table{def: *u.StickTable.Clone(), entries: make(map[string]*entry)}
+		t.def.Name = shared
+		r.tables[shared] = t
+	}
+	t.def.Expiry = u.StickTable.Expiry
+
+	t.updates++
+	if t.updates%sweepInterval == 0 {
+		t.sweep(now)
+	}
+
+	key, err := u.StickTable.EncodeKey(u.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := u.Clone()
+	e, ok := t.entries[key]
+	if !ok || e.expired(now) {
+		e = &entry{key: c.Key, data: c.Data, origin: cluster}
+		t.entries[key] = e
+	} else if !r.mergeData(&t.def, e.data, c.Data) {
+		return nil, nil
+	} else {
+		e.origin = cluster
+	}
+
+	e.expires = time.Time{}
+	switch {
+	case u.WithExpiry:
+		e.expires = now.Add(time.Duration(u.Expiry) * time.Millisecond)
+	case t.def.Expiry > 0:
+		e.expires = now.Add(time.Duration(t.def.Expiry) * time.Millisecond)
+	}
+
+	// The definition is copied, as it is used by the sessions without
+	// holding the mutex.
+	def := t.def
+	return e.update(&def), nil
+}
+
+// mergeData merges the values of an update into the known values and
+// reports whether they changed.
+func (r *Relay) mergeData(def *sticktable.Definition, known, update []sticktable.MapData) bool {
+	var changed bool
+	for i, dt := range def.DataTypes {
+		v := update[i]
+		if r.rule(dt.DataType) == RuleMax {
+			v = maxData(known[i], v)
+		}
+
+		if !equalData(known[i], v) {
+			known[i] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// equalData reports whether two values are equal. Dictionary entries are
+// compared by value, their IDs are specific to a session. Frequency
+// counters are compared by their periods, as the current tick is relative
+// to the moment an update was sent and differs for every echo.
+func equalData(a, b sticktable.MapData) bool {
+	switch a := a.(type) {
+	case *sticktable.DictData:
+		b, ok := b.(*sticktable.DictData)
+		return ok && bytes.Equal(a.Value, b.Value)
+	case *sticktable.FreqData:
+		b, ok := b.(*sticktable.FreqData)
+		return ok && equalFreq(*a, *b)
+	case *sticktable.FreqArrayData:
+		b, ok := b.(*sticktable.FreqArrayData)
+		return ok && slices.EqualFunc(*a, *b, equalFreq)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func equalFreq(a, b sticktable.FreqData) bool {
+	return a.CurrentPeriod == b.CurrentPeriod && a.LastPeriod == b.LastPeriod
+}
+
+// maxData returns the greater of two values of the same type.
+func maxData(a, b sticktable.MapData) sticktable.MapData {
+	switch a := a.(type) {
+	case *sticktable.UnsignedIntegerData:
+		if b, ok := b.(*sticktable.UnsignedIntegerData); ok && *a > *b {
+			return a
+		}
+	case *sticktable.UnsignedLongLongData:
+		if b, ok := b.(*sticktable.UnsignedLongLongData); ok && *a > *b {
+			return a
+		}
+	case *sticktable.SignedIntegerData:
+		if b, ok := b.(*sticktable.SignedIntegerData); ok && *a > *b {
+			return a
+		}
+	case *sticktable.UnsignedIntegerArrayData:
+		b, ok := b.(*sticktable.UnsignedIntegerArrayData)
+		if !ok || len(*a) != len(*b) {
+			break
+		}
+		v := slices.Clone(*b)
+		for i := range v {
+			v[i] = max(v[i], (*a)[i])
+		}
+		return &v
+	}
+	return b
+}
+
+func (t *table) sweep(now time.Time) {
+	for k, e := range t.entries {
+		if e.expired(now) {
+			delete(t.entries, k)
+		}
+	}
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// update returns a copy of the entry as update of the shared table. The
+// expiry is left to the tables of the receiving cluster.
+func (e *entry) update(def *sticktable.Definition) *sticktable.EntryUpdate {
+	return (&sticktable.EntryUpdate{StickTable: def, Key: e.key, Data: e.data}).Clone()
+}
+
+// forward queues the update of a shared table for all sessions of other
+// clusters than origin.
+func (r *Relay) forward(origin string, u *sticktable.EntryUpdate) {
+	for _, s := range r.sessions.All() {
+		if s.cluster == origin {
+			continue
+		}
+		if !s.outbox.Push(u) {
+			log.Printf("relay to %s: queue full, dropped oldest update", s.cluster)
+		}
+	}
+}
+
+// session is the handler of a single remote peer.
+type session struct {
+	relay   *Relay
+	cluster string
+	writer  *peers.Writer
+	outbox  *outbox.Outbox
+
+	// defs caches the definitions of the shared tables renamed for the
+	// cluster of the session.
+	mu   sync.Mutex
+	defs map[string]*sticktable.Definition
+}
+
+var (
+	_ peers.Handler     = (*session)(nil)
+	_ peers.SyncHandler = (*session)(nil)
+)
+
+func (s *session) HandleHandshake(ctx context.Context, h *peers.Handshake) {
+	s.cluster = h.LocalPeerIdentifier
+	if s.relay.Cluster != nil {
+		s.cluster = s.relay.Cluster(h)
+	}
+	s.writer = peers.WriterFromContext(ctx)
+	s.outbox = outbox.New(s.relay.QueueSize)
+
+	go func() {
+		if err := s.outbox.Run(ctx, s.send); err != nil && ctx.Err() == nil {
+			log.Printf("relay to %s: %v", s.cluster, err)
+		}
+	}()
+
+	s.relay.sessions.Add(s)
+}
+
+func (s *session) HandleUpdate(_ context.Context, u *sticktable.EntryUpdate) {
+	merged, err := s.relay.merge(s.cluster, u)
+	if err != nil {
+		log.Printf("relay from %s: %v", s.cluster, err)
+		return
+	}
+	if merged == nil {
+		return
+	}
+
+	s.relay.forward(s.cluster, merged)
+}
+
+// HandleSyncRequest teaches the entries of all shared tables that were
+// last changed by another cluster.
+func (s *session) HandleSyncRequest(_ context.Context, w *peers.Writer) error {
+	now := s.relay.now.Now()
+
+	var updates []*sticktable.EntryUpdate
+	s.relay.mu.Lock()
+	for _, t := range s.relay.tables {
+		def := t.def
+		for _, e := range t.entries {
+			if e.origin != s.cluster && !e.expired(now) {
+				updates = append(updates, e.update(&def))
+			}
+		}
+	}
+	s.relay.mu.Unlock()
+
+	return s.send(updates)
+}
+
+// send sends updates of shared tables under their name in the cluster of
+// the session.
+func (s *session) send(updates []*sticktable.EntryUpdate) error {
+	local := make([]*sticktable.EntryUpdate, len(updates))
+
+	s.mu.Lock()
+	for i, u := range updates {
+		c := *u
+		c.StickTable = s.definition(u.StickTable)
+		local[i] = &c
+	}
+	s.mu.Unlock()
+
+	return s.writer.SendEntries(local)
+}
+
+// definition returns the definition of the shared table for the cluster
+// of the session. Caller MUST hold the mutex.
+func (s *session) definition(shared *sticktable.Definition) *sticktable.Definition {
+	if s.defs == nil {
+		s.defs = make(map[string]*sticktable.Definition)
+	}
+
+	def, ok := s.defs[shared.Name]
+	if !ok || !def.Compatible(shared) || def.Expiry != shared.Expiry {
+		def = &sticktable.Definition{
+			Name:      s.relay.localName(s.cluster, shared.Name),
+			DataTypes: slices.Clone(shared.DataTypes),
+			KeyType:   shared.KeyType,
+			KeyLength: shared.KeyLength,
+			Expiry:    shared.Expiry,
+		}
+		s.defs[shared.Name] = def
+	}
+
+	return def
+}
+
+func (s *session) Close() error {
+	s.relay.sessions.Remove(s)
+	return nil
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/dropmorepackets/haproxy-go/peers"
+	"github.com/dropmorepackets/haproxy-go/peers/internal/peertest"
+	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
+)
+
+// values returns gpt0 and gpc0 of the update.
+func values(u *sticktable.EntryUpdate) [2]uint32 {
+	return [2]uint32{
+		uint32(*u.Data[0].(*sticktable.UnsignedIntegerData)),
+		uint32(*u.Data[1].(*sticktable.UnsignedIntegerData)),
+	}
+}
+
+func TestRelayMerge(t *testing.T) {
+	def := peertest.Definition(t, "table st_src type string store gpt0,gpc0,server_key")
+	dc1Def := peertest.Definition(t, "table st_src_dc1 type string store gpt0,gpc0,server_key")
+
+	r := &Relay{
+		Tables: map[string]map[string]string{
+			"dc1": {"st_src_dc1": "st_src"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cluster string
+		update  *sticktable.EntryUpdate
+		// want are the merged gpt0 and gpc0, nil if the entry must not
+		// change.
+		want *[2]uint32
+	}{
+		{"new entry", "dc1", peertest.Update(t, dc1Def, "a", peertest.Entry{GPT0: 1, GPC0: 5, Server: "srv", ServerID: 1}), &[2]uint32{1, 5}},
+		{"lower counter", "dc2", peertest.Update(t, def, "a", peertest.Entry{GPT0: 2, GPC0: 3, Server: "srv", ServerID: 7}), &[2]uint32{2, 5}},
+		{"echo", "dc1", peertest.Update(t, dc1Def, "a", peertest.Entry{GPT0: 2, GPC0: 5, Server: "srv", ServerID: 4}), nil},
+		{"higher counter", "dc2", peertest.Update(t, def, "a", peertest.Entry{GPT0: 2, GPC0: 6, Server: "srv", ServerID: 7}), &[2]uint32{2, 6}},
+		{"other key", "dc2", peertest.Update(t, def, "b", peertest.Entry{GPC0: 1, Server: "srv", ServerID: 7}), &[2]uint32{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.merge(tt.cluster, tt.update)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("expected no change, got %v", values(got))
+				}
+				return
+			}
+
+			if got == nil {
+				t.Fatal("expected change")
+			}
+			if got.StickTable.Name != "st_src" {
+				t.Errorf("expected shared table st_src, got %s", got.StickTable.Name)
+			}
+			if diff := cmp.Diff(*tt.want, values(got)); diff != "" {
+				t.Errorf("merged values mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("rule override", func(t *testing.T) {
+		r := &Relay{Rules: map[sticktable.DataType]ConflictRule{
+			sticktable.DataTypeGPC0: RuleLatest,
+		}}
+		if _, err := r.merge("dc1", peertest.Update(t, def, "a", peertest.Entry{GPC0: 5, Server: "srv", ServerID: 1})); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.merge("dc2", peertest.Update(t, def, "a", peertest.Entry{GPC0: 3, Server: "srv", ServerID: 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || values(got)[1] != 3 {
+			t.Errorf("expected latest gpc0 3, got %v", got)
+		}
+	})
+}
+
+func TestRelaySessions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := &Relay{
+		Cluster: func(h *peers.Handshake) string {
+			cluster, _, _ := strings.Cut(h.LocalPeerIdentifier, "_")
+			return cluster
+		},
+		Tables: map[string]map[string]string{
+			"dc1": {"st_src_dc1": "st_src"},
+		},
+	}
+
+	peer := &peers.Peer{BaseContext: ctx, HandlerSource: r.Handler}
+	go peer.Serve(l)
+
+	dc1 := peertest.Dial(t, l.Addr().String(), "dc1_a", "relay")
+	dc2a := peertest.Dial(t, l.Addr().String(), "dc2_a", "relay")
+	dc2b := peertest.Dial(t, l.Addr().String(), "dc2_b", "relay")
+
+	def := peertest.Definition(t, "table st_src type string store gpt0,gpc0,server_key")
+	dc1Def := peertest.Definition(t, "table st_src_dc1 type string store gpt0,gpc0,server_key")
+
+	dc1.SendUpdate(t, peertest.Update(t, dc1Def, "a", peertest.Entry{GPT0: 1, GPC0: 5, Server: "srv", ServerID: 1}))
+	for _, c := range []*peertest.Conn{dc2a, dc2b} {
+		u := c.ReceiveUpdate(t)
+		if u.StickTable.Name != "st_src" || values(u) != [2]uint32{1, 5} {
+			t.Errorf("%s: expected st_src [1 5], got %s %v", c.Name, u.StickTable.Name, values(u))
+		}
+	}
+
+	dc2a.SendUpdate(t, peertest.Update(t, def, "a", peertest.Entry{GPT0: 2, GPC0: 3, Server: "srv", ServerID: 1}))
+	u := dc1.ReceiveUpdate(t)
+	if u.StickTable.Name != "st_src_dc1" || values(u) != [2]uint32{2, 5} {
+		t.Errorf("expected st_src_dc1 [2 5], got %s %v", u.StickTable.Name, values(u))
+	}
+
+	// Echoes of the merged value are not forwarded, neither are updates
+	// forwarded to the cluster they originate from.
+	dc1.SendUpdate(t, peertest.Update(t, dc1Def, "a", peertest.Entry{GPT0: 2, GPC0: 5, Server: "srv", ServerID: 1}))
+	dc2b.ExpectNothing(t, 50*time.Millisecond)
+	dc2a.ExpectNothing(t, 50*time.Millisecond)
+}
+
+func TestRelayRateEcho(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := &Relay{}
+	peer := &peers.Peer{BaseContext: ctx, HandlerSource: r.Handler}
+	go peer.Serve(l)
+
+	dc1 := peertest.Dial(t, l.Addr().String(), "dc1", "relay")
+	dc2 := peertest.Dial(t, l.Addr().String(), "dc2", "relay")
+
+	def := peertest.Definition(t, "table st_src type string store http_req_rate(10s)")
+	dc1.SendUpdate(t, peertest.Update(t, def, "a", peertest.Entry{
+		Rate: sticktable.FreqData{CurrentTick: 100, CurrentPeriod: 5, LastPeriod: 3},
+	}))
+	dc2.ReceiveUpdate(t)
+
+	// HAProxy echoes the rate with the tick relative to the moment it
+	// sends the update.
+	dc2.SendUpdate(t, peertest.Update(t, def, "a", peertest.Entry{
+		Rate: sticktable.FreqData{CurrentTick: 2100, CurrentPeriod: 5, LastPeriod: 3},
+	}))
+	dc1.ExpectNothing(t, 50*time.Millisecond)
+}
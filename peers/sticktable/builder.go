@@ -0,0 +1,127 @@
+package sticktable
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// EntryBuilder builds the data of an entry update in the order of the
+// data types of a table definition.
+type EntryBuilder struct {
+	def    *Definition
+	values map[DataType]MapData
+}
+
+// NewEntryBuilder returns an EntryBuilder for the given table definition.
+func NewEntryBuilder(def *Definition) *EntryBuilder {
+	return &EntryBuilder{
+		def:    def,
+		values: make(map[DataType]MapData, len(def.DataTypes)),
+	}
+}
+
+// Set sets the value of a data type. The value must have the type used
+// by the table definition for the data type, arrays must have the
+// configured amount of elements.
+func (b *EntryBuilder) Set(t DataType, v MapData) error {
+	var def *DataTypeDefinition
+	for i := range b.def.DataTypes {
+		if b.def.DataTypes[i].DataType == t {
+			def = &b.def.DataTypes[i]
+			break
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("table %s does not store %s", b.def.Name, t)
+	}
+
+	want := def.New()
+	if reflect.TypeOf(v) != reflect.TypeOf(want) {
+		return fmt.Errorf("invalid value for %s: got %T, want %T", t, v, want)
+	}
+
+	switch v := v.(type) {
+	case *UnsignedIntegerArrayData:
+		if uint64(len(*v)) != def.Elements {
+			return fmt.Errorf("invalid amount of elements for %s: got %d, want %d", t, len(*v), def.Elements)
+		}
+	case *FreqArrayData:
+		if uint64(len(*v)) != def.Elements {
+			return fmt.Errorf("invalid amount of elements for %s: got %d, want %d", t, len(*v), def.Elements)
+		}
+	}
+
+	b.values[t] = v
+	return nil
+}
+
+// SetByName sets the value of a data type by its name as used in the
+// store of a HAProxy stick table, like gpc0 or http_req_rate. The value
+// must have the type used by the table definition, see Set.
+func (b *EntryBuilder) SetByName(name string, v MapData) error {
+	t, err := ParseDataType(name)
+	if err != nil {
+		return err
+	}
+	return b.Set(t, v)
+}
+
+// SetUint sets the value of an unsigned integer data type like gpc0.
+func (b *EntryBuilder) SetUint(t DataType, v uint32) error {
+	d := UnsignedIntegerData(v)
+	return b.Set(t, &d)
+}
+
+// SetUint64 sets the value of an unsigned 64-bit integer data type like
+// bytes_in_cnt.
+func (b *EntryBuilder) SetUint64(t DataType, v uint64) error {
+	d := UnsignedLongLongData(v)
+	return b.Set(t, &d)
+}
+
+// SetFreq sets the frequency counter of a rate data type like http_req_rate.
+func (b *EntryBuilder) SetFreq(t DataType, v FreqData) error {
+	return b.Set(t, &v)
+}
+
+// SetDict sets the value of a dictionary data type like server_key.
+func (b *EntryBuilder) SetDict(t DataType, v []byte) error {
+	return b.Set(t, &DictData{Value: v})
+}
+
+// Build returns an entry update for key with the data ordered like the
+// table definition. It fails if a data type stored by the table was not set
+// or if the data types of the definition are not ordered like on the wire,
+// as the data would be sent in the wrong order.
+func (b *EntryBuilder) Build(key MapKey) (*EntryUpdate, error) {
+	if !slices.IsSortedFunc(b.def.DataTypes, func(a, b DataTypeDefinition) int {
+		return cmp.Compare(a.DataType, b.DataType)
+	}) {
+		return nil, fmt.Errorf("data types of table %s are not ordered by their type", b.def.Name)
+	}
+
+	data := make([]MapData, 0, len(b.def.DataTypes))
+
+	var missing []string
+	for _, dt := range b.def.DataTypes {
+		v, ok := b.values[dt.DataType]
+		if !ok {
+			missing = append(missing, dt.DataType.String())
+			continue
+		}
+		data = append(data, v)
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing data types for table %s: %s", b.def.Name, strings.Join(missing, ", "))
+	}
+
+	return &EntryUpdate{
+		StickTable: b.def,
+		Key:        key,
+		Data:       data,
+	}, nil
+}
@@ -0,0 +1,131 @@
+package sticktable
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEntryBuilder(t *testing.T) {
+	def := &Definition{
+		Name:      "builder",
+		KeyType:   KeyTypeString,
+		KeyLength: 32,
+		DataTypes: []DataTypeDefinition{
+			{DataType: DataTypeGPC0},
+			{DataType: DataTypeHttpRequestsRate, Period: 10000},
+			{DataType: DataTypeBytesInCounter},
+			{DataType: DataTypeGPCArray, Elements: 2},
+		},
+	}
+
+	t.Run("ordered data", func(t *testing.T) {
+		b := NewEntryBuilder(def)
+		if err := b.Set(DataTypeGPCArray, &UnsignedIntegerArrayData{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetUint64(DataTypeBytesInCounter, 1<<40); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetFreq(DataTypeHttpRequestsRate, NewFreqData(5)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetUint(DataTypeGPC0, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		key := StringKey("foo")
+		e, err := b.Build(&key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gpc0 := UnsignedIntegerData(1)
+		bytesIn := UnsignedLongLongData(1 << 40)
+		want := []MapData{&gpc0, &FreqData{CurrentPeriod: 5}, &bytesIn, &UnsignedIntegerArrayData{1, 2}}
+		if diff := cmp.Diff(want, e.Data); diff != "" {
+			t.Errorf("Build() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing data type", func(t *testing.T) {
+		b := NewEntryBuilder(def)
+		if err := b.SetUint(DataTypeGPC0, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		key := StringKey("foo")
+		if _, err := b.Build(&key); err == nil {
+			t.Error("expected error for missing data types")
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		b := NewEntryBuilder(def)
+		if err := b.SetUint(DataTypeGPC1, 1); err == nil {
+			t.Error("expected error for data type not stored by the table")
+		}
+		if err := b.SetUint64(DataTypeGPC0, 1); err == nil {
+			t.Error("expected error for value of wrong type")
+		}
+		if err := b.Set(DataTypeGPCArray, &UnsignedIntegerArrayData{1}); err == nil {
+			t.Error("expected error for array of wrong size")
+		}
+		if err := b.SetByName("gpc_0", new(UnsignedIntegerData)); err == nil {
+			t.Error("expected error for unknown data type name")
+		}
+	})
+
+	t.Run("by name", func(t *testing.T) {
+		b := NewEntryBuilder(def)
+		gpc0 := UnsignedIntegerData(1)
+		bytesIn := UnsignedLongLongData(2)
+		values := map[string]MapData{
+			"gpc0":          &gpc0,
+			"http_req_rate": &FreqData{CurrentPeriod: 5},
+			"bytes_in_cnt":  &bytesIn,
+			"gpc":           &UnsignedIntegerArrayData{1, 2},
+		}
+		for name, v := range values {
+			if err := b.SetByName(name, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		key := StringKey("foo")
+		e, err := b.Build(&key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []MapData{values["gpc0"], values["http_req_rate"], values["bytes_in_cnt"], values["gpc"]}
+		if diff := cmp.Diff(want, e.Data); diff != "" {
+			t.Errorf("Build() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unordered definition", func(t *testing.T) {
+		unordered := &Definition{
+			Name:      "unordered",
+			KeyType:   KeyTypeString,
+			KeyLength: 32,
+			DataTypes: []DataTypeDefinition{
+				{DataType: DataTypeHttpRequestsRate, Period: 10000},
+				{DataType: DataTypeGPC0},
+			},
+		}
+
+		b := NewEntryBuilder(unordered)
+		if err := b.SetUint(DataTypeGPC0, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetFreq(DataTypeHttpRequestsRate, NewFreqData(5)); err != nil {
+			t.Fatal(err)
+		}
+
+		key := StringKey("foo")
+		if _, err := b.Build(&key); err == nil {
+			t.Error("expected error for data types not ordered like on the wire")
+		}
+	})
+}
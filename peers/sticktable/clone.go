@@ -0,0 +1,96 @@
+package sticktable
+
+import "slices"
+
+// Clone returns a copy of the definition that does not share the data
+// types with the original. The table ID is reset, as it is only valid on
+// the session the definition was received on.
+func (s *Definition) Clone() *Definition {
+	c := *s
+	c.DataTypes = slices.Clone(s.DataTypes)
+	c.StickTableID = 0
+	return &c
+}
+
+// Clone returns a deep copy of the update that does not share the key and
+// data with the original. The table definition is shared.
+func (e *EntryUpdate) Clone() *EntryUpdate {
+	c := *e
+	c.Key = cloneKey(e.Key)
+
+	if e.Data != nil {
+		c.Data = make([]MapData, len(e.Data))
+		for i, d := range e.Data {
+			c.Data[i] = cloneData(d)
+		}
+	}
+
+	return &c
+}
+
+func cloneKey(k MapKey) MapKey {
+	switch k := k.(type) {
+	case *SignedIntegerKey:
+		v := *k
+		return &v
+	case *IPv4AddressKey:
+		v := *k
+		return &v
+	case *IPv6AddressKey:
+		v := *k
+		return &v
+	case *StringKey:
+		v := *k
+		return &v
+	case *BinaryKey:
+		v := append(BinaryKey(nil), *k...)
+		return &v
+	case *AnyKey:
+		v := append(AnyKey(nil), *k...)
+		return &v
+	case *BooleanKey:
+		v := *k
+		return &v
+	case *AddressKey:
+		v := *k
+		return &v
+	case *MethodKey:
+		v := *k
+		return &v
+	default:
+		// Unknown keys are not reused by Unmarshal.
+		return k
+	}
+}
+
+func cloneData(d MapData) MapData {
+	switch d := d.(type) {
+	case *FreqData:
+		v := *d
+		return &v
+	case *SignedIntegerData:
+		v := *d
+		return &v
+	case *UnsignedIntegerData:
+		v := *d
+		return &v
+	case *UnsignedLongLongData:
+		v := *d
+		return &v
+	case *DictData:
+		v := DictData{ID: d.ID}
+		if d.Value != nil {
+			v.Value = append([]byte(nil), d.Value...)
+		}
+		return &v
+	case *UnsignedIntegerArrayData:
+		v := append(UnsignedIntegerArrayData(nil), *d...)
+		return &v
+	case *FreqArrayData:
+		v := append(FreqArrayData(nil), *d...)
+		return &v
+	default:
+		// Unknown data is not reused by Unmarshal.
+		return d
+	}
+}
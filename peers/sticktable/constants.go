@@ -20,8 +20,17 @@ const (
 	KeyTypeMethod
 )
 
+// New returns an empty key of the key type or nil if the key type is unknown.
 func (t KeyType) New() MapKey {
 	switch t {
+	case KeyTypeAny:
+		return new(AnyKey)
+	case KeyTypeBoolean:
+		return new(BooleanKey)
+	case KeyTypeAddress:
+		return new(AddressKey)
+	case KeyTypeMethod:
+		return new(MethodKey)
 	case KeyTypeSignedInteger:
 		return new(SignedIntegerKey)
 	case KeyTypeIPv4Address:
@@ -33,10 +42,36 @@ func (t KeyType) New() MapKey {
 	case KeyTypeBinary:
 		return new(BinaryKey)
 	default:
-		panic("unknown key type: " + t.String())
+		return nil
 	}
 }
 
+// fits reports whether k is of the type returned by New.
+func (t KeyType) fits(k MapKey) bool {
+	var ok bool
+	switch t {
+	case KeyTypeAny:
+		_, ok = k.(*AnyKey)
+	case KeyTypeBoolean:
+		_, ok = k.(*BooleanKey)
+	case KeyTypeAddress:
+		_, ok = k.(*AddressKey)
+	case KeyTypeMethod:
+		_, ok = k.(*MethodKey)
+	case KeyTypeSignedInteger:
+		_, ok = k.(*SignedIntegerKey)
+	case KeyTypeIPv4Address:
+		_, ok = k.(*IPv4AddressKey)
+	case KeyTypeIPv6Address:
+		_, ok = k.(*IPv6AddressKey)
+	case KeyTypeString:
+		_, ok = k.(*StringKey)
+	case KeyTypeBinary:
+		_, ok = k.(*BinaryKey)
+	}
+	return ok
+}
+
 type DataType int
 
 func (d DataType) String() string {
@@ -110,7 +145,43 @@ func (d DataType) IsDelay() bool {
 		DataTypeBytesInRate,
 		DataTypeBytesOutRate,
 		DataTypeGPC1Rate,
-		DataTypeHttpFailRate:
+		DataTypeHttpFailRate,
+		DataTypeGPCRateArray,
+		DataTypeGlitchRate:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsCounter reports whether the data type is a cumulative counter that
+// only grows until it is cleared.
+func (d DataType) IsCounter() bool {
+	switch d {
+	case DataTypeGPC0,
+		DataTypeConnectionsCounter,
+		DataTypeSessionsCounter,
+		DataTypeHttpRequestsCounter,
+		DataTypeErrorsCounter,
+		DataTypeBytesInCounter,
+		DataTypeBytesOutCounter,
+		DataTypeGPC1,
+		DataTypeHttpFailCounter,
+		DataTypeGPCArray,
+		DataTypeGlitchCounter:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsArray reports whether the data type is an array. The amount of elements
+// is configured per table and sent as part of the table definition.
+func (d DataType) IsArray() bool {
+	switch d {
+	case DataTypeGPTArray,
+		DataTypeGPCArray,
+		DataTypeGPCRateArray:
 		return true
 	default:
 		return false
@@ -176,6 +247,14 @@ const (
 	DataTypeGlitchRate
 )
 
+// valid reports whether the data type is known.
+func (d DataType) valid() bool {
+	return d >= DataTypeServerId && d <= DataTypeGlitchRate
+}
+
+// New returns an empty value for the data type. Arrays are returned
+// without elements, use DataTypeDefinition.New to get an array of the
+// size configured for a table.
 func (d DataType) New() MapData {
 	switch d {
 	case DataTypeServerId:
@@ -223,11 +302,11 @@ func (d DataType) New() MapData {
 	case DataTypeHttpFailRate:
 		return new(FreqData)
 	case DataTypeGPTArray:
-		return new(DictData)
+		return new(UnsignedIntegerArrayData)
 	case DataTypeGPCArray:
-		return new(DictData)
+		return new(UnsignedIntegerArrayData)
 	case DataTypeGPCRateArray:
-		return new(DictData)
+		return new(FreqArrayData)
 	case DataTypeGlitchCounter:
 		return new(UnsignedIntegerData)
 	case DataTypeGlitchRate:
@@ -0,0 +1,388 @@
+package sticktable
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDefinition parses the declaration of a stick table in the syntax
+// of the HAProxy configuration, for example
+//
+//	stick-table type ip size 200k expire 5m store gpc0,http_req_rate(10s)
+//
+// The declaration may also be given with the table keyword of a peers
+// section, which sets the name of the table, or without keyword. The name
+// of a stick-table declaration is the name of its proxy and has to be set
+// by the caller.
+//
+// The size is validated but not part of the definition, as it is local to
+// every HAProxy. Keywords not affecting the definition, like peers or
+// nopurge, are ignored.
+func ParseDefinition(decl string) (*Definition, error) {
+	args := strings.Fields(decl)
+	def := &Definition{}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "stick-table":
+			args = args[1:]
+		case "table":
+			if len(args) < 2 {
+				return nil, fmt.Errorf("missing table name")
+			}
+			def.Name = args[1]
+			args = args[2:]
+		}
+	}
+
+	next := func(keyword string) (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("missing argument for %s", keyword)
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg, nil
+	}
+
+	var haveType bool
+	var keyLength uint64
+	stored := make(map[DataType]DataTypeDefinition)
+	for len(args) > 0 {
+		keyword := args[0]
+		args = args[1:]
+
+		switch keyword {
+		case "type":
+			arg, err := next(keyword)
+			if err != nil {
+				return nil, err
+			}
+			if def.KeyType, def.KeyLength, err = parseKeyType(arg); err != nil {
+				return nil, err
+			}
+			haveType = true
+		case "len":
+			arg, err := next(keyword)
+			if err != nil {
+				return nil, err
+			}
+			if keyLength, err = strconv.ParseUint(arg, 10, 32); err != nil || keyLength == 0 {
+				return nil, fmt.Errorf("invalid key length %q", arg)
+			}
+		case "size":
+			arg, err := next(keyword)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := parseSize(arg); err != nil {
+				return nil, err
+			}
+		case "expire":
+			arg, err := next(keyword)
+			if err != nil {
+				return nil, err
+			}
+			d, err := parseTime(arg)
+			if err != nil {
+				return nil, err
+			}
+			def.Expiry = uint64(d.Milliseconds())
+		case "store":
+			arg, err := next(keyword)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range splitStore(arg) {
+				dt, err := parseStore(s)
+				if err != nil {
+					return nil, err
+				}
+				stored[dt.DataType] = dt
+			}
+		case "nopurge", "recv-only":
+		case "peers", "srvkey", "write-to":
+			if _, err := next(keyword); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", keyword)
+		}
+	}
+
+	if !haveType {
+		return nil, fmt.Errorf("missing type")
+	}
+	if keyLength > 0 {
+		if def.KeyType != KeyTypeString && def.KeyType != KeyTypeBinary {
+			return nil, fmt.Errorf("len is only supported for string and binary keys")
+		}
+		def.KeyLength = keyLength
+	}
+
+	// The data types are ordered by their value like on the wire.
+	for t := DataTypeServerId; t.valid(); t++ {
+		if dt, ok := stored[t]; ok {
+			def.DataTypes = append(def.DataTypes, dt)
+		}
+	}
+
+	return def, nil
+}
+
+// defaultKeyLength is the length of string and binary keys if not set.
+const defaultKeyLength = 32
+
+func parseKeyType(s string) (KeyType, uint64, error) {
+	switch s {
+	case "ip":
+		return KeyTypeIPv4Address, 4, nil
+	case "ipv6":
+		return KeyTypeIPv6Address, 16, nil
+	case "integer":
+		return KeyTypeSignedInteger, 4, nil
+	case "string":
+		return KeyTypeString, defaultKeyLength, nil
+	case "binary":
+		return KeyTypeBinary, defaultKeyLength, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown key type %q", s)
+	}
+}
+
+// splitStore splits a comma separated list of data types, ignoring commas
+// within arguments like gpc_rate(3,10s).
+func splitStore(s string) []string {
+	var parts []string
+	var depth, start int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseStore parses a data type with its arguments, like
+// http_req_rate(10s) or gpc(3).
+func parseStore(s string) (DataTypeDefinition, error) {
+	name, rest, hasArgs := strings.Cut(s, "(")
+	var args []string
+	if hasArgs {
+		if !strings.HasSuffix(rest, ")") {
+			return DataTypeDefinition{}, fmt.Errorf("malformed data type %q", s)
+		}
+		args = strings.Split(strings.TrimSuffix(rest, ")"), ",")
+	}
+
+	t, err := ParseDataType(name)
+	if err != nil {
+		return DataTypeDefinition{}, err
+	}
+	dt := DataTypeDefinition{DataType: t}
+
+	if t.IsArray() {
+		if len(args) == 0 {
+			return dt, fmt.Errorf("missing amount of elements for %s", name)
+		}
+		if dt.Elements, err = strconv.ParseUint(args[0], 10, 32); err != nil || dt.Elements == 0 {
+			return dt, fmt.Errorf("invalid amount of elements for %s: %q", name, args[0])
+		}
+		args = args[1:]
+	}
+
+	if t.IsDelay() {
+		if len(args) != 1 {
+			return dt, fmt.Errorf("missing period for %s", name)
+		}
+		d, err := parseTime(args[0])
+		if err != nil {
+			return dt, err
+		}
+		// HAProxy repeats the data type in the definition of rates.
+		dt.Counter = uint64(t)
+		dt.Period = uint64(d.Milliseconds())
+		args = nil
+	}
+
+	if len(args) > 0 {
+		return dt, fmt.Errorf("unexpected arguments for %s", name)
+	}
+
+	return dt, nil
+}
+
+// timeUnits are the units of HAProxy times, from the largest unit.
+var timeUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+	{"us", time.Microsecond},
+}
+
+// parseTime parses a time in the format of HAProxy, a number with an
+// optional unit defaulting to milliseconds.
+func parseTime(s string) (time.Duration, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+
+	v, err := strconv.ParseUint(s[:i], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	if i == len(s) {
+		return time.Duration(v) * time.Millisecond, nil
+	}
+	for _, u := range timeUnits {
+		if s[i:] == u.suffix {
+			return time.Duration(v) * u.unit, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid time unit in %q", s)
+}
+
+// formatTime formats milliseconds with the largest unit that represents
+// them exactly.
+func formatTime(ms uint64) string {
+	d := time.Duration(ms) * time.Millisecond
+	for _, u := range timeUnits {
+		if d >= u.unit && d%u.unit == 0 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(ms, 10)
+}
+
+// sizeSuffixes are the suffixes of HAProxy sizes, from the largest one.
+var sizeSuffixes = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+}
+
+// parseSize parses a size with an optional k, m or g suffix.
+func parseSize(s string) (uint64, error) {
+	mult := uint64(1)
+	for _, suffix := range sizeSuffixes {
+		if strings.HasSuffix(s, suffix.suffix) {
+			s, mult = strings.TrimSuffix(s, suffix.suffix), suffix.mult
+			break
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * mult, nil
+}
+
+func formatSize(size uint64) string {
+	for _, suffix := range sizeSuffixes {
+		if size >= suffix.mult && size%suffix.mult == 0 {
+			return strconv.FormatUint(size/suffix.mult, 10) + suffix.suffix
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
+
+// Declaration returns the name of the key type in the HAProxy
+// configuration, like ip for KeyTypeIPv4Address. Key types that can not be
+// declared return the name HAProxy uses for them internally.
+func (t KeyType) Declaration() string {
+	switch t {
+	case KeyTypeAny:
+		return "any"
+	case KeyTypeBoolean:
+		return "boolean"
+	case KeyTypeSignedInteger:
+		return "integer"
+	case KeyTypeAddress:
+		return "address"
+	case KeyTypeIPv4Address:
+		return "ip"
+	case KeyTypeIPv6Address:
+		return "ipv6"
+	case KeyTypeString:
+		return "string"
+	case KeyTypeBinary:
+		return "binary"
+	case KeyTypeMethod:
+		return "method"
+	default:
+		return t.String()
+	}
+}
+
+// FormatDefinition returns the declaration of the table in the syntax
+// parsed by ParseDefinition. Tables with a name are declared with the
+// table keyword of a peers section, the others with stick-table. The size
+// is only written if greater than zero, as it is not part of the
+// definition.
+func FormatDefinition(def *Definition, size uint64) string {
+	var b strings.Builder
+	if def.Name != "" {
+		b.WriteString("table ")
+		b.WriteString(def.Name)
+	} else {
+		b.WriteString("stick-table")
+	}
+
+	b.WriteString(" type ")
+	b.WriteString(def.KeyType.Declaration())
+	if (def.KeyType == KeyTypeString || def.KeyType == KeyTypeBinary) && def.KeyLength != defaultKeyLength {
+		b.WriteString(" len ")
+		b.WriteString(strconv.FormatUint(def.KeyLength, 10))
+	}
+	if size > 0 {
+		b.WriteString(" size ")
+		b.WriteString(formatSize(size))
+	}
+	if def.Expiry > 0 {
+		b.WriteString(" expire ")
+		b.WriteString(formatTime(def.Expiry))
+	}
+
+	for i, dt := range def.DataTypes {
+		if i == 0 {
+			b.WriteString(" store ")
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(dt.DataType.String())
+
+		var args []string
+		if dt.DataType.IsArray() {
+			args = append(args, strconv.FormatUint(dt.Elements, 10))
+		}
+		if dt.DataType.IsDelay() {
+			args = append(args, formatTime(dt.Period))
+		}
+		if len(args) > 0 {
+			b.WriteString("(" + strings.Join(args, ",") + ")")
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package sticktable
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDefinition(t *testing.T) {
+	tests := []struct {
+		decl string
+		want *Definition
+		// format is the declaration returned by FormatDefinition for the
+		// size 200k.
+		format string
+	}{
+		{
+			"stick-table type ip size 200k expire 5m store gpc0,http_req_rate(10s)",
+			&Definition{
+				KeyType:   KeyTypeIPv4Address,
+				KeyLength: 4,
+				Expiry:    300000,
+				DataTypes: []DataTypeDefinition{
+					{DataType: DataTypeGPC0},
+					{DataType: DataTypeHttpRequestsRate, Counter: uint64(DataTypeHttpRequestsRate), Period: 10000},
+				},
+			},
+			"stick-table type ip size 200k expire 5m store gpc0,http_req_rate(10s)",
+		},
+		{
+			"table st_path type string len 64 size 1m store http_req_rate(10s),gpc0 store gpc(2),gpc_rate(2,1m) peers mypeers nopurge",
+			&Definition{
+				Name:      "st_path",
+				KeyType:   KeyTypeString,
+				KeyLength: 64,
+				DataTypes: []DataTypeDefinition{
+					{DataType: DataTypeGPC0},
+					{DataType: DataTypeHttpRequestsRate, Counter: uint64(DataTypeHttpRequestsRate), Period: 10000},
+					{DataType: DataTypeGPCArray, Elements: 2},
+					{DataType: DataTypeGPCRateArray, Counter: uint64(DataTypeGPCRateArray), Elements: 2, Period: 60000},
+				},
+			},
+			"table st_path type string len 64 size 200k store gpc0,http_req_rate(10s),gpc(2),gpc_rate(2,1m)",
+		},
+		{
+			"type ipv6 size 10 expire 1500",
+			&Definition{KeyType: KeyTypeIPv6Address, KeyLength: 16, Expiry: 1500},
+			"stick-table type ipv6 size 200k expire 1500ms",
+		},
+		{
+			"stick-table type binary size 1k expire 1d store server_id,server_key",
+			&Definition{
+				KeyType:   KeyTypeBinary,
+				KeyLength: 32,
+				Expiry:    86400000,
+				DataTypes: []DataTypeDefinition{
+					{DataType: DataTypeServerId},
+					{DataType: DataTypeServerKey},
+				},
+			},
+			"stick-table type binary size 200k expire 1d store server_id,server_key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.decl, func(t *testing.T) {
+			got, err := ParseDefinition(tt.decl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseDefinition() mismatch (-want +got):\n%s", diff)
+			}
+
+			format := FormatDefinition(got, 200<<10)
+			if format != tt.format {
+				t.Errorf("FormatDefinition() = %q, want %q", format, tt.format)
+			}
+
+			again, err := ParseDefinition(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, again); diff != "" {
+				t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, decl := range []string{
+		"",
+		"stick-table size 200k",
+		"table",
+		"stick-table type foo",
+		"stick-table type ip len 8",
+		"stick-table type string len 0",
+		"stick-table type ip size 1x",
+		"stick-table type ip expire 5x",
+		"stick-table type ip expire",
+		"stick-table type ip store gpc42",
+		"stick-table type ip store http_req_rate",
+		"stick-table type ip store http_req_rate(10s,1)",
+		"stick-table type ip store gpc",
+		"stick-table type ip store gpc(0)",
+		"stick-table type ip store gpc0(1)",
+		"stick-table type ip store gpc0(",
+		"stick-table type ip store",
+		"stick-table type ip foo",
+	} {
+		if _, err := ParseDefinition(decl); err == nil {
+			t.Errorf("ParseDefinition(%q): expected error", decl)
+		}
+	}
+}
+
+func TestFormatDefinition(t *testing.T) {
+	def := &Definition{
+		KeyType:   KeyTypeString,
+		KeyLength: 32,
+		Expiry:    90000,
+		DataTypes: []DataTypeDefinition{{DataType: DataTypeGPT0}},
+	}
+
+	if got, want := FormatDefinition(def, 0), "stick-table type string expire 90s store gpt0"; got != want {
+		t.Errorf("FormatDefinition() = %q, want %q", got, want)
+	}
+	if got, want := FormatDefinition(def, 1000), "stick-table type string size 1000 expire 90s store gpt0"; got != want {
+		t.Errorf("FormatDefinition() = %q, want %q", got, want)
+	}
+}
+
+func TestKeyTypeDeclaration(t *testing.T) {
+	for _, kt := range []KeyType{KeyTypeIPv4Address, KeyTypeIPv6Address, KeyTypeSignedInteger, KeyTypeString, KeyTypeBinary} {
+		got, _, err := parseKeyType(kt.Declaration())
+		if err != nil {
+			t.Errorf("parsing declaration of %s: %v", kt, err)
+			continue
+		}
+		if got != kt {
+			t.Errorf("Declaration() of %s parsed as %s", kt, got)
+		}
+	}
+
+	if got := KeyTypeMethod.Declaration(); got != "method" {
+		t.Errorf("expected method, got %q", got)
+	}
+}
@@ -0,0 +1,131 @@
+package sticktable
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// ParseDataType returns the data type with the name used by HAProxy, like
+// gpc0 or http_req_rate.
+func ParseDataType(name string) (DataType, error) {
+	for t := DataTypeServerId; t.valid(); t++ {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown data type: %q", name)
+}
+
+// ParseKey parses the string representation of a key of the key type.
+// Addresses are parsed like netip.ParseAddr, binary and any keys as hex
+// string. IPv4 addresses are accepted for IPv6 keys as IPv4-mapped
+// address.
+func (t KeyType) ParseKey(s string) (MapKey, error) {
+	switch t {
+	case KeyTypeString:
+		k := StringKey(s)
+		return &k, nil
+	case KeyTypeMethod:
+		k := MethodKey(s)
+		return &k, nil
+	case KeyTypeSignedInteger:
+		v, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing integer key: %w", err)
+		}
+		k := SignedIntegerKey(v)
+		return &k, nil
+	case KeyTypeBoolean:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing boolean key: %w", err)
+		}
+		k := BooleanKey(v)
+		return &k, nil
+	case KeyTypeIPv4Address, KeyTypeIPv6Address, KeyTypeAddress:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing address key: %w", err)
+		}
+
+		switch t {
+		case KeyTypeIPv4Address:
+			addr = addr.Unmap()
+			if !addr.Is4() {
+				return nil, fmt.Errorf("not an ipv4 address: %s", s)
+			}
+			k := IPv4AddressKey(addr)
+			return &k, nil
+		case KeyTypeIPv6Address:
+			k := IPv6AddressKey(netip.AddrFrom16(addr.As16()))
+			return &k, nil
+		default:
+			k := AddressKey(addr)
+			return &k, nil
+		}
+	case KeyTypeBinary, KeyTypeAny:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing binary key: %w", err)
+		}
+		if t == KeyTypeAny {
+			k := AnyKey(b)
+			return &k, nil
+		}
+		k := BinaryKey(b)
+		return &k, nil
+	default:
+		return nil, fmt.Errorf("unknown key type: %v", t)
+	}
+}
+
+// FormatKey returns the string representation of the key accepted by
+// KeyType.ParseKey.
+func FormatKey(k MapKey) string {
+	switch k := k.(type) {
+	case *BinaryKey:
+		return hex.EncodeToString(*k)
+	case *AnyKey:
+		return hex.EncodeToString(*k)
+	default:
+		return k.String()
+	}
+}
+
+// DataValue returns the value of the data type as plain value, for
+// example to encode it as JSON. Integers are returned as uint32, uint64
+// or int32, arrays as slice of them and dictionary entries as string.
+// Frequency counters are returned as rate over the period of dt like
+// "show table" does, their current tick is elapsed old. Other data is
+// returned in its String representation.
+func DataValue(dt DataTypeDefinition, d MapData, elapsed time.Duration) any {
+	switch d := d.(type) {
+	case *UnsignedIntegerData:
+		return uint32(*d)
+	case *UnsignedLongLongData:
+		return uint64(*d)
+	case *SignedIntegerData:
+		return int32(*d)
+	case *FreqData:
+		return d.Rate(dt.PeriodDuration(), elapsed)
+	case *DictData:
+		return string(d.Value)
+	case *UnsignedIntegerArrayData:
+		values := make([]uint32, len(*d))
+		for i, v := range *d {
+			values[i] = uint32(v)
+		}
+		return values
+	case *FreqArrayData:
+		rates := make([]uint64, len(*d))
+		for i := range *d {
+			rates[i] = (*d)[i].Rate(dt.PeriodDuration(), elapsed)
+		}
+		return rates
+	default:
+		return d.String()
+	}
+}
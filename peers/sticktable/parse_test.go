@@ -0,0 +1,135 @@
+package sticktable
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDataType(t *testing.T) {
+	for d := DataTypeServerId; d.valid(); d++ {
+		got, err := ParseDataType(d.String())
+		if err != nil {
+			t.Errorf("ParseDataType(%q): %v", d.String(), err)
+			continue
+		}
+		if got != d {
+			t.Errorf("ParseDataType(%q) = %v, want %v", d.String(), got, d)
+		}
+	}
+
+	if _, err := ParseDataType("gpc42"); err == nil {
+		t.Error("expected error for unknown data type")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	str := StringKey("abc")
+	integer := SignedIntegerKey(-42)
+	boolean := BooleanKey(true)
+	ipv4 := IPv4AddressKey(netip.MustParseAddr("192.0.2.1"))
+	ipv6 := IPv6AddressKey(netip.MustParseAddr("2001:db8::1"))
+	mapped := IPv6AddressKey(netip.MustParseAddr("::ffff:192.0.2.1"))
+	addr := AddressKey(netip.MustParseAddr("192.0.2.1"))
+	binary := BinaryKey{0xde, 0xad}
+	method := MethodKey("GET")
+
+	tests := []struct {
+		keyType KeyType
+		input   string
+		want    MapKey
+	}{
+		{KeyTypeString, "abc", &str},
+		{KeyTypeSignedInteger, "-42", &integer},
+		{KeyTypeBoolean, "true", &boolean},
+		{KeyTypeIPv4Address, "192.0.2.1", &ipv4},
+		{KeyTypeIPv4Address, "::ffff:192.0.2.1", &ipv4},
+		{KeyTypeIPv6Address, "2001:db8::1", &ipv6},
+		{KeyTypeIPv6Address, "192.0.2.1", &mapped},
+		{KeyTypeAddress, "192.0.2.1", &addr},
+		{KeyTypeBinary, "dead", &binary},
+		{KeyTypeMethod, "GET", &method},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.keyType.String()+"/"+tt.input, func(t *testing.T) {
+			got, err := tt.keyType.ParseKey(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.Transformer("String", MapKey.String)); diff != "" {
+				t.Errorf("ParseKey() mismatch (-want +got):\n%s", diff)
+			}
+
+			formatted, err := tt.keyType.ParseKey(FormatKey(got))
+			if err != nil {
+				t.Fatalf("parsing formatted key: %v", err)
+			}
+			if diff := cmp.Diff(got, formatted, cmp.Transformer("String", MapKey.String)); diff != "" {
+				t.Errorf("FormatKey() round trip mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		keyType KeyType
+		input   string
+	}{
+		{KeyTypeSignedInteger, "abc"},
+		{KeyTypeSignedInteger, "4294967296"},
+		{KeyTypeIPv4Address, "2001:db8::1"},
+		{KeyTypeIPv6Address, "host"},
+		{KeyTypeBinary, "xyz"},
+		{KeyType(42), ""},
+	} {
+		if _, err := tt.keyType.ParseKey(tt.input); err == nil {
+			t.Errorf("ParseKey(%q) as %v: expected error", tt.input, tt.keyType)
+		}
+	}
+}
+
+func TestDataValue(t *testing.T) {
+	rate := DataTypeDefinition{DataType: DataTypeHttpRequestsRate, Period: 10000}
+	gpc0 := UnsignedIntegerData(7)
+	bytesIn := UnsignedLongLongData(1 << 40)
+	freq := FreqData{CurrentTick: 1000, CurrentPeriod: 5, LastPeriod: 10}
+	dict := DictData{ID: 1, Value: []byte("srv")}
+	gpc := UnsignedIntegerArrayData{1, 2}
+	gpcRate := FreqArrayData{NewFreqData(3), NewFreqData(4)}
+
+	tests := []struct {
+		dt   DataTypeDefinition
+		data MapData
+		want any
+	}{
+		{DataTypeDefinition{DataType: DataTypeGPC0}, &gpc0, uint32(7)},
+		{DataTypeDefinition{DataType: DataTypeBytesInCounter}, &bytesIn, uint64(1 << 40)},
+		// 5 + 10 * (10s - 1s - 4s) / 10s
+		{rate, &freq, uint64(10)},
+		{DataTypeDefinition{DataType: DataTypeServerKey}, &dict, "srv"},
+		{DataTypeDefinition{DataType: DataTypeGPCArray, Elements: 2}, &gpc, []uint32{1, 2}},
+		{DataTypeDefinition{DataType: DataTypeGPCRateArray, Elements: 2, Period: 10000}, &gpcRate, []uint64{3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dt.DataType.String(), func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, DataValue(tt.dt, tt.data, 4*time.Second)); diff != "" {
+				t.Errorf("DataValue() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAgeRates(t *testing.T) {
+	gpc0 := UnsignedIntegerData(1)
+	freq := FreqData{CurrentTick: 100, CurrentPeriod: 5}
+	gpcRate := FreqArrayData{{CurrentTick: 200}}
+
+	AgeRates([]MapData{&gpc0, &freq, &gpcRate}, time.Second)
+
+	if freq.CurrentTick != 1100 || gpcRate[0].CurrentTick != 1200 || gpc0 != 1 {
+		t.Errorf("unexpected aged data: %v %v %v", gpc0, freq, gpcRate)
+	}
+}
@@ -3,7 +3,9 @@ package sticktable
 import (
 	"encoding/binary"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 )
@@ -11,7 +13,55 @@ import (
 type DataTypeDefinition struct {
 	DataType DataType
 	Counter  uint64
-	Period   uint64
+	// Period is the period of frequency counters in milliseconds.
+	Period uint64
+	// Elements is the amount of elements of array data types.
+	Elements uint64
+}
+
+// PeriodDuration returns the period of frequency counters.
+func (d DataTypeDefinition) PeriodDuration() time.Duration {
+	return time.Duration(d.Period) * time.Millisecond
+}
+
+// New returns an empty value for the data type. Arrays are allocated
+// with the amount of elements of the definition.
+func (d DataTypeDefinition) New() MapData {
+	switch d.DataType {
+	case DataTypeGPTArray, DataTypeGPCArray:
+		v := make(UnsignedIntegerArrayData, d.Elements)
+		return &v
+	case DataTypeGPCRateArray:
+		v := make(FreqArrayData, d.Elements)
+		return &v
+	default:
+		return d.DataType.New()
+	}
+}
+
+// fits reports whether v is of the type returned by New.
+func (d DataTypeDefinition) fits(v MapData) bool {
+	switch v := v.(type) {
+	case *UnsignedIntegerArrayData:
+		return (d.DataType == DataTypeGPTArray || d.DataType == DataTypeGPCArray) &&
+			uint64(len(*v)) == d.Elements
+	case *FreqArrayData:
+		return d.DataType == DataTypeGPCRateArray && uint64(len(*v)) == d.Elements
+	case *FreqData:
+		return d.DataType.IsDelay() && !d.DataType.IsArray()
+	case *SignedIntegerData:
+		return d.DataType == DataTypeServerId
+	case *DictData:
+		return d.DataType == DataTypeServerKey
+	case *UnsignedLongLongData:
+		return d.DataType == DataTypeBytesInCounter || d.DataType == DataTypeBytesOutCounter
+	case *UnsignedIntegerData:
+		return d.DataType.valid() && !d.DataType.IsDelay() && !d.DataType.IsArray() &&
+			d.DataType != DataTypeServerId && d.DataType != DataTypeServerKey &&
+			d.DataType != DataTypeBytesInCounter && d.DataType != DataTypeBytesOutCounter
+	default:
+		return false
+	}
 }
 
 type Definition struct {
@@ -38,9 +88,14 @@ func (s *Definition) Unmarshal(b []byte) (int, error) {
 		return offset, err
 	}
 
-	name := make([]byte, nameLength)
-	offset += copy(name, b[offset:])
-	s.Name = string(name)
+	if nameLength > uint64(len(b)-offset) {
+		return offset, fmt.Errorf("invalid name length: %d", nameLength)
+	}
+	// Reused definitions only allocate when the name changed.
+	if name := b[offset : offset+int(nameLength)]; s.Name != string(name) {
+		s.Name = string(name)
+	}
+	offset += int(nameLength)
 
 	keyType, n, err := encoding.Varint(b[offset:])
 	offset += n
@@ -69,6 +124,7 @@ func (s *Definition) Unmarshal(b []byte) (int, error) {
 	}
 	s.Expiry = expiry
 
+	s.DataTypes = s.DataTypes[:0]
 	// The data types are values from 0 to 64. Currently only 24 are implemented,
 	// but we iterate over all possible values to capture potentially missing ones.
 	for i := 0; i < 64; i++ {
@@ -78,12 +134,12 @@ func (s *Definition) Unmarshal(b []byte) (int, error) {
 				DataType: DataType(i),
 			}
 
-			info := d.DataType.New()
-			if info == nil {
+			if !d.DataType.valid() {
 				return offset, fmt.Errorf("unknown data type: %v", d.DataType)
 			}
 
-			if d.DataType.IsDelay() {
+			switch {
+			case d.DataType.IsDelay():
 				counter, n, err := encoding.Varint(b[offset:])
 				offset += n
 				if err != nil {
@@ -91,12 +147,38 @@ func (s *Definition) Unmarshal(b []byte) (int, error) {
 				}
 				d.Counter = counter
 
+				if d.DataType.IsArray() {
+					elements, n, err := encoding.Varint(b[offset:])
+					offset += n
+					if err != nil {
+						return offset, err
+					}
+					d.Elements = elements
+				}
+
 				period, n, err := encoding.Varint(b[offset:])
 				offset += n
 				if err != nil {
 					return offset, err
 				}
 				d.Period = period
+			case d.DataType.IsArray():
+				// Arrays repeat their data type before the amount of elements.
+				dataType, n, err := encoding.Varint(b[offset:])
+				offset += n
+				if err != nil {
+					return offset, err
+				}
+				if DataType(dataType) != d.DataType {
+					return offset, fmt.Errorf("array data type mismatch: %v != %v", DataType(dataType), d.DataType)
+				}
+
+				elements, n, err := encoding.Varint(b[offset:])
+				offset += n
+				if err != nil {
+					return offset, err
+				}
+				d.Elements = elements
 			}
 
 			s.DataTypes = append(s.DataTypes, d)
@@ -105,6 +187,8 @@ func (s *Definition) Unmarshal(b []byte) (int, error) {
 	return offset, nil
 }
 
+// Marshal encodes the definition into b. It returns
+// encoding.ErrInsufficientSpace if b is shorter than Size.
 func (s *Definition) Marshal(b []byte) (int, error) {
 	var offset int
 	n, err := encoding.PutVarint(b[offset:], s.StickTableID)
@@ -119,6 +203,9 @@ func (s *Definition) Marshal(b []byte) (int, error) {
 		return offset, err
 	}
 
+	if len(b)-offset < len(s.Name) {
+		return offset, encoding.ErrInsufficientSpace
+	}
 	offset += copy(b[offset:], s.Name)
 
 	n, err = encoding.PutVarint(b[offset:], uint64(s.KeyType))
@@ -151,24 +238,104 @@ func (s *Definition) Marshal(b []byte) (int, error) {
 	}
 
 	for _, dataType := range s.DataTypes {
-		if dataType.DataType.IsDelay() {
+		switch {
+		case dataType.DataType.IsDelay():
 			n, err = encoding.PutVarint(b[offset:], dataType.Counter)
 			offset += n
 			if err != nil {
 				return offset, err
 			}
 
+			if dataType.DataType.IsArray() {
+				n, err = encoding.PutVarint(b[offset:], dataType.Elements)
+				offset += n
+				if err != nil {
+					return offset, err
+				}
+			}
+
 			n, err = encoding.PutVarint(b[offset:], dataType.Period)
 			offset += n
 			if err != nil {
 				return offset, err
 			}
+		case dataType.DataType.IsArray():
+			n, err = encoding.PutVarint(b[offset:], uint64(dataType.DataType))
+			offset += n
+			if err != nil {
+				return offset, err
+			}
+
+			n, err = encoding.PutVarint(b[offset:], dataType.Elements)
+			offset += n
+			if err != nil {
+				return offset, err
+			}
 		}
 	}
 
 	return offset, nil
 }
 
+// Size returns the exact amount of bytes written by Marshal.
+func (s *Definition) Size() int {
+	var dataTypes uint64
+	for _, dataType := range s.DataTypes {
+		dataTypes |= 1 << dataType.DataType
+	}
+
+	size := encoding.VarintSize(s.StickTableID) +
+		encoding.VarintSize(uint64(len(s.Name))) + len(s.Name) +
+		encoding.VarintSize(uint64(s.KeyType)) +
+		encoding.VarintSize(s.KeyLength) +
+		encoding.VarintSize(dataTypes) +
+		encoding.VarintSize(s.Expiry)
+
+	for _, dataType := range s.DataTypes {
+		switch {
+		case dataType.DataType.IsDelay():
+			size += encoding.VarintSize(dataType.Counter)
+			if dataType.DataType.IsArray() {
+				size += encoding.VarintSize(dataType.Elements)
+			}
+			size += encoding.VarintSize(dataType.Period)
+		case dataType.DataType.IsArray():
+			size += encoding.VarintSize(uint64(dataType.DataType)) +
+				encoding.VarintSize(dataType.Elements)
+		}
+	}
+
+	return size
+}
+
+// Compatible reports whether the entries of the table can be kept for the
+// table o, which requires the same key and data types.
+func (s *Definition) Compatible(o *Definition) bool {
+	return s.KeyType == o.KeyType &&
+		s.KeyLength == o.KeyLength &&
+		slices.Equal(s.DataTypes, o.DataTypes)
+}
+
+// AppendKey appends the wire encoding of a key of the table to b. The
+// encoding differs for every key, so it identifies entries in maps.
+func (s *Definition) AppendKey(b []byte, k MapKey) ([]byte, error) {
+	size := k.Size(s.KeyLength)
+	b = slices.Grow(b, size)
+
+	n, err := k.Marshal(b[len(b):len(b)+size], s.KeyLength)
+	if err != nil {
+		return b, fmt.Errorf("encoding key: %w", err)
+	}
+
+	return b[:len(b)+n], nil
+}
+
+// EncodeKey returns the wire encoding of a key of the table, see AppendKey.
+func (s *Definition) EncodeKey(k MapKey) (string, error) {
+	b, err := s.AppendKey(nil, k)
+	return string(b), err
+}
+
 type EntryUpdate struct {
 	StickTable *Definition
 	Key        MapKey
@@ -190,14 +357,77 @@ func (e *EntryUpdate) String() string {
 	return fmt.Sprintf("EntryUpdate %d: %s - %s", e.LocalUpdateID, e.Key, strings.Join(data, " | "))
 }
 
+// Get returns the value of the data type or nil if the table does not
+// store the data type.
+func (e *EntryUpdate) Get(t DataType) MapData {
+	for i, dt := range e.StickTable.DataTypes {
+		if dt.DataType == t {
+			if i >= len(e.Data) {
+				return nil
+			}
+			return e.Data[i]
+		}
+	}
+
+	return nil
+}
+
+// Uint returns the value of an unsigned integer data type like gpc0 or
+// conn_cnt. It reports false if the data type is not stored or has a
+// different type.
+func (e *EntryUpdate) Uint(t DataType) (uint32, bool) {
+	v, ok := e.Get(t).(*UnsignedIntegerData)
+	if !ok {
+		return 0, false
+	}
+	return uint32(*v), true
+}
+
+// Uint64 returns the value of an unsigned integer data type like
+// bytes_in_cnt. Unsigned 32-bit data types are returned as well.
+func (e *EntryUpdate) Uint64(t DataType) (uint64, bool) {
+	switch v := e.Get(t).(type) {
+	case *UnsignedLongLongData:
+		return uint64(*v), true
+	case *UnsignedIntegerData:
+		return uint64(*v), true
+	default:
+		return 0, false
+	}
+}
+
+// Freq returns the frequency counter of a rate data type like
+// http_req_rate.
+func (e *EntryUpdate) Freq(t DataType) (*FreqData, bool) {
+	v, ok := e.Get(t).(*FreqData)
+	return v, ok
+}
+
+// Dict returns the value of a dictionary data type like server_key.
+func (e *EntryUpdate) Dict(t DataType) ([]byte, bool) {
+	v, ok := e.Get(t).(*DictData)
+	if !ok {
+		return nil, false
+	}
+	return v.Value, true
+}
+
+// Marshal encodes the update into b. It returns
+// encoding.ErrInsufficientSpace if b is shorter than Size.
 func (e *EntryUpdate) Marshal(b []byte) (int, error) {
 	var offset int
 	if e.WithLocalUpdateID {
+		if len(b) < offset+4 {
+			return offset, encoding.ErrInsufficientSpace
+		}
 		binary.BigEndian.PutUint32(b[offset:], e.LocalUpdateID)
 		offset += 4
 	}
 
 	if e.WithExpiry {
+		if len(b) < offset+4 {
+			return offset, encoding.ErrInsufficientSpace
+		}
 		binary.BigEndian.PutUint32(b[offset:], e.Expiry)
 		offset += 4
 	}
@@ -219,23 +449,51 @@ func (e *EntryUpdate) Marshal(b []byte) (int, error) {
 	return offset, nil
 }
 
+// Size returns the exact amount of bytes written by Marshal.
+func (e *EntryUpdate) Size() int {
+	var size int
+	if e.WithLocalUpdateID {
+		size += 4
+	}
+	if e.WithExpiry {
+		size += 4
+	}
+
+	size += e.Key.Size(e.StickTable.KeyLength)
+	for _, data := range e.Data {
+		size += data.Size()
+	}
+
+	return size
+}
+
 func (e *EntryUpdate) Unmarshal(b []byte) (int, error) {
 	var offset int
 	// We already have a correct update ID loaded from the caller,
 	// so we just override it when the message has its own
 	if e.WithLocalUpdateID {
+		if len(b) < offset+4 {
+			return offset, fmt.Errorf("invalid update id length: %d", len(b)-offset)
+		}
 		e.LocalUpdateID = binary.BigEndian.Uint32(b[offset:])
 		offset += 4
 	}
 
 	if e.WithExpiry {
+		if len(b) < offset+4 {
+			return offset, fmt.Errorf("invalid expiry length: %d", len(b)-offset)
+		}
 		e.Expiry = binary.BigEndian.Uint32(b[offset:])
 		offset += 4
 	}
 
-	e.Key = e.StickTable.KeyType.New()
-	if e.Key == nil {
-		return offset, fmt.Errorf("unknown key type: %v", e.StickTable.KeyType)
+	// The key and data of a reused update are only replaced if they do
+	// not fit the table definition.
+	if !e.StickTable.KeyType.fits(e.Key) {
+		e.Key = e.StickTable.KeyType.New()
+		if e.Key == nil {
+			return offset, fmt.Errorf("unknown key type: %v", e.StickTable.KeyType)
+		}
 	}
 
 	n, err := e.Key.Unmarshal(b[offset:], e.StickTable.KeyLength)
@@ -244,10 +502,23 @@ func (e *EntryUpdate) Unmarshal(b []byte) (int, error) {
 	}
 	offset += n
 
-	for _, dataType := range e.StickTable.DataTypes {
-		data := dataType.DataType.New()
-		if data == nil {
-			return offset, fmt.Errorf("unknown data type: %v", dataType)
+	if len(e.Data) > len(e.StickTable.DataTypes) {
+		clear(e.Data[len(e.StickTable.DataTypes):])
+		e.Data = e.Data[:len(e.StickTable.DataTypes)]
+	}
+
+	for i, dataType := range e.StickTable.DataTypes {
+		if i == len(e.Data) {
+			e.Data = append(e.Data, nil)
+		}
+
+		data := e.Data[i]
+		if !dataType.fits(data) {
+			data = dataType.New()
+			if data == nil {
+				return offset, fmt.Errorf("unknown data type: %v", dataType)
+			}
+			e.Data[i] = data
 		}
 
 		n, err := data.Unmarshal(b[offset:])
@@ -255,8 +526,6 @@ func (e *EntryUpdate) Unmarshal(b []byte) (int, error) {
 			return offset, err
 		}
 		offset += n
-
-		e.Data = append(e.Data, data)
 	}
 
 	return offset, nil
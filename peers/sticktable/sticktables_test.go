@@ -1,9 +1,13 @@
 package sticktable
 
 import (
+	"errors"
 	"net/netip"
+	"strings"
 	"testing"
 
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/dropmorepackets/haproxy-go/pkg/testutil"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -125,3 +129,362 @@ func TestEntryUpdateMarshalEncodesData(t *testing.T) {
 		t.Errorf("round-trip data = %v, want [42]", got.Data)
 	}
 }
+
+func TestMarshalUnmarshalArrays(t *testing.T) {
+	def := &Definition{
+		StickTableID: 7,
+		Name:         "arrays",
+		KeyType:      KeyTypeString,
+		KeyLength:    32,
+		DataTypes: []DataTypeDefinition{
+			{DataType: DataTypeGPTArray, Elements: 2},
+			{DataType: DataTypeGPCArray, Elements: 3},
+			{DataType: DataTypeGPCRateArray, Counter: uint64(DataTypeGPCRateArray), Elements: 3, Period: 10000},
+		},
+		Expiry: 600000,
+	}
+
+	t.Run("sticktable definition", func(t *testing.T) {
+		b := make([]byte, 256)
+		n, err := def.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var d Definition
+		m, err := d.Unmarshal(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m != n {
+			t.Errorf("Unmarshal() consumed %d of %d bytes", m, n)
+		}
+
+		if diff := cmp.Diff(*def, d); diff != "" {
+			t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("entry update", func(t *testing.T) {
+		key := StringKey("10.0.0.1")
+		e := &EntryUpdate{
+			StickTable:        def,
+			WithLocalUpdateID: true,
+			LocalUpdateID:     1,
+			Key:               &key,
+			Data: []MapData{
+				&UnsignedIntegerArrayData{1, 2},
+				&UnsignedIntegerArrayData{3, 400, 5},
+				&FreqArrayData{
+					{CurrentTick: 1, CurrentPeriod: 2, LastPeriod: 3},
+					{},
+					{CurrentTick: 4, CurrentPeriod: 500, LastPeriod: 6},
+				},
+			},
+		}
+
+		b := make([]byte, 256)
+		n, err := e.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := EntryUpdate{StickTable: def, WithLocalUpdateID: true}
+		m, err := d.Unmarshal(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m != n {
+			t.Errorf("Unmarshal() consumed %d of %d bytes", m, n)
+		}
+
+		if diff := cmp.Diff(*e, d); diff != "" {
+			t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestEntryUpdateUnknownKeyType(t *testing.T) {
+	def := &Definition{
+		Name:    "unknown",
+		KeyType: KeyType(42),
+	}
+
+	e := EntryUpdate{StickTable: def}
+	if _, err := e.Unmarshal([]byte{0, 0, 0, 0}); err == nil {
+		t.Error("expected error for unknown key type")
+	}
+}
+
+func TestEntryUpdateAccessors(t *testing.T) {
+	def := &Definition{
+		Name:      "accessors",
+		KeyType:   KeyTypeString,
+		KeyLength: 32,
+		DataTypes: []DataTypeDefinition{
+			{DataType: DataTypeGPC0},
+			{DataType: DataTypeHttpRequestsRate, Period: 10000},
+			{DataType: DataTypeBytesInCounter},
+			{DataType: DataTypeServerKey},
+		},
+	}
+
+	gpc0 := UnsignedIntegerData(3)
+	bytesIn := UnsignedLongLongData(1 << 40)
+	e := &EntryUpdate{
+		StickTable: def,
+		Data: []MapData{
+			&gpc0,
+			&FreqData{CurrentPeriod: 7},
+			&bytesIn,
+			&DictData{ID: 1, Value: []byte("srv1")},
+		},
+	}
+
+	if v, ok := e.Uint(DataTypeGPC0); !ok || v != 3 {
+		t.Errorf("Uint(gpc0) = %d, %t", v, ok)
+	}
+	if v, ok := e.Uint64(DataTypeGPC0); !ok || v != 3 {
+		t.Errorf("Uint64(gpc0) = %d, %t", v, ok)
+	}
+	if v, ok := e.Uint64(DataTypeBytesInCounter); !ok || v != 1<<40 {
+		t.Errorf("Uint64(bytes_in_cnt) = %d, %t", v, ok)
+	}
+	if v, ok := e.Freq(DataTypeHttpRequestsRate); !ok || v.CurrentPeriod != 7 {
+		t.Errorf("Freq(http_req_rate) = %v, %t", v, ok)
+	}
+	if v, ok := e.Dict(DataTypeServerKey); !ok || string(v) != "srv1" {
+		t.Errorf("Dict(server_key) = %q, %t", v, ok)
+	}
+	if _, ok := e.Uint(DataTypeGPC1); ok {
+		t.Error("Uint(gpc1) reported a value for a data type not stored")
+	}
+	if _, ok := e.Uint(DataTypeBytesInCounter); ok {
+		t.Error("Uint(bytes_in_cnt) reported a value of the wrong type")
+	}
+	if e.Get(DataTypeGPC1) != nil {
+		t.Error("Get(gpc1) returned a value for a data type not stored")
+	}
+}
+
+func TestEntryUpdateUnmarshalReuse(t *testing.T) {
+	def := &Definition{
+		StickTableID: 1,
+		Name:         "reuse",
+		KeyType:      KeyTypeString,
+		KeyLength:    32,
+		DataTypes: []DataTypeDefinition{
+			{DataType: DataTypeGPC0},
+			{DataType: DataTypeHttpRequestsRate, Counter: 1, Period: 10000},
+			{DataType: DataTypeServerKey},
+			{DataType: DataTypeGPCArray, Elements: 2},
+		},
+	}
+
+	key := StringKey("key")
+	gpc0 := UnsignedIntegerData(1)
+	rate := FreqData{CurrentTick: 1, CurrentPeriod: 2, LastPeriod: 3}
+	dict := DictData{ID: 1, Value: []byte("server")}
+	gpc := UnsignedIntegerArrayData{4, 5}
+	in := &EntryUpdate{
+		StickTable:        def,
+		Key:               &key,
+		Data:              []MapData{&gpc0, &rate, &dict, &gpc},
+		WithLocalUpdateID: true,
+		LocalUpdateID:     10,
+	}
+
+	buf := make([]byte, 256)
+	n, err := in.Marshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = buf[:n]
+
+	var defBuf [256]byte
+	dn, err := def.Marshal(defBuf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &EntryUpdate{StickTable: def, WithLocalUpdateID: true}
+	if _, err := out.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var outDef Definition
+	if _, err := outDef.Unmarshal(defBuf[:dn]); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("without allocations", func(t *testing.T) {
+		testutil.WithoutAllocations(t, func() {
+			if _, err := out.Unmarshal(buf); err != nil {
+				t.Error(err)
+			}
+			if _, err := outDef.Unmarshal(defBuf[:dn]); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+
+	t.Run("does not reference the buffer", func(t *testing.T) {
+		c := out.Clone()
+		clear(buf)
+
+		if diff := cmp.Diff(in.String(), c.String()); diff != "" {
+			t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(in.String(), out.String()); diff != "" {
+			t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(*def, outDef); diff != "" {
+			t.Errorf("Definition Unmarshal() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("different definition", func(t *testing.T) {
+		other := &Definition{
+			KeyType:   KeyTypeSignedInteger,
+			KeyLength: 4,
+			DataTypes: []DataTypeDefinition{{DataType: DataTypeBytesInCounter}},
+		}
+
+		key := SignedIntegerKey(7)
+		bytesIn := UnsignedLongLongData(1 << 40)
+		b := make([]byte, 32)
+		n, err := (&EntryUpdate{StickTable: other, Key: &key, Data: []MapData{&bytesIn}}).Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out.StickTable = other
+		out.WithLocalUpdateID = false
+		if _, err := out.Unmarshal(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _ := out.Uint64(DataTypeBytesInCounter); got != 1<<40 || len(out.Data) != 1 {
+			t.Errorf("unexpected update %s", out)
+		}
+	})
+}
+
+func TestDataTypeDefinitionFits(t *testing.T) {
+	for dt := DataTypeServerId; dt <= DataTypeGlitchRate; dt++ {
+		d := DataTypeDefinition{DataType: dt, Elements: 3}
+		if !d.fits(d.New()) {
+			t.Errorf("%s does not fit its own value", dt)
+		}
+
+		for other := DataTypeServerId; other <= DataTypeGlitchRate; other++ {
+			o := DataTypeDefinition{DataType: other, Elements: 2}
+			if d.fits(o.New()) && cmp.Diff(d.New(), o.New()) != "" {
+				t.Errorf("%s fits value of %s", dt, other)
+			}
+		}
+	}
+}
+
+func TestDefinitionAndEntryUpdateSize(t *testing.T) {
+	def := &Definition{
+		StickTableID: 300,
+		Name:         strings.Repeat("t", 300),
+		KeyType:      KeyTypeString,
+		KeyLength:    1024,
+		Expiry:       600000,
+		DataTypes: []DataTypeDefinition{
+			{DataType: DataTypeGPC0},
+			{DataType: DataTypeHttpRequestsRate, Counter: 10, Period: 10000},
+			{DataType: DataTypeGPCArray, Elements: 3},
+			{DataType: DataTypeGPCRateArray, Counter: 24, Elements: 2, Period: 1000},
+		},
+	}
+
+	key := StringKey(strings.Repeat("k", 1000))
+	e := &EntryUpdate{
+		StickTable:        def,
+		Key:               &key,
+		Data:              []MapData{ptr(UnsignedIntegerData(1)), &FreqData{}, &UnsignedIntegerArrayData{1, 2, 3}, &FreqArrayData{{}, {}}},
+		WithLocalUpdateID: true,
+		WithExpiry:        true,
+	}
+
+	for _, tt := range []struct {
+		name string
+		size func() int
+		fn   func([]byte) (int, error)
+	}{
+		{"Definition", def.Size, def.Marshal},
+		{"EntryUpdate", e.Size, e.Marshal},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size()
+			n, err := tt.fn(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Errorf("Size() = %d, Marshal() wrote %d bytes", size, n)
+			}
+
+			for l := 0; l < size; l++ {
+				if _, err := tt.fn(make([]byte, l)); !errors.Is(err, encoding.ErrInsufficientSpace) {
+					t.Fatalf("Marshal() into %d bytes: expected ErrInsufficientSpace, got %v", l, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDefinitionHelpers(t *testing.T) {
+	def := &Definition{
+		StickTableID: 3,
+		Name:         "st_src",
+		KeyType:      KeyTypeString,
+		KeyLength:    32,
+		Expiry:       60000,
+		DataTypes:    []DataTypeDefinition{{DataType: DataTypeGPC0}},
+	}
+
+	c := def.Clone()
+	if c.StickTableID != 0 {
+		t.Errorf("expected table ID 0, got %d", c.StickTableID)
+	}
+	c.DataTypes[0].DataType = DataTypeGPT0
+	if def.DataTypes[0].DataType != DataTypeGPC0 {
+		t.Error("clone shares the data types")
+	}
+
+	if def.Compatible(c) {
+		t.Error("expected different data types to be incompatible")
+	}
+	c = def.Clone()
+	c.Name, c.Expiry = "st_other", 0
+	if !def.Compatible(c) {
+		t.Error("expected definition with other name and expiry to be compatible")
+	}
+
+	a, b := StringKey("a"), StringKey("b")
+	ka, err := def.EncodeKey(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := def.EncodeKey(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ka == kb {
+		t.Errorf("expected different encodings, got %q", ka)
+	}
+
+	buf, err := def.AppendKey([]byte("prefix"), &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "prefix"+ka {
+		t.Errorf("expected %q, got %q", "prefix"+ka, got)
+	}
+}
@@ -1,22 +1,33 @@
 package sticktable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 )
 
+// MapKey is the key of a stick table entry. Marshal returns
+// encoding.ErrInsufficientSpace if b is shorter than Size.
 type MapKey interface {
 	fmt.Stringer
 	Unmarshal(b []byte, keySize uint64) (int, error)
 	Marshal(b []byte, keySize uint64) (int, error)
+	// Size returns the exact amount of bytes written by Marshal.
+	Size(keySize uint64) int
 }
 
 type SignedIntegerKey int32
 
 func (v *SignedIntegerKey) Unmarshal(b []byte, keySize uint64) (int, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("invalid signed integer key length: %d", len(b))
+	}
+
 	*v = SignedIntegerKey(binary.BigEndian.Uint32(b))
 	return 4, nil
 }
@@ -31,6 +42,9 @@ func (v *IPv4AddressKey) Unmarshal(b []byte, keySize uint64) (int, error) {
 	if keySize != 4 {
 		return 0, fmt.Errorf("invalid ipv4 key size: %d", keySize)
 	}
+	if len(b) < 4 {
+		return 0, fmt.Errorf("invalid ipv4 key length: %d", len(b))
+	}
 
 	*v = IPv4AddressKey(netip.AddrFrom4([4]byte(b)))
 	return 4, nil
@@ -46,6 +60,9 @@ func (v *IPv6AddressKey) Unmarshal(b []byte, keySize uint64) (int, error) {
 	if keySize != 16 {
 		return 0, fmt.Errorf("invalid ipv6 key size: %d", keySize)
 	}
+	if len(b) < 16 {
+		return 0, fmt.Errorf("invalid ipv6 key length: %d", len(b))
+	}
 
 	*v = IPv6AddressKey(netip.AddrFrom16([16]byte(b)))
 
@@ -64,9 +81,17 @@ func (v *StringKey) Unmarshal(b []byte, keySize uint64) (int, error) {
 		return n, err
 	}
 	if valueLength == 0 {
+		*v = ""
 		return n, nil
 	}
-	*v = StringKey(b[n : n+int(valueLength)])
+	if valueLength > uint64(len(b)-n) {
+		return n, fmt.Errorf("invalid string key length: %d", valueLength)
+	}
+	value := b[n : n+int(valueLength)]
+	// Reused keys only allocate when the value changed.
+	if string(*v) != string(value) {
+		*v = StringKey(value)
+	}
 	return n + int(valueLength), nil
 }
 
@@ -77,7 +102,12 @@ func (v *StringKey) String() string {
 type BinaryKey []byte
 
 func (v *BinaryKey) Unmarshal(b []byte, keySize uint64) (int, error) {
-	*v = b[:keySize]
+	if keySize > uint64(len(b)) {
+		return 0, fmt.Errorf("invalid binary key length: %d < %d", len(b), keySize)
+	}
+
+	// The key must not reference b, as message buffers are reused.
+	*v = append((*v)[:0], b[:keySize]...)
 	return int(keySize), nil
 }
 
@@ -85,18 +115,164 @@ func (v *BinaryKey) String() string {
 	return fmt.Sprintf("%v", *v)
 }
 
+// AnyKey is the key of a table without a specific key type.
+// HAProxy sends it as raw bytes of the configured key size.
+type AnyKey []byte
+
+func (v *AnyKey) Unmarshal(b []byte, keySize uint64) (int, error) {
+	if keySize > uint64(len(b)) {
+		return 0, fmt.Errorf("invalid any key length: %d < %d", len(b), keySize)
+	}
+
+	*v = append((*v)[:0], b[:keySize]...)
+	return int(keySize), nil
+}
+
+func (v *AnyKey) String() string {
+	return fmt.Sprintf("%v", *v)
+}
+
+// BooleanKey is sent as raw bytes of the configured key size,
+// any non-zero byte is considered true.
+type BooleanKey bool
+
+func (v *BooleanKey) Unmarshal(b []byte, keySize uint64) (int, error) {
+	if keySize > uint64(len(b)) {
+		return 0, fmt.Errorf("invalid boolean key length: %d < %d", len(b), keySize)
+	}
+
+	*v = false
+	for _, c := range b[:keySize] {
+		if c != 0 {
+			*v = true
+			break
+		}
+	}
+
+	return int(keySize), nil
+}
+
+func (v *BooleanKey) String() string {
+	return fmt.Sprintf("%t", bool(*v))
+}
+
+// AddressKey is either an IPv4 or IPv6 address, depending on the key size.
+type AddressKey netip.Addr
+
+func (v *AddressKey) Unmarshal(b []byte, keySize uint64) (int, error) {
+	switch keySize {
+	case 4:
+		var k IPv4AddressKey
+		n, err := k.Unmarshal(b, keySize)
+		*v = AddressKey(k)
+		return n, err
+	case 16:
+		var k IPv6AddressKey
+		n, err := k.Unmarshal(b, keySize)
+		*v = AddressKey(k)
+		return n, err
+	default:
+		return 0, fmt.Errorf("invalid address key size: %d", keySize)
+	}
+}
+
+func (v *AddressKey) String() string {
+	return (*netip.Addr)(v).String()
+}
+
+// MethodKey is an HTTP method sent as raw bytes of the configured key size.
+// Trailing zero bytes are not part of the method.
+type MethodKey string
+
+func (v *MethodKey) Unmarshal(b []byte, keySize uint64) (int, error) {
+	if keySize > uint64(len(b)) {
+		return 0, fmt.Errorf("invalid method key length: %d < %d", len(b), keySize)
+	}
+
+	if method := bytes.TrimRight(b[:keySize], "\x00"); string(*v) != string(method) {
+		*v = MethodKey(method)
+	}
+	return int(keySize), nil
+}
+
+func (v *MethodKey) String() string {
+	return string(*v)
+}
+
+// MapData is a value stored in a stick table entry. Marshal returns
+// encoding.ErrInsufficientSpace if b is shorter than Size.
 type MapData interface {
 	fmt.Stringer
 	Unmarshal(b []byte) (int, error)
 	Marshal(b []byte) (int, error)
+	// Size returns the exact amount of bytes written by Marshal.
+	Size() int
 }
 
+// FreqData is a frequency counter. CurrentTick is the age of the current
+// period in milliseconds at the moment the update was sent.
 type FreqData struct {
 	CurrentTick   uint64
 	CurrentPeriod uint64
 	LastPeriod    uint64
 }
 
+// NewFreqData returns a frequency counter that HAProxy reports with the given
+// rate for one full period after receiving it, before it starts to decay.
+func NewFreqData(rate uint64) FreqData {
+	return FreqData{CurrentPeriod: rate}
+}
+
+// Rate returns the event rate over period in the same way HAProxy's
+// read_freq_ctr_period computes it, which is also the value shown by
+// "show table". The previous period is weighted by the remaining time of
+// the current one. HAProxy sends the current tick relative to the moment
+// the update was sent, so elapsed is the time passed since it was received.
+func (f *FreqData) Rate(period, elapsed time.Duration) uint64 {
+	p := uint64(period.Milliseconds())
+	if p == 0 {
+		return f.CurrentPeriod
+	}
+
+	age := f.CurrentTick
+	if elapsed > 0 {
+		age += uint64(elapsed.Milliseconds())
+	}
+
+	curr, past := f.CurrentPeriod, f.LastPeriod
+	if age >= p {
+		// We're past the current period, check if we can still report a
+		// part of it or if we're too far away.
+		age -= p
+		if age >= p {
+			return 0
+		}
+		past, curr = curr, 0
+	}
+
+	return curr + past*(p-age)/p
+}
+
+// AgeRates adds age to the current tick of the frequency counters in data,
+// so a counter received age ago is relative to now like in an update that
+// is sent now.
+func AgeRates(data []MapData, age time.Duration) {
+	if age <= 0 {
+		return
+	}
+
+	for _, d := range data {
+		switch d := d.(type) {
+		case *FreqData:
+			d.CurrentTick += uint64(age.Milliseconds())
+		case *FreqArrayData:
+			for i := range *d {
+				(*d)[i].CurrentTick += uint64(age.Milliseconds())
+			}
+		}
+	}
+}
+
 func (f *FreqData) String() string {
 	return fmt.Sprintf("tick/cur/last: %d/%d/%d", f.CurrentTick, f.CurrentPeriod, f.LastPeriod)
 }
@@ -178,6 +354,10 @@ func (v *UnsignedLongLongData) String() string {
 	return fmt.Sprintf("%d", *v)
 }
 
+// DictData is a dictionary encoded value, as used for server_key. HAProxy
+// caches dictionary entries per peer session and, after sending a value once,
+// only references it by its ID. Within a peer session the ID is resolved to
+// the cached value before the update is handed to the handler.
 type DictData struct {
 	Value []byte
 	ID    uint64
@@ -188,11 +368,15 @@ func (f *DictData) String() string {
 		return "No Entry"
 	}
 
-	return fmt.Sprintf("%d: %v", f.ID, f.Value)
+	return fmt.Sprintf("%d: %s", f.ID, f.Value)
 }
 
 func (f *DictData) Unmarshal(b []byte) (int, error) {
+	f.ID = 0
+	f.Value = f.Value[:0]
+
 	var offset int
+	// length of the remaining dictionary data in bytes
 	length, n, err := encoding.Varint(b[offset:])
 	offset += n
 	if err != nil {
@@ -204,68 +388,188 @@ func (f *DictData) Unmarshal(b []byte) (int, error) {
 		return offset, nil
 	}
 
-	id, n, err := encoding.Varint(b[offset:])
+	if length > uint64(len(b)-offset) {
+		return offset, fmt.Errorf("dict data length exceeds buffer: %d", length)
+	}
+	end := offset + int(length)
+
+	id, n, err := encoding.Varint(b[offset:end])
 	offset += n
 	if err != nil {
 		return offset, err
 	}
+	if id == 0 {
+		return offset, fmt.Errorf("invalid dict entry id: %d", id)
+	}
 	f.ID = id
 
-	if length == 1 {
+	// The entry was sent before on this session and is only referenced by its ID.
+	if offset == end {
 		return offset, nil
 	}
 
-	valueLength, n, err := encoding.Varint(b[offset:])
+	valueLength, n, err := encoding.Varint(b[offset:end])
 	offset += n
 	if err != nil {
 		return offset, err
 	}
 
+	if valueLength > uint64(end-offset) {
+		return offset, fmt.Errorf("dict value length exceeds data length: %d", valueLength)
+	}
+
 	if valueLength == 0 {
 		return offset, nil
 	}
 
-	value := make([]byte, valueLength)
-	offset += copy(value, b[offset:])
-	f.Value = value
+	f.Value = append(f.Value, b[offset:offset+int(valueLength)]...)
+	offset += int(valueLength)
 
 	return offset, nil
 }
 
 func (v *SignedIntegerKey) Marshal(b []byte, keySize uint64) (int, error) {
+	if len(b) < 4 {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
 	binary.BigEndian.PutUint32(b, uint32(*v))
 	return 4, nil
 }
 
+func (v *SignedIntegerKey) Size(keySize uint64) int {
+	return 4
+}
+
 func (v *IPv4AddressKey) Marshal(b []byte, keySize uint64) (int, error) {
 	if keySize != 4 {
 		return 0, fmt.Errorf("invalid ipv4 key size: %d", keySize)
 	}
+	if len(b) < 4 {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
 	a := (*netip.Addr)(v).As4()
 	copy(b, a[:])
 	return 4, nil
 }
 
+func (v *IPv4AddressKey) Size(keySize uint64) int {
+	return 4
+}
+
 func (v *IPv6AddressKey) Marshal(b []byte, keySize uint64) (int, error) {
 	if keySize != 16 {
 		return 0, fmt.Errorf("invalid ipv6 key size: %d", keySize)
 	}
+	if len(b) < 16 {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
 	a := (*netip.Addr)(v).As16()
 	copy(b, a[:])
 	return 16, nil
 }
 
+func (v *IPv6AddressKey) Size(keySize uint64) int {
+	return 16
+}
+
 func (v *StringKey) Marshal(b []byte, keySize uint64) (int, error) {
 	n, err := encoding.PutVarint(b, uint64(len(*v)))
 	if err != nil {
 		return n, err
 	}
+	if len(b)-n < len(*v) {
+		return n, encoding.ErrInsufficientSpace
+	}
 
 	return n + copy(b[n:], *v), nil
 }
 
+func (v *StringKey) Size(keySize uint64) int {
+	return encoding.VarintSize(uint64(len(*v))) + len(*v)
+}
+
+// marshalRawKey writes the key padded with zero bytes to the key size.
+func marshalRawKey(b []byte, key []byte, keySize uint64) (int, error) {
+	if uint64(len(key)) > keySize {
+		return 0, fmt.Errorf("key exceeds key size: %d > %d", len(key), keySize)
+	}
+	if uint64(len(b)) < keySize {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
+	clear(b[:keySize])
+	copy(b, key)
+	return int(keySize), nil
+}
+
 func (v *BinaryKey) Marshal(b []byte, keySize uint64) (int, error) {
-	return copy(b[:keySize], *v), nil
+	return marshalRawKey(b, *v, keySize)
+}
+
+func (v *BinaryKey) Size(keySize uint64) int {
+	return int(keySize)
+}
+
+func (v *AnyKey) Marshal(b []byte, keySize uint64) (int, error) {
+	return marshalRawKey(b, *v, keySize)
+}
+
+func (v *AnyKey) Size(keySize uint64) int {
+	return int(keySize)
+}
+
+func (v *BooleanKey) Marshal(b []byte, keySize uint64) (int, error) {
+	if uint64(len(b)) < keySize {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
+	clear(b[:keySize])
+	if *v && keySize > 0 {
+		b[0] = 1
+	}
+	return int(keySize), nil
+}
+
+func (v *BooleanKey) Size(keySize uint64) int {
+	return int(keySize)
+}
+
+func (v *AddressKey) Marshal(b []byte, keySize uint64) (int, error) {
+	switch keySize {
+	case 4:
+		k := IPv4AddressKey(*v)
+		return k.Marshal(b, keySize)
+	case 16:
+		k := IPv6AddressKey(*v)
+		return k.Marshal(b, keySize)
+	default:
+		return 0, fmt.Errorf("invalid address key size: %d", keySize)
+	}
+}
+
+func (v *AddressKey) Size(keySize uint64) int {
+	return int(keySize)
+}
+
+func (v *MethodKey) Marshal(b []byte, keySize uint64) (int, error) {
+	if uint64(len(*v)) > keySize {
+		return 0, fmt.Errorf("method key exceeds key size: %d > %d", len(*v), keySize)
+	}
+
+	if uint64(len(b)) < keySize {
+		return 0, encoding.ErrInsufficientSpace
+	}
+
+	clear(b[:keySize])
+	copy(b, *v)
+	return int(keySize), nil
+}
+
+func (v *MethodKey) Size(keySize uint64) int {
+	return int(keySize)
 }
 
 func (f *FreqData) Marshal(b []byte) (int, error) {
@@ -292,43 +596,177 @@ func (f *FreqData) Marshal(b []byte) (int, error) {
 	return offset, nil
 }
 
+func (f *FreqData) Size() int {
+	return encoding.VarintSize(f.CurrentTick) +
+		encoding.VarintSize(f.CurrentPeriod) +
+		encoding.VarintSize(f.LastPeriod)
+}
+
 func (v *SignedIntegerData) Marshal(b []byte) (int, error) {
 	return encoding.PutVarint(b, uint64(*v))
 }
 
+func (v *SignedIntegerData) Size() int {
+	return encoding.VarintSize(uint64(*v))
+}
+
 func (v *UnsignedIntegerData) Marshal(b []byte) (int, error) {
 	return encoding.PutVarint(b, uint64(*v))
 }
 
+func (v *UnsignedIntegerData) Size() int {
+	return encoding.VarintSize(uint64(*v))
+}
+
 func (v *UnsignedLongLongData) Marshal(b []byte) (int, error) {
 	return encoding.PutVarint(b, uint64(*v))
 }
 
+func (v *UnsignedLongLongData) Size() int {
+	return encoding.VarintSize(uint64(*v))
+}
+
 func (f *DictData) Marshal(b []byte) (int, error) {
-	var offset int
+	// No entry
+	if f.ID == 0 {
+		return encoding.PutVarint(b, 0)
+	}
 
-	n, err := encoding.PutVarint(b[offset:], uint64(len(f.Value)))
-	offset += n
+	// The dictionary data is prefixed with its length in bytes, so the ID and
+	// the value are encoded into a scratch buffer first.
+	var scratch [20]byte
+	dataLength, err := encoding.PutVarint(scratch[:], f.ID)
 	if err != nil {
-		return offset, err
+		return 0, err
+	}
+
+	if len(f.Value) > 0 {
+		n, err := encoding.PutVarint(scratch[dataLength:], uint64(len(f.Value)))
+		if err != nil {
+			return 0, err
+		}
+		dataLength += n
 	}
 
-	n, err = encoding.PutVarint(b[offset:], uint64(f.ID))
+	var offset int
+	n, err := encoding.PutVarint(b[offset:], uint64(dataLength+len(f.Value)))
 	offset += n
 	if err != nil {
 		return offset, err
 	}
 
+	if len(b)-offset < dataLength+len(f.Value) {
+		return offset, encoding.ErrInsufficientSpace
+	}
+
+	offset += copy(b[offset:], scratch[:dataLength])
+	offset += copy(b[offset:], f.Value)
+
+	return offset, nil
+}
+
+func (f *DictData) Size() int {
+	if f.ID == 0 {
+		return 1
+	}
+
+	dataLength := encoding.VarintSize(f.ID)
 	if len(f.Value) > 0 {
-		n, err := encoding.PutVarint(b[offset:], uint64(len(f.Value)))
+		dataLength += encoding.VarintSize(uint64(len(f.Value))) + len(f.Value)
+	}
+
+	return encoding.VarintSize(uint64(dataLength)) + dataLength
+}
+
+// UnsignedIntegerArrayData is an array of unsigned integers as used by
+// gpt and gpc. The elements are encoded one after another, the amount of
+// elements is given by the table definition.
+type UnsignedIntegerArrayData []UnsignedIntegerData
+
+func (v *UnsignedIntegerArrayData) Unmarshal(b []byte) (int, error) {
+	var offset int
+	for i := range *v {
+		n, err := (*v)[i].Unmarshal(b[offset:])
 		offset += n
 		if err != nil {
 			return offset, err
 		}
+	}
 
-		copy(b[offset:], f.Value)
-		offset += len(f.Value)
+	return offset, nil
+}
+
+func (v *UnsignedIntegerArrayData) Marshal(b []byte) (int, error) {
+	var offset int
+	for i := range *v {
+		n, err := (*v)[i].Marshal(b[offset:])
+		offset += n
+		if err != nil {
+			return offset, err
+		}
 	}
 
 	return offset, nil
 }
+
+func (v *UnsignedIntegerArrayData) Size() int {
+	var size int
+	for i := range *v {
+		size += (*v)[i].Size()
+	}
+
+	return size
+}
+
+func (v *UnsignedIntegerArrayData) String() string {
+	return fmt.Sprintf("%v", []UnsignedIntegerData(*v))
+}
+
+// FreqArrayData is an array of frequency counters as used by gpc_rate.
+// The elements are encoded one after another, the amount of elements is
+// given by the table definition.
+type FreqArrayData []FreqData
+
+func (v *FreqArrayData) Unmarshal(b []byte) (int, error) {
+	var offset int
+	for i := range *v {
+		n, err := (*v)[i].Unmarshal(b[offset:])
+		offset += n
+		if err != nil {
+			return offset, err
+		}
+	}
+
+	return offset, nil
+}
+
+func (v *FreqArrayData) Marshal(b []byte) (int, error) {
+	var offset int
+	for i := range *v {
+		n, err := (*v)[i].Marshal(b[offset:])
+		offset += n
+		if err != nil {
+			return offset, err
+		}
+	}
+
+	return offset, nil
+}
+
+func (v *FreqArrayData) Size() int {
+	var size int
+	for i := range *v {
+		size += (*v)[i].Size()
+	}
+
+	return size
+}
+
+func (v *FreqArrayData) String() string {
+	s := make([]string, len(*v))
+	for i := range *v {
+		s[i] = (*v)[i].String()
+	}
+
+	return "[" + strings.Join(s, " ") + "]"
+}
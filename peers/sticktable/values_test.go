@@ -1,9 +1,13 @@
 package sticktable
 
 import (
+	"errors"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -105,6 +109,97 @@ func TestMarshalUnmarshalValues(t *testing.T) {
 			}
 		})
 
+		t.Run("AnyKey", func(t *testing.T) {
+			in := AnyKey("foobar")
+			var out AnyKey
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b, uint64(len(in)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = out.Unmarshal(b[:n], uint64(len(in)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+		t.Run("BooleanKey", func(t *testing.T) {
+			in := BooleanKey(true)
+			var out BooleanKey
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = out.Unmarshal(b[:n], 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+		t.Run("AddressKey", func(t *testing.T) {
+			for _, tc := range []struct {
+				addr    string
+				keySize uint64
+			}{
+				{"127.0.0.1", 4},
+				{"fe80::1", 16},
+			} {
+				in := AddressKey(netip.MustParseAddr(tc.addr))
+				var out AddressKey
+
+				b := make([]byte, 256)
+				n, err := in.Marshal(b, tc.keySize)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = out.Unmarshal(b[:n], tc.keySize)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if in != out {
+					t.Errorf("Unmarshal() mismatch:\n%v != %v", in, out)
+				}
+			}
+		})
+		t.Run("MethodKey", func(t *testing.T) {
+			in := MethodKey("GET")
+			var out MethodKey
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = out.Unmarshal(b[:n], 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+		t.Run("ShortBuffer", func(t *testing.T) {
+			for kt := KeyTypeAny; kt <= KeyTypeMethod; kt++ {
+				if _, err := kt.New().Unmarshal([]byte{1}, 16); err == nil {
+					t.Errorf("%s: expected error for short buffer", kt)
+				}
+			}
+		})
 	})
 
 	t.Run("MapData", func(t *testing.T) {
@@ -213,5 +308,193 @@ func TestMarshalUnmarshalValues(t *testing.T) {
 				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
 			}
 		})
+
+		t.Run("UnsignedIntegerArrayData", func(t *testing.T) {
+			in := UnsignedIntegerArrayData{1, 1337, 0}
+			out := make(UnsignedIntegerArrayData, len(in))
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = out.Unmarshal(b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("FreqArrayData", func(t *testing.T) {
+			in := FreqArrayData{
+				{CurrentTick: 1, CurrentPeriod: 2, LastPeriod: 3},
+				{CurrentTick: 4, CurrentPeriod: 5, LastPeriod: 6},
+			}
+			out := make(FreqArrayData, len(in))
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = out.Unmarshal(b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("DictDataReference", func(t *testing.T) {
+			in := DictData{ID: 5}
+			var out DictData
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != 2 {
+				t.Errorf("expected 2 bytes for an id only reference, got %d", n)
+			}
+
+			_, err = out.Unmarshal(b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("DictDataNoEntry", func(t *testing.T) {
+			in := DictData{}
+			out := DictData{}
+
+			b := make([]byte, 256)
+			n, err := in.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := out.Unmarshal(b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != 1 || m != 1 {
+				t.Errorf("expected a single byte, got %d/%d", n, m)
+			}
+		})
 	})
 }
+
+func TestMarshalSize(t *testing.T) {
+	keys := []struct {
+		name    string
+		key     MapKey
+		keySize uint64
+	}{
+		{"SignedIntegerKey", ptr(SignedIntegerKey(-1)), 4},
+		{"IPv4AddressKey", ptr(IPv4AddressKey(netip.MustParseAddr("127.0.0.1"))), 4},
+		{"IPv6AddressKey", ptr(IPv6AddressKey(netip.MustParseAddr("fe80::1"))), 16},
+		{"StringKey", ptr(StringKey(strings.Repeat("a", 300))), 0},
+		{"BinaryKey", ptr(BinaryKey{1, 2, 3}), 8},
+		{"AnyKey", ptr(AnyKey{1}), 4},
+		{"BooleanKey", ptr(BooleanKey(true)), 2},
+		{"AddressKey", ptr(AddressKey(netip.MustParseAddr("fe80::1"))), 16},
+		{"MethodKey", ptr(MethodKey("GET")), 8},
+	}
+
+	for _, tt := range keys {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.key.Size(tt.keySize)
+			n, err := tt.key.Marshal(make([]byte, size), tt.keySize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Errorf("Size() = %d, Marshal() wrote %d bytes", size, n)
+			}
+
+			for l := 0; l < size; l++ {
+				if _, err := tt.key.Marshal(make([]byte, l), tt.keySize); !errors.Is(err, encoding.ErrInsufficientSpace) {
+					t.Fatalf("Marshal() into %d bytes: expected ErrInsufficientSpace, got %v", l, err)
+				}
+			}
+		})
+	}
+
+	data := []struct {
+		name string
+		data MapData
+	}{
+		{"FreqData", &FreqData{CurrentTick: 1 << 40, CurrentPeriod: 300, LastPeriod: 1}},
+		{"SignedIntegerData", ptr(SignedIntegerData(-1))},
+		{"UnsignedIntegerData", ptr(UnsignedIntegerData(1 << 31))},
+		{"UnsignedLongLongData", ptr(UnsignedLongLongData(1 << 63))},
+		{"DictData", &DictData{ID: 300, Value: []byte(strings.Repeat("s", 300))}},
+		{"DictDataReference", &DictData{ID: 1}},
+		{"DictDataNoEntry", &DictData{}},
+		{"UnsignedIntegerArrayData", &UnsignedIntegerArrayData{1, 1 << 20, 3}},
+		{"FreqArrayData", &FreqArrayData{{CurrentTick: 1}, {CurrentPeriod: 1 << 20}}},
+	}
+
+	for _, tt := range data {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.data.Size()
+			n, err := tt.data.Marshal(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Errorf("Size() = %d, Marshal() wrote %d bytes", size, n)
+			}
+
+			for l := 0; l < size; l++ {
+				if _, err := tt.data.Marshal(make([]byte, l)); !errors.Is(err, encoding.ErrInsufficientSpace) {
+					t.Fatalf("Marshal() into %d bytes: expected ErrInsufficientSpace, got %v", l, err)
+				}
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestFreqDataRate(t *testing.T) {
+	const period = 10 * time.Second
+
+	tests := []struct {
+		name    string
+		in      FreqData
+		elapsed time.Duration
+		want    uint64
+	}{
+		{"current period only", FreqData{CurrentTick: 2000, CurrentPeriod: 7}, 0, 7},
+		{"half of last period", FreqData{CurrentTick: 5000, CurrentPeriod: 3, LastPeriod: 10}, 0, 8},
+		{"elapsed since receiving", FreqData{CurrentTick: 2000, CurrentPeriod: 3, LastPeriod: 10}, 3 * time.Second, 8},
+		{"rotated period", FreqData{CurrentTick: 9000, CurrentPeriod: 10, LastPeriod: 20}, 3 * time.Second, 8},
+		{"expired", FreqData{CurrentTick: 9000, CurrentPeriod: 10, LastPeriod: 20}, 11 * time.Second, 0},
+		{"desired rate", NewFreqData(42), 0, 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.in.Rate(period, tt.elapsed); got != tt.want {
+				t.Errorf("Rate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
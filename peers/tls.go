@@ -0,0 +1,70 @@
+package peers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+)
+
+// PeerCertificate returns the verified certificate of the remote peer in
+// calls to functions in a Handler. It returns nil if the session does not
+// use TLS or the remote peer did not present a verified certificate.
+func PeerCertificate(ctx context.Context) *x509.Certificate {
+	tc, ok := ctx.Value(connectionKey).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// certificateIdentities returns the identities of a certificate matched
+// against CertificatePeers.
+func certificateIdentities(cert *x509.Certificate) []string {
+	ids := make([]string, 0, 1+len(cert.DNSNames))
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+// tlsHandshake runs the TLS handshake of the session, if it uses TLS,
+// within the dead peer timeout.
+func (c *protocolClient) tlsHandshake() error {
+	tc, ok := c.ctx.Value(connectionKey).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.deadPeerTimeout())
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("tls handshake: %w", err)
+	}
+	return nil
+}
+
+// verifyCertificate checks that the certificate of the remote peer is
+// mapped to its name by CertificatePeers.
+func (c *protocolClient) verifyCertificate(name string) error {
+	if c.peer.CertificatePeers == nil {
+		return nil
+	}
+
+	cert := PeerCertificate(c.ctx)
+	if cert == nil {
+		return fmt.Errorf("peer %q: no verified certificate", name)
+	}
+	for _, id := range certificateIdentities(cert) {
+		if slices.Contains(c.peer.CertificatePeers[id], name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %q: certificate %q not allowed", name, cert.Subject.CommonName)
+}
@@ -0,0 +1,144 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/testutil"
+)
+
+// serveTLS serves the peer on a local TLS listener and returns its address.
+func serveTLS(t *testing.T, p *Peer) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go p.Serve(l)
+	return l.Addr().String()
+}
+
+func TestPeerTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ca := testutil.NewCA(t)
+
+	serverCerts := make(chan string, 1)
+	server := &Peer{
+		BaseContext: ctx,
+		Name:        "server",
+		TLSConfig:   ca.ServerConfig(t, "server.example"),
+		CertificatePeers: map[string][]string{
+			"client.example": {"client"},
+		},
+		Handler: &testHandler{
+			onHandshake: func(ctx context.Context, h *Handshake) {
+				serverCerts <- PeerCertificate(ctx).Subject.CommonName
+			},
+		},
+	}
+	addr := serveTLS(t, server)
+
+	clientCerts := make(chan string, 1)
+	client := &Peer{
+		Name:      "client",
+		TLSConfig: ca.ClientConfig(t, "client.example"),
+		CertificatePeers: map[string][]string{
+			"server.example": {"server"},
+		},
+		Handler: &testHandler{
+			onHandshake: func(ctx context.Context, h *Handshake) {
+				clientCerts <- PeerCertificate(ctx).Subject.CommonName
+			},
+		},
+	}
+
+	clientCtx, clientCancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- client.DialAndServe(clientCtx, addr, "server") }()
+
+	for _, tt := range []struct {
+		certs chan string
+		want  string
+	}{
+		{serverCerts, "client.example"},
+		{clientCerts, "server.example"},
+	} {
+		select {
+		case cn := <-tt.certs:
+			if cn != tt.want {
+				t.Errorf("expected certificate %q, got %q", tt.want, cn)
+			}
+		case err := <-done:
+			t.Fatalf("session ended: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for handshake")
+		}
+	}
+
+	clientCancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error after cancel, got %v", err)
+	}
+}
+
+func TestPeerTLSRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ca := testutil.NewCA(t)
+	server := &Peer{
+		BaseContext: ctx,
+		Name:        "server",
+		TLSConfig:   ca.ServerConfig(t, "server.example"),
+		CertificatePeers: map[string][]string{
+			"client.example": {"client"},
+		},
+		Handler: &testHandler{},
+	}
+	addr := serveTLS(t, server)
+
+	t.Run("unmapped name", func(t *testing.T) {
+		client := &Peer{
+			Name:      "other",
+			TLSConfig: ca.ClientConfig(t, "client.example"),
+			Handler:   &testHandler{},
+		}
+		err := client.DialAndServe(ctx, addr, "server")
+		if !errors.Is(err, HandshakeStatusRemotePeerIdentifierMismatch) {
+			t.Errorf("expected %v, got %v", HandshakeStatusRemotePeerIdentifierMismatch, err)
+		}
+	})
+
+	t.Run("unmapped server", func(t *testing.T) {
+		client := &Peer{
+			Name:      "client",
+			TLSConfig: ca.ClientConfig(t, "client.example"),
+			CertificatePeers: map[string][]string{
+				"server.example": {"another"},
+			},
+			Handler: &testHandler{},
+		}
+		if err := client.DialAndServe(ctx, addr, "server"); err == nil {
+			t.Error("expected error for unmapped server certificate")
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		client := &Peer{
+			Name:      "client",
+			TLSConfig: ca.ClientConfig(t, ""),
+			Handler:   &testHandler{},
+		}
+		if err := client.DialAndServe(ctx, addr, "server"); err == nil {
+			t.Error("expected error without client certificate")
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 
 	"github.com/dropmorepackets/haproxy-go/peers/sticktable"
@@ -14,23 +15,54 @@ import (
 // Writer sends stick table updates over an existing peer connection.
 // It is safe for concurrent use. Obtain a Writer from a handler's context
 // using WriterFromContext.
+//
+// The Writer keeps track of the table definitions sent on the session and
+// assigns their table IDs. Before an entry of a table is written, the
+// definition is sent if it is new or changed, or a table switch if another
+// table was written last. A Writer belongs to a single session, after a
+// reconnect the Writer of the new session sends the definitions again.
 type Writer struct {
 	bw  *bufio.Writer
 	mu  *sync.Mutex
-	buf []byte // reusable scratch buffer for marshaling
+	buf []byte // reusable scratch buffer for marshaling, see grow
 
+	dictCache    dictTxCache
 	nextUpdateID uint32
+
+	// tables holds the tables sent on the session by their name.
+	tables      map[string]*txTable
+	nextTableID uint64
+	// currentTable is the ID of the table the remote peer applies
+	// updates to, zero if none was selected yet.
+	currentTable uint64
+}
+
+// txTable is a table whose definition was sent on the session.
+type txTable struct {
+	def sticktable.Definition
+	// lastUpdateID is the ID of the last update sent for the table, only
+	// valid if updated is set.
+	lastUpdateID uint32
+	updated      bool
 }
 
 func newWriter(w io.Writer, mu *sync.Mutex) *Writer {
 	bw := bufio.NewWriterSize(w, 64*1024)
 	return &Writer{
-		bw:  bw,
-		mu:  mu,
-		buf: make([]byte, 65536),
+		bw: bw,
+		mu: mu,
 	}
 }
 
+// grow returns the scratch buffer with a length of n bytes, growing it if
+// necessary. Caller MUST hold the mutex.
+func (w *Writer) grow(n int) []byte {
+	if cap(w.buf) < n {
+		w.buf = make([]byte, n)
+	}
+	return w.buf[:n]
+}
+
 // bufferedWriter returns the underlying bufio.Writer so the protocol
 // client can share the same buffered output (under the shared mutex).
 func (w *Writer) bufferedWriter() *bufio.Writer {
@@ -45,16 +77,8 @@ func (w *Writer) Flush() error {
 	return w.bw.Flush()
 }
 
-// writeMessage writes a peer protocol message. Messages with type >= 128
+// writeMessageLocked writes a peer protocol message. Messages with type >= 128
 // include a varint-encoded data length prefix before the payload.
-// Caller must NOT hold the mutex — this method acquires it.
-func (w *Writer) writeMessage(class MessageClass, msgType byte, data []byte) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	return w.writeMessageLocked(class, msgType, data)
-}
-
-// writeMessageLocked writes a peer protocol message.
 // Caller MUST hold the mutex.
 func (w *Writer) writeMessageLocked(class MessageClass, msgType byte, data []byte) error {
 	var lenBuf [10]byte
@@ -89,17 +113,46 @@ func (w *Writer) writeMessageLocked(class MessageClass, msgType byte, data []byt
 	return nil
 }
 
-// SendTableDefinition sends a stick table definition message.
-// This must be called before sending entry updates for a table so
-// that the remote peer knows which table the updates refer to.
+// SendTableDefinition sends a stick table definition message, even if the
+// definition was sent before. Sending definitions is optional, as SendEntry
+// and SendEntries send them when needed. The StickTableID of def is
+// ignored, the table ID is assigned by the Writer.
 func (w *Writer) SendTableDefinition(def *sticktable.Definition) error {
-	var buf [4096]byte
-	n, err := def.Marshal(buf[:])
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sendDefinitionLocked(def); err != nil {
+		return err
+	}
+
+	return w.bw.Flush()
+}
+
+// sendDefinitionLocked registers the definition and sends it.
+// Caller MUST hold the mutex.
+func (w *Writer) sendDefinitionLocked(def *sticktable.Definition) error {
+	if w.tables == nil {
+		w.tables = make(map[string]*txTable)
+	}
+
+	table := w.tables[def.Name]
+	if table == nil {
+		// Table IDs are numbered from 1 like in HAProxy.
+		w.nextTableID++
+		table = &txTable{def: sticktable.Definition{StickTableID: w.nextTableID}}
+	}
+
+	sent := *def
+	sent.StickTableID = table.def.StickTableID
+	sent.DataTypes = slices.Clone(def.DataTypes)
+
+	buf := w.grow(sent.Size())
+	n, err := sent.Marshal(buf)
 	if err != nil {
 		return fmt.Errorf("marshaling table definition: %w", err)
 	}
 
-	if err := w.writeMessage(
+	if err := w.writeMessageLocked(
 		MessageClassStickTableUpdates,
 		byte(StickTableUpdateMessageTypeStickTableDefinition),
 		buf[:n],
@@ -107,19 +160,72 @@ func (w *Writer) SendTableDefinition(def *sticktable.Definition) error {
 		return err
 	}
 
-	return w.Flush()
+	// The remote peer keeps the update IDs of a redefined table.
+	table.def = sent
+	w.tables[sent.Name] = table
+	w.currentTable = sent.StickTableID
+	return nil
+}
+
+// selectTableLocked makes def the table the remote peer applies the
+// following updates to and returns it. Caller MUST hold the mutex.
+func (w *Writer) selectTableLocked(def *sticktable.Definition) (*txTable, error) {
+	table, ok := w.tables[def.Name]
+	if !ok || !definitionsEqual(&table.def, def) {
+		if err := w.sendDefinitionLocked(def); err != nil {
+			return nil, err
+		}
+		return w.tables[def.Name], nil
+	}
+
+	if w.currentTable == table.def.StickTableID {
+		return table, nil
+	}
+
+	if err := w.sendSwitchLocked(table.def.StickTableID); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// SendSyncRequest asks the remote peer to teach all entries of its tables.
+// The remote peer answers with the entries, followed by a synchronization
+// finished or partial control message.
+func (w *Writer) SendSyncRequest() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writeMessageLocked(MessageClassControl, byte(ControlMessageSyncRequest), nil); err != nil {
+		return err
+	}
+
+	return w.bw.Flush()
 }
 
 // SendTableSwitch sends a table switch message to select a previously
-// defined table by its sender table ID.
+// defined table by its sender table ID. Sending switches is optional, as
+// SendEntry and SendEntries send them when needed.
 func (w *Writer) SendTableSwitch(tableID uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sendSwitchLocked(tableID); err != nil {
+		return err
+	}
+
+	return w.bw.Flush()
+}
+
+// sendSwitchLocked sends a table switch message.
+// Caller MUST hold the mutex.
+func (w *Writer) sendSwitchLocked(tableID uint64) error {
 	var buf [10]byte
 	n, err := encoding.PutVarint(buf[:], tableID)
 	if err != nil {
 		return fmt.Errorf("encoding table ID: %w", err)
 	}
 
-	if err := w.writeMessage(
+	if err := w.writeMessageLocked(
 		MessageClassStickTableUpdates,
 		byte(StickTableUpdateMessageTypeStickTableSwitch),
 		buf[:n],
@@ -127,17 +233,49 @@ func (w *Writer) SendTableSwitch(tableID uint64) error {
 		return err
 	}
 
-	return w.Flush()
+	w.currentTable = tableID
+	return nil
+}
+
+// entrySize returns the exact size of the entry update as marshaled by
+// marshalEntry. Caller MUST hold the mutex.
+func (w *Writer) entrySize(entry *sticktable.EntryUpdate, withUpdateID bool) int {
+	var size int
+	if withUpdateID {
+		size += 4
+	}
+	if entry.WithExpiry {
+		size += 4
+	}
+
+	size += entry.Key.Size(entry.StickTable.KeyLength)
+	for _, data := range entry.Data {
+		if d, ok := data.(*sticktable.DictData); ok {
+			cached, _ := w.dictCache.peek(d)
+			size += cached.Size()
+			continue
+		}
+
+		size += data.Size()
+	}
+
+	return size
 }
 
-// marshalEntry marshals a single entry update into buf and returns the
-// byte count. The updateID is written first, followed by optional expiry,
-// key and data values.
-func marshalEntry(buf []byte, entry *sticktable.EntryUpdate, updateID uint32) (int, error) {
+// marshalEntry marshals a single entry update into the scratch buffer and
+// returns it. The updateID is written first unless the update is
+// incremental, followed by optional expiry, key and data values. Dictionary
+// values are encoded against the session's dictionary cache, new values are
+// pending until the caller commits or discards them.
+// Caller MUST hold the mutex.
+func (w *Writer) marshalEntry(entry *sticktable.EntryUpdate, updateID uint32, incremental bool) ([]byte, error) {
+	buf := w.grow(w.entrySize(entry, !incremental))
 	offset := 0
 
-	binary.BigEndian.PutUint32(buf[offset:], updateID)
-	offset += 4
+	if !incremental {
+		binary.BigEndian.PutUint32(buf[offset:], updateID)
+		offset += 4
+	}
 
 	if entry.WithExpiry {
 		binary.BigEndian.PutUint32(buf[offset:], entry.Expiry)
@@ -147,55 +285,45 @@ func marshalEntry(buf []byte, entry *sticktable.EntryUpdate, updateID uint32) (i
 	n, err := entry.Key.Marshal(buf[offset:], entry.StickTable.KeyLength)
 	offset += n
 	if err != nil {
-		return offset, fmt.Errorf("marshaling entry key: %w", err)
+		return nil, fmt.Errorf("marshaling entry key: %w", err)
 	}
 
 	for _, data := range entry.Data {
+		if d, ok := data.(*sticktable.DictData); ok {
+			cached := w.dictCache.encode(d)
+			data = &cached
+		}
+
 		n, err := data.Marshal(buf[offset:])
 		offset += n
 		if err != nil {
-			return offset, fmt.Errorf("marshaling entry data: %w", err)
+			return nil, fmt.Errorf("marshaling entry data: %w", err)
 		}
 	}
 
-	return offset, nil
+	return buf[:offset], nil
 }
 
 // SendEntry sends a stick table entry update with an automatically
-// assigned update ID. The message type is chosen based on the entry's
-// WithExpiry flag:
-//   - WithExpiry=false: Entry Update (0x80)
-//   - WithExpiry=true:  Update Timed (0x85)
+// assigned update ID. The table definition or a table switch is sent
+// before the entry if needed. Dictionary values (server_key) are sent in
+// full only the first time and referenced by ID afterwards, so the ID of a
+// DictData is assigned by the Writer. The message type is chosen based on
+// the entry's WithExpiry flag and whether the update ID directly follows
+// the one of the previous update of the table, which makes it implicit:
+//   - WithExpiry=false: Entry Update (0x80) or Incremental Entry Update (0x81)
+//   - WithExpiry=true:  Update Timed (0x85) or Incremental Update Timed (0x86)
 //
 // Note: for bulk operations, prefer SendEntries which batches writes and flushes once.
 func (w *Writer) SendEntry(entry *sticktable.EntryUpdate) error {
 	w.mu.Lock()
-	updateID := w.nextUpdateID
-	w.nextUpdateID++
-
-	msgType := StickTableUpdateMessageTypeEntryUpdate
-	if entry.WithExpiry {
-		msgType = StickTableUpdateMessageTypeUpdateTimed
-	}
-
-	offset, err := marshalEntry(w.buf, entry, updateID)
-	if err != nil {
-		w.mu.Unlock()
-		return fmt.Errorf("marshaling entry update: %w", err)
-	}
+	defer w.mu.Unlock()
 
-	if err = w.writeMessageLocked(
-		MessageClassStickTableUpdates,
-		byte(msgType),
-		w.buf[:offset],
-	); err != nil {
-		w.mu.Unlock()
+	if err := w.sendEntryLocked(entry); err != nil {
 		return err
 	}
 
-	err = w.bw.Flush()
-	w.mu.Unlock()
-	return err
+	return w.bw.Flush()
 }
 
 // SendEntries sends multiple stick table entry updates in a single
@@ -207,27 +335,57 @@ func (w *Writer) SendEntries(entries []*sticktable.EntryUpdate) error {
 	defer w.mu.Unlock()
 
 	for _, entry := range entries {
-		updateID := w.nextUpdateID
-		w.nextUpdateID++
-
-		msgType := StickTableUpdateMessageTypeEntryUpdate
-		if entry.WithExpiry {
-			msgType = StickTableUpdateMessageTypeUpdateTimed
-		}
-
-		offset, err := marshalEntry(w.buf, entry, updateID)
-		if err != nil {
-			return fmt.Errorf("marshaling entry update: %w", err)
-		}
-
-		if err := w.writeMessageLocked(
-			MessageClassStickTableUpdates,
-			byte(msgType),
-			w.buf[:offset],
-		); err != nil {
+		if err := w.sendEntryLocked(entry); err != nil {
 			return err
 		}
 	}
 
 	return w.bw.Flush()
 }
+
+// sendEntryLocked writes a single entry update, preceded by its table
+// definition or a table switch if needed. Caller MUST hold the mutex.
+func (w *Writer) sendEntryLocked(entry *sticktable.EntryUpdate) error {
+	table, err := w.selectTableLocked(entry.StickTable)
+	if err != nil {
+		return err
+	}
+
+	// The update ID is only used up once the entry was written, so a
+	// failed entry leaves no gap in the update IDs of the table.
+	updateID := w.nextUpdateID
+	incremental := table.updated && updateID == table.lastUpdateID+1
+
+	var msgType StickTableUpdateMessageType
+	switch {
+	case incremental && entry.WithExpiry:
+		msgType = StickTableUpdateMessageTypeIncrementalEntryUpdateTimed
+	case incremental:
+		msgType = StickTableUpdateMessageTypeIncrementalEntryUpdate
+	case entry.WithExpiry:
+		msgType = StickTableUpdateMessageTypeUpdateTimed
+	default:
+		msgType = StickTableUpdateMessageTypeEntryUpdate
+	}
+
+	buf, err := w.marshalEntry(entry, updateID, incremental)
+	if err != nil {
+		w.dictCache.discard()
+		return fmt.Errorf("marshaling entry update: %w", err)
+	}
+
+	if err := w.writeMessageLocked(
+		MessageClassStickTableUpdates,
+		byte(msgType),
+		buf,
+	); err != nil {
+		w.dictCache.discard()
+		return err
+	}
+	w.dictCache.commit()
+
+	w.nextUpdateID++
+	table.lastUpdateID = updateID
+	table.updated = true
+	return nil
+}
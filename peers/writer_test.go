@@ -2,10 +2,13 @@ package peers
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -23,8 +26,7 @@ func helperDialPeer(t *testing.T, addr, localPeer, remotePeer string) net.Conn {
 		t.Fatalf("dialing peer: %v", err)
 	}
 
-	h := NewHandshake(remotePeer)
-	h.LocalPeerIdentifier = localPeer
+	h := NewHandshakeFrom(localPeer, remotePeer)
 	if _, err = h.WriteTo(conn); err != nil {
 		conn.Close()
 		t.Fatalf("writing handshake: %v", err)
@@ -336,6 +338,470 @@ func TestWriterRoundTrip(t *testing.T) {
 	}
 }
 
+// TestWriterDictionaryCache verifies that dictionary values are sent in full
+// only once per session and resolved from the receiving session's cache
+// when referenced by ID.
+func TestWriterDictionaryCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	updates := make(chan *sticktable.EntryUpdate, 10)
+
+	peerB := &Peer{
+		BaseContext: ctx,
+		Handler: HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+			updates <- u
+		}),
+	}
+	go peerB.Serve(l)
+
+	conn := helperDialPeer(t, l.Addr().String(), "peer_a", "peer_b")
+	defer conn.Close()
+
+	w := newWriter(conn, &sync.Mutex{})
+
+	tableDef := &sticktable.Definition{
+		StickTableID: 0,
+		Name:         "dict_table",
+		KeyType:      sticktable.KeyTypeString,
+		KeyLength:    50,
+		DataTypes: []sticktable.DataTypeDefinition{
+			{DataType: sticktable.DataTypeServerKey},
+		},
+		Expiry: 600000,
+	}
+
+	if err := w.SendTableDefinition(tableDef); err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{"srv1", "srv1", "srv2", "srv1"}
+	for i, v := range values {
+		key := sticktable.StringKey(fmt.Sprintf("key_%d", i))
+		entry := &sticktable.EntryUpdate{
+			StickTable: tableDef,
+			Key:        &key,
+			Data:       []sticktable.MapData{&sticktable.DictData{Value: []byte(v)}},
+		}
+
+		if err := w.SendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(w.dictCache.ids); got != 2 {
+		t.Errorf("expected 2 cached dictionary entries, got %d", got)
+	}
+
+	for i, want := range values {
+		select {
+		case u := <-updates:
+			got := u.Data[0].(*sticktable.DictData)
+			if string(got.Value) != want {
+				t.Errorf("update %d: expected server_key %q, got %q", i, want, got.Value)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for dictionary update")
+		}
+	}
+}
+
+func TestDictTxCacheEviction(t *testing.T) {
+	var c dictTxCache
+	for i := 0; i < dictCacheSize+1; i++ {
+		d := c.encode(&sticktable.DictData{Value: []byte(fmt.Sprintf("srv%d", i))})
+		if want := uint64(i%dictCacheSize) + 1; d.ID != want {
+			t.Fatalf("entry %d: expected id %d, got %d", i, want, d.ID)
+		}
+		c.commit()
+	}
+
+	// The first entry was replaced and has to be sent in full again.
+	if d := c.encode(&sticktable.DictData{Value: []byte("srv0")}); d.Value == nil {
+		t.Errorf("expected evicted entry to be sent with value, got id only %d", d.ID)
+	}
+
+	// The last entry is still cached and only referenced by ID.
+	if d := c.encode(&sticktable.DictData{Value: []byte(fmt.Sprintf("srv%d", dictCacheSize))}); d.Value != nil || d.ID != 1 {
+		t.Errorf("expected id only reference 1, got %d: %q", d.ID, d.Value)
+	}
+}
+
+// failingData is a data value that cannot be marshaled.
+type failingData struct{ sticktable.UnsignedIntegerData }
+
+func (failingData) Marshal([]byte) (int, error) { return 0, errors.New("failing data") }
+
+// TestWriterDictFailedEntry verifies that dictionary values of an entry that
+// was not written are not considered sent.
+func TestWriterDictFailedEntry(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	def := &sticktable.Definition{
+		Name:      "dict_table",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 50,
+		DataTypes: []sticktable.DataTypeDefinition{
+			{DataType: sticktable.DataTypeServerKey},
+			{DataType: sticktable.DataTypeGPC0},
+		},
+	}
+
+	server := &sticktable.DictData{Value: []byte("srv1")}
+	key := sticktable.StringKey("key")
+	entry := &sticktable.EntryUpdate{
+		StickTable: def,
+		Key:        &key,
+		Data:       []sticktable.MapData{server, &failingData{}},
+	}
+	if err := w.SendEntry(entry); err == nil {
+		t.Fatal("expected entry with failing data to fail")
+	}
+	if _, known := w.dictCache.peek(server); known {
+		t.Fatal("value of failed entry is cached")
+	}
+
+	var gpc0 sticktable.UnsignedIntegerData
+	entry.Data[1] = &gpc0
+	if err := w.SendEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	if d, known := w.dictCache.peek(server); !known || d.ID != 1 {
+		t.Errorf("expected value to be cached with id 1, got %d", d.ID)
+	}
+}
+
+// TestWriterLargeMessages verifies that the Writer sizes its buffers by the
+// encoded size instead of a fixed limit.
+func TestWriterLargeMessages(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	def := &sticktable.Definition{
+		StickTableID: 1,
+		Name:         strings.Repeat("t", 8192),
+		KeyType:      sticktable.KeyTypeString,
+		KeyLength:    1 << 20,
+		DataTypes: []sticktable.DataTypeDefinition{
+			{DataType: sticktable.DataTypeServerKey},
+			{DataType: sticktable.DataTypeGPCArray, Elements: 1024},
+		},
+	}
+	if err := w.SendTableDefinition(def); err != nil {
+		t.Fatal(err)
+	}
+
+	key := sticktable.StringKey(strings.Repeat("k", 100000))
+	dict := sticktable.DictData{Value: []byte(strings.Repeat("s", 1000))}
+	gpc := make(sticktable.UnsignedIntegerArrayData, 1024)
+	for i := range gpc {
+		gpc[i] = 1 << 31
+	}
+	if err := w.SendEntry(&sticktable.EntryUpdate{
+		StickTable: def,
+		Key:        &key,
+		Data:       []sticktable.MapData{&dict, &gpc},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(&stream)
+	var m rawMessage
+	if _, err := m.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotDef sticktable.Definition
+	if _, err := gotDef.Unmarshal(m.Data); err != nil {
+		t.Fatal(err)
+	}
+	if gotDef.Name != def.Name {
+		t.Errorf("expected table name of %d bytes, got %d bytes", len(def.Name), len(gotDef.Name))
+	}
+
+	if _, err := m.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	e := sticktable.EntryUpdate{StickTable: def, WithLocalUpdateID: true}
+	if _, err := e.Unmarshal(m.Data); err != nil {
+		t.Fatal(err)
+	}
+	if e.Key.String() != string(key) {
+		t.Errorf("expected key of %d bytes, got %d bytes", len(key), len(e.Key.String()))
+	}
+	if v, _ := e.Dict(sticktable.DataTypeServerKey); !bytes.Equal(v, dict.Value) {
+		t.Errorf("expected dict value of %d bytes, got %d bytes", len(dict.Value), len(v))
+	}
+	if diff := cmp.Diff(&gpc, e.Data[1]); diff != "" {
+		t.Errorf("gpc mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriterTableManagement(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	newDef := func(name string) *sticktable.Definition {
+		return &sticktable.Definition{
+			StickTableID: 42,
+			Name:         name,
+			KeyType:      sticktable.KeyTypeString,
+			KeyLength:    32,
+			DataTypes:    []sticktable.DataTypeDefinition{{DataType: sticktable.DataTypeGPC0}},
+		}
+	}
+	a, b := newDef("st_a"), newDef("st_b")
+	changed := newDef("st_a")
+	changed.Expiry = 1000
+
+	for _, def := range []*sticktable.Definition{a, a, b, a, changed, b} {
+		key := sticktable.StringKey("key")
+		v := sticktable.UnsignedIntegerData(1)
+		if err := w.SendEntry(&sticktable.EntryUpdate{
+			StickTable: def,
+			Key:        &key,
+			Data:       []sticktable.MapData{&v},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	br := bufio.NewReader(&stream)
+	for br.Buffered() > 0 || stream.Len() > 0 {
+		var m rawMessage
+		if _, err := m.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+
+		switch StickTableUpdateMessageType(m.MessageType) {
+		case StickTableUpdateMessageTypeStickTableDefinition:
+			var def sticktable.Definition
+			if _, err := def.Unmarshal(m.Data); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("define %s=%d", def.Name, def.StickTableID))
+		case StickTableUpdateMessageTypeStickTableSwitch:
+			got = append(got, fmt.Sprintf("switch %d", m.Data[0]))
+		default:
+			got = append(got, "update")
+		}
+	}
+
+	want := []string{
+		"define st_a=1", "update",
+		"update",
+		"define st_b=2", "update",
+		"switch 1", "update",
+		"define st_a=1", "update",
+		"switch 2", "update",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+
+	if a.StickTableID != 42 {
+		t.Errorf("definition of the caller was modified")
+	}
+}
+
+// TestWriterIncrementalUpdates verifies that consecutive updates of a table
+// omit their update ID and that the receive path restores it.
+func TestWriterIncrementalUpdates(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	a := &sticktable.Definition{Name: "st_a", KeyType: sticktable.KeyTypeString, KeyLength: 32}
+	b := &sticktable.Definition{Name: "st_b", KeyType: sticktable.KeyTypeString, KeyLength: 32}
+
+	var entries []*sticktable.EntryUpdate
+	for i, def := range []*sticktable.Definition{a, a, a, b, a, a} {
+		key := sticktable.StringKey(fmt.Sprintf("key_%d", i))
+		entries = append(entries, &sticktable.EntryUpdate{
+			StickTable: def,
+			Key:        &key,
+			WithExpiry: i == 2,
+			Expiry:     uint32(i * 1000),
+		})
+	}
+	if err := w.SendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	c := newProtocolClient(context.Background(), &Peer{}, &stream, HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+		got = append(got, fmt.Sprintf("%s:%s:%d:%d", u.StickTable.Name, u.Key, u.LocalUpdateID, u.Expiry))
+	}), &sync.Mutex{}, nil)
+	defer c.Close()
+
+	var types []StickTableUpdateMessageType
+	br := bufio.NewReader(&stream)
+	for br.Buffered() > 0 || stream.Len() > 0 {
+		var m rawMessage
+		if _, err := m.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+
+		switch typ := StickTableUpdateMessageType(m.MessageType); typ {
+		case StickTableUpdateMessageTypeStickTableDefinition, StickTableUpdateMessageTypeStickTableSwitch:
+		default:
+			types = append(types, typ)
+		}
+
+		if err := c.messageHandler(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantTypes := []StickTableUpdateMessageType{
+		StickTableUpdateMessageTypeEntryUpdate,
+		StickTableUpdateMessageTypeIncrementalEntryUpdate,
+		StickTableUpdateMessageTypeIncrementalEntryUpdateTimed,
+		StickTableUpdateMessageTypeEntryUpdate,
+		// The update IDs of st_a are not consecutive after st_b.
+		StickTableUpdateMessageTypeEntryUpdate,
+		StickTableUpdateMessageTypeIncrementalEntryUpdate,
+	}
+	if diff := cmp.Diff(wantTypes, types); diff != "" {
+		t.Errorf("message types mismatch (-want +got):\n%s", diff)
+	}
+
+	want := []string{
+		"st_a:key_0:0:0",
+		"st_a:key_1:1:0",
+		"st_a:key_2:2:2000",
+		"st_b:key_3:3:0",
+		"st_a:key_4:4:0",
+		"st_a:key_5:5:0",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("received updates mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestWriterFailedEntryUpdateID verifies that an entry that was not written
+// does not use up an update ID.
+func TestWriterFailedEntryUpdateID(t *testing.T) {
+	var stream bytes.Buffer
+	w := newWriter(&stream, &sync.Mutex{})
+
+	def := &sticktable.Definition{
+		Name:      "st_a",
+		KeyType:   sticktable.KeyTypeString,
+		KeyLength: 32,
+		DataTypes: []sticktable.DataTypeDefinition{{DataType: sticktable.DataTypeGPC0}},
+	}
+
+	for i := 0; i < 3; i++ {
+		key := sticktable.StringKey(fmt.Sprintf("key_%d", i))
+		var data sticktable.MapData = new(sticktable.UnsignedIntegerData)
+		if i == 1 {
+			data = &failingData{}
+		}
+
+		err := w.SendEntry(&sticktable.EntryUpdate{StickTable: def, Key: &key, Data: []sticktable.MapData{data}})
+		if (err != nil) != (i == 1) {
+			t.Fatalf("entry %d: unexpected error %v", i, err)
+		}
+	}
+
+	var got []string
+	c := newProtocolClient(context.Background(), &Peer{}, &stream, HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+		got = append(got, fmt.Sprintf("%s:%d", u.Key, u.LocalUpdateID))
+	}), &sync.Mutex{}, nil)
+	defer c.Close()
+
+	var types []StickTableUpdateMessageType
+	br := bufio.NewReader(&stream)
+	for br.Buffered() > 0 || stream.Len() > 0 {
+		var m rawMessage
+		if _, err := m.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+
+		if typ := StickTableUpdateMessageType(m.MessageType); typ != StickTableUpdateMessageTypeStickTableDefinition {
+			types = append(types, typ)
+		}
+
+		if err := c.messageHandler(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantTypes := []StickTableUpdateMessageType{
+		StickTableUpdateMessageTypeEntryUpdate,
+		StickTableUpdateMessageTypeIncrementalEntryUpdate,
+	}
+	if diff := cmp.Diff(wantTypes, types); diff != "" {
+		t.Errorf("message types mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"key_0:0", "key_2:1"}, got); diff != "" {
+		t.Errorf("received updates mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestWriterTablesAfterReconnect verifies that the Writer of every session
+// sends the definitions and switches the receiving Peer needs.
+func TestWriterTablesAfterReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	updates := make(chan string, 10)
+	peer := &Peer{
+		BaseContext: ctx,
+		Handler: HandlerFunc(func(_ context.Context, u *sticktable.EntryUpdate) {
+			updates <- u.StickTable.Name + ":" + u.Key.String()
+		}),
+	}
+	go peer.Serve(l)
+
+	defs := []*sticktable.Definition{
+		{Name: "st_a", KeyType: sticktable.KeyTypeString, KeyLength: 32},
+		{Name: "st_b", KeyType: sticktable.KeyTypeString, KeyLength: 32},
+	}
+
+	for session := 0; session < 2; session++ {
+		conn := helperDialPeer(t, l.Addr().String(), "peer_a", "peer_b")
+		w := newWriter(conn, &sync.Mutex{})
+
+		var want []string
+		for i, def := range []*sticktable.Definition{defs[0], defs[1], defs[0]} {
+			key := sticktable.StringKey(fmt.Sprintf("s%d_%d", session, i))
+			if err := w.SendEntry(&sticktable.EntryUpdate{StickTable: def, Key: &key}); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, def.Name+":"+string(key))
+		}
+
+		for _, want := range want {
+			select {
+			case got := <-updates:
+				if got != want {
+					t.Errorf("expected update %q, got %q", want, got)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timeout waiting for update %q", want)
+			}
+		}
+
+		conn.Close()
+	}
+}
+
 // testHandler is a Handler implementation for testing that allows
 // overriding individual methods.
 type testHandler struct {
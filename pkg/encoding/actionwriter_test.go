@@ -11,7 +11,7 @@ func TestActionWriter(t *testing.T) {
 	buf := make([]byte, 16386)
 
 	const exampleKey, exampleValue = "key", "value"
-	testutil.WithoutAllocations(t, func() {
+	write := func() {
 		aw := NewActionWriter(buf, 0)
 
 		if err := aw.SetString(VarScopeTransaction, exampleKey, exampleValue); err != nil {
@@ -19,6 +19,11 @@ func TestActionWriter(t *testing.T) {
 		}
 
 		buf = aw.Bytes()
+	}
+
+	write()
+	t.Run("without allocations", func(t *testing.T) {
+		testutil.WithoutAllocations(t, write)
 	})
 
 	const expectedValue = "010302036b6579080576616c7565"
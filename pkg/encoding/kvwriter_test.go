@@ -11,7 +11,7 @@ func TestKVWriter(t *testing.T) {
 	buf := make([]byte, 16386)
 
 	const exampleKey, exampleValue = "key", "value"
-	testutil.WithoutAllocations(t, func() {
+	write := func() {
 		aw := NewKVWriter(buf, 0)
 
 		if err := aw.SetString(exampleKey, exampleValue); err != nil {
@@ -19,6 +19,11 @@ func TestKVWriter(t *testing.T) {
 		}
 
 		buf = aw.Bytes()
+	}
+
+	write()
+	t.Run("without allocations", func(t *testing.T) {
+		testutil.WithoutAllocations(t, write)
 	})
 
 	const expectedValue = "036b6579080576616c7565"
@@ -93,6 +93,22 @@ func PutVarint(b []byte, i uint64) (int, error) {
 	return n, nil
 }
 
+// VarintSize returns the amount of bytes PutVarint needs to encode i.
+func VarintSize(i uint64) int {
+	if i < 240 {
+		return 1
+	}
+
+	n := 1
+	i = (i - 240) >> 4
+	for i >= 128 {
+		n++
+		i = (i - 128) >> 7
+	}
+
+	return n + 1
+}
+
 func Varint(b []byte) (uint64, int, error) {
 	if len(b) == 0 {
 		return 0, 0, ErrUnterminatedSequence
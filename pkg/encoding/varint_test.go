@@ -35,3 +35,21 @@ func Test_encode(t *testing.T) {
 		})
 	}
 }
+
+func TestVarintSize(t *testing.T) {
+	for _, v := range []uint64{0, 1, 239, 240, 2287, 2288, 1 << 20, 1<<32 - 1, 1<<64 - 1} {
+		b := make([]byte, 10)
+		n, err := PutVarint(b, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size := VarintSize(v); size != n {
+			t.Errorf("VarintSize(%d) = %d, PutVarint wrote %d bytes", v, size, n)
+		}
+
+		if _, err := PutVarint(b[:n-1], v); err != ErrInsufficientSpace {
+			t.Errorf("PutVarint(%d) into %d bytes: expected ErrInsufficientSpace, got %v", v, n-1, err)
+		}
+	}
+}
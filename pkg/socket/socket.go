@@ -0,0 +1,181 @@
+// Package socket opens the listeners of agents and peers. Besides TCP it
+// supports unix sockets and sockets passed by systemd socket activation.
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Network returns the network and address of addr, which may be prefixed
+// like an address in the HAProxy configuration:
+//
+//	unix@/run/agent.sock    unix socket
+//	ipv4@127.0.0.1:9000     TCP over IPv4 only
+//	ipv6@[::1]:9000         TCP over IPv6 only
+//
+// Addresses without prefix are TCP addresses.
+func Network(addr string) (network, address string) {
+	prefix, address, ok := strings.Cut(addr, "@")
+	if !ok {
+		return "tcp", addr
+	}
+
+	switch prefix {
+	case "unix":
+		return "unix", address
+	case "ipv4":
+		return "tcp4", address
+	case "ipv6":
+		return "tcp6", address
+	default:
+		return "tcp", addr
+	}
+}
+
+// Listen opens a listener on addr in the syntax of Network.
+//
+// A unix socket left over by a process that did not clean up is removed,
+// while a socket that still accepts connections is an error. The
+// permissions of the socket are set to mode if it is not zero, the socket
+// is not accessible before. The socket is removed when the listener is
+// closed.
+func Listen(addr string, mode fs.FileMode) (net.Listener, error) {
+	network, address := Network(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStale(address); err != nil {
+		return nil, err
+	}
+
+	if mode == 0 {
+		return net.Listen(network, address)
+	}
+
+	// The socket is created without permissions, so it is not reachable
+	// with the permissions of the umask until its mode is set.
+	var l net.Listener
+	err := withoutPermissions(func() (err error) {
+		l, err = net.Listen(network, address)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(address, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+
+	return l, nil
+}
+
+// removeStale removes the unix socket at path if no process listens on it.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	nc, err := net.Dial("unix", path)
+	if err == nil {
+		nc.Close()
+		return fmt.Errorf("%s: %w", path, syscall.EADDRINUSE)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing stale socket: %w", err)
+	}
+	return nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Systemd returns the listeners passed by systemd socket activation, in
+// the order of the sockets in the socket unit. It returns no listeners if
+// the process was not socket activated. The environment variables of
+// socket activation are unset, so they are not inherited by children.
+func Systemd() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener duplicates the descriptor, so the file is closed
+		// either way.
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// ServeAll calls serve for every listener concurrently. It returns the
+// error of the first call returning, after closing all listeners and
+// waiting for the other calls to return.
+func ServeAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	if len(listeners) == 0 {
+		return fmt.Errorf("no listeners")
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- serve(l)
+		}(l)
+	}
+
+	err := <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	for range listeners[1:] {
+		<-errs
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{":9000", "tcp", ":9000"},
+		{"unix@/run/agent.sock", "unix", "/run/agent.sock"},
+		{"ipv4@127.0.0.1:9000", "tcp4", "127.0.0.1:9000"},
+		{"ipv6@[::1]:9000", "tcp6", "[::1]:9000"},
+		{"foo@bar:9000", "tcp", "foo@bar:9000"},
+	}
+
+	for _, tt := range tests {
+		network, address := Network(tt.addr)
+		if network != tt.network || address != tt.address {
+			t.Errorf("Network(%q) = %q, %q, want %q, %q", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	l, err := Listen("unix@"+path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o660 {
+		t.Errorf("expected permissions 0660, got %v", perm)
+	}
+
+	if _, err := Listen("unix@"+path, 0); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected %v while listening, got %v", syscall.EADDRINUSE, err)
+	}
+
+	l.Close()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected socket to be removed on close, got %v", err)
+	}
+
+	// Leave a stale socket behind, like a killed process.
+	l, err = Listen("unix@"+path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = Listen("unix@"+path, 0)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %v", err)
+	}
+	l.Close()
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix@"+path, 0); err == nil {
+		t.Error("expected error for a file that is not a socket")
+	}
+}
+
+func TestWithoutPermissions(t *testing.T) {
+	dir := t.TempDir()
+
+	created := filepath.Join(dir, "created")
+	if err := withoutPermissions(func() error {
+		return os.WriteFile(created, nil, 0o666)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0 {
+		t.Errorf("expected no permissions, got %v", perm)
+	}
+
+	// The umask is restored afterwards.
+	after := filepath.Join(dir, "after")
+	if err := os.WriteFile(after, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(after); err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected permissions 0600, got %v", perm)
+	}
+}
+
+func TestSystemd(t *testing.T) {
+	if os.Getenv("SOCKET_TEST_SYSTEMD") != "" {
+		systemdChild()
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The child is the test binary, which sets LISTEN_PID itself as its
+	// pid is only known after the start.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemd$")
+	cmd.Env = append(os.Environ(), "SOCKET_TEST_SYSTEMD=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=spop")
+	cmd.ExtraFiles = []*os.File{f}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	if got, want := string(out), fmt.Sprintf("listener %s\n", l.Addr()); !strings.HasPrefix(got, want) {
+		t.Errorf("expected child output %q, got %q", want, got)
+	}
+}
+
+// systemdChild prints the address of the listener passed by TestSystemd.
+func systemdChild() {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	ls, err := Systemd()
+	if err != nil || len(ls) != 1 {
+		fmt.Println("unexpected listeners", ls, err)
+		os.Exit(1)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		fmt.Println("environment not unset")
+		os.Exit(1)
+	}
+
+	fmt.Printf("listener %s\n", ls[0].Addr())
+	os.Exit(0)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package socket
+
+// withoutPermissions calls fn, there is no umask to restrict.
+func withoutPermissions(fn func() error) error {
+	return fn()
+}
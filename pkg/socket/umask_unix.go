@@ -0,0 +1,15 @@
+//go:build unix
+
+package socket
+
+import "syscall"
+
+// withoutPermissions calls fn with a umask that denies all permissions,
+// so files created by fn are not accessible until their mode is set.
+// The umask is process wide and restored afterwards.
+func withoutPermissions(fn func() error) error {
+	old := syscall.Umask(0o777)
+	defer syscall.Umask(old)
+
+	return fn()
+}
@@ -11,6 +11,10 @@ func WithoutAllocations(tb testing.TB, fn func()) {
 }
 
 func WithNAllocations(tb testing.TB, n uint64, fn func()) {
+	if raceEnabled {
+		tb.Skip("allocation counts are unreliable under -race")
+	}
+
 	avg := testing.AllocsPerRun(runsPerTest, fn)
 
 	// early exit when failed
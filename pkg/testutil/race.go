@@ -0,0 +1,7 @@
+//go:build race
+
+package testutil
+
+// raceEnabled is set when the race detector is enabled, which randomly
+// drops pooled objects and therefore causes allocations.
+const raceEnabled = true
@@ -0,0 +1,104 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// CA issues certificates for tests.
+type CA struct {
+	Pool *x509.CertPool
+
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial atomic.Int64
+}
+
+func NewCA(tb testing.TB) *CA {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ca := &CA{Pool: x509.NewCertPool(), cert: cert, key: key}
+	ca.Pool.AddCert(cert)
+	ca.serial.Store(1)
+	return ca
+}
+
+// Issue returns a certificate for the common name, valid for localhost
+// and for client and server authentication.
+func (ca *CA) Issue(tb testing.TB, cn string) tls.Certificate {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial.Add(1)),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// ServerConfig returns the configuration of a server with a certificate
+// for the common name, requiring client certificates issued by the CA.
+func (ca *CA) ServerConfig(tb testing.TB, cn string) *tls.Config {
+	tb.Helper()
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.Issue(tb, cn)},
+		ClientCAs:    ca.Pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// ClientConfig returns the configuration of a client trusting the CA,
+// with a certificate for the common name unless it is empty. The server
+// is verified as localhost, as it may listen on any address.
+func (ca *CA) ClientConfig(tb testing.TB, cn string) *tls.Config {
+	tb.Helper()
+	config := &tls.Config{RootCAs: ca.Pool, ServerName: "localhost"}
+	if cn != "" {
+		config.Certificates = []tls.Certificate{ca.Issue(tb, cn)}
+	}
+	return config
+}
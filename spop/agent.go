@@ -2,18 +2,52 @@ package spop
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"math"
 	"net"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
 )
 
 type Agent struct {
 	Handler     Handler
 	BaseContext context.Context
 	Addr        string
+
+	// TLSConfig enables TLS for accepted connections if set, like the ssl
+	// option of a server in the SPOE backend. Set ClientAuth to verify
+	// the certificates of HAProxy, which are available to the handler
+	// with PeerCertificate.
+	TLSConfig *tls.Config
+	// SocketMode is the permission of the unix socket opened by
+	// ListenAndServe if Addr is a unix socket. The umask applies if zero.
+	SocketMode fs.FileMode
+
+	// MaxConns limits the number of concurrent connections if greater than
+	// zero. Further connections are closed with a resource allocation
+	// error.
+	MaxConns int
+	// HelloTimeout is the time allowed for HAProxy to send HAPROXY-HELLO
+	// after connecting. IdleTimeout is the time a connection without
+	// pending frames may wait for the next frame, and ReadTimeout the time
+	// allowed to receive a frame once it started to arrive. Connections
+	// exceeding them are closed with a timeout error. There is no timeout
+	// if zero.
+	HelloTimeout time.Duration
+	IdleTimeout  time.Duration
+	ReadTimeout  time.Duration
+
+	initOnce sync.Once
+	as       *asyncScheduler
+	conns    atomic.Int64
 }
 
 func ListenAndServe(addr string, handler Handler) error {
@@ -21,8 +55,10 @@ func ListenAndServe(addr string, handler Handler) error {
 	return a.ListenAndServe()
 }
 
+// ListenAndServe listens on Addr and serves the connections. Addr may be
+// a unix socket like unix@/run/agent.sock, see socket.Network.
 func (a *Agent) ListenAndServe() error {
-	l, err := net.Listen("tcp", a.Addr)
+	l, err := socket.Listen(a.Addr, a.SocketMode)
 	if err != nil {
 		return fmt.Errorf("opening listener: %w", err)
 	}
@@ -31,18 +67,38 @@ func (a *Agent) ListenAndServe() error {
 	return a.Serve(l)
 }
 
+// Serve accepts connections on l until BaseContext is done. Serve may be
+// called concurrently for several listeners, which share the scheduler of
+// the agent.
 func (a *Agent) Serve(l net.Listener) error {
-	a.Addr = l.Addr().String()
-	if a.BaseContext == nil {
-		a.BaseContext = context.Background()
-	}
+	return a.serve(l, a.TLSConfig)
+}
+
+// ServeListeners serves all listeners, for example those returned by
+// socket.Systemd. It returns the error of the first listener failing and
+// closes the others.
+func (a *Agent) ServeListeners(listeners []net.Listener) error {
+	return socket.ServeAll(listeners, a.Serve)
+}
+
+func (a *Agent) init(l net.Listener) {
+	a.initOnce.Do(func() {
+		a.Addr = l.Addr().String()
+		if a.BaseContext == nil {
+			a.BaseContext = context.Background()
+		}
+		a.as = newAsyncScheduler()
+	})
+}
+
+func (a *Agent) serve(l net.Listener, config *tls.Config) error {
+	a.init(l)
 
 	go func() {
 		<-a.BaseContext.Done()
 		l.Close()
 	}()
 
-	as := newAsyncScheduler()
 	for {
 		nc, err := l.Accept()
 		if err != nil {
@@ -60,9 +116,32 @@ func (a *Agent) Serve(l net.Listener) error {
 			}
 		}
 
-		p := newProtocolClient(a.BaseContext, nc, as, a.Handler)
+		if config != nil {
+			nc = tls.Server(nc, config)
+		}
+
+		if n := a.conns.Add(1); a.MaxConns > 0 && n > int64(a.MaxConns) {
+			a.conns.Add(-1)
+			go reject(nc, ErrorRes)
+			continue
+		}
+
 		go func() {
 			defer nc.Close()
+			// Released before closing, so closed connections do not count.
+			defer a.conns.Add(-1)
+
+			if err := tlsHandshake(a.BaseContext, nc); err != nil {
+				log.Println(err)
+				return
+			}
+
+			// Wrap the context to provide access to the underlying connection.
+			ctx := context.WithValue(a.BaseContext, connectionKey, nc)
+			p := newProtocolClient(ctx, nc, a.as, a.Handler)
+			p.helloTimeout = a.HelloTimeout
+			p.idleTimeout = a.IdleTimeout
+			p.readTimeout = a.ReadTimeout
 			defer p.Close()
 
 			// don't let panics inside the protocol kill the entire library
@@ -73,6 +152,19 @@ func (a *Agent) Serve(l net.Listener) error {
 	}
 }
 
+// rejectTimeout limits the time spent on rejecting a connection.
+const rejectTimeout = time.Second
+
+// reject closes the connection after sending an AGENT-DISCONNECT frame
+// with the error code.
+func reject(nc net.Conn, code errorCode) {
+	defer nc.Close()
+
+	_ = nc.SetDeadline(time.Now().Add(rejectTimeout))
+	// The frame is delivered on best effort, like in Close.
+	_, _ = (&AgentDisconnectFrame{ErrCode: code}).WriteTo(nc)
+}
+
 func wrapPanic(fn func() error) (err error) {
 	didPanic := true
 	defer func() {
@@ -0,0 +1,200 @@
+package spop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
+	"github.com/dropmorepackets/haproxy-go/pkg/testutil"
+)
+
+func TestAgentServeListeners(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tcp := testutil.TCPListener(t)
+	unixAddr := "unix@" + filepath.Join(t.TempDir(), "agent.sock")
+	unix, err := socket.Listen(unixAddr, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string, 1)
+	a := Agent{
+		BaseContext: ctx,
+		Handler: HandlerFunc(func(_ context.Context, _ *encoding.ActionWriter, m *encoding.Message) {
+			messages <- string(m.NameBytes())
+		}),
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.ServeListeners([]net.Listener{tcp, unix})
+	}()
+
+	for _, addr := range []string{tcp.Addr().String(), unixAddr} {
+		network, address := socket.Network(addr)
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err := newHelloFrame(conn, maxFrameSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAgentHello); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if err := newNotifyFrame(conn, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAck); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+
+		select {
+		case name := <-messages:
+			if name != "example" {
+				t.Errorf("%s: expected message example, got %q", addr, name)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for message")
+		}
+	}
+
+	cancel()
+	if err := <-serveErr; err == nil || !strings.Contains(err.Error(), "accepting conn") {
+		t.Errorf("expected accept error after cancel, got %v", err)
+	}
+}
+
+// readDisconnect reads an AGENT-DISCONNECT frame and returns its error code.
+func readDisconnect(r io.Reader) (errorCode, error) {
+	f := acquireFrame()
+	defer releaseFrame(f)
+
+	if _, err := f.readFrom(r, maxFrameSize); err != nil {
+		return 0, err
+	}
+	if f.frameType != frameTypeIDAgentDisconnect {
+		return 0, fmt.Errorf("expected frame type %d, got %d", frameTypeIDAgentDisconnect, f.frameType)
+	}
+
+	s := encoding.AcquireKVScanner(f.buf.ReadBytes(), -1)
+	defer encoding.ReleaseKVScanner(s)
+	k := encoding.AcquireKVEntry()
+	defer encoding.ReleaseKVEntry(k)
+
+	for s.Next(k) {
+		if k.NameEquals("status-code") {
+			return errorCode(k.ValueInt()), nil
+		}
+	}
+	return 0, fmt.Errorf("disconnect frame without status code: %v", s.Error())
+}
+
+// helloConn connects to the agent and exchanges the hello frames.
+func helloConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := newHelloFrame(conn, maxFrameSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := readExpectedFrame(conn, frameTypeIDAgentHello); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestAgentLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const timeout = 100 * time.Millisecond
+	a := Agent{
+		BaseContext:  ctx,
+		MaxConns:     2,
+		HelloTimeout: timeout,
+		IdleTimeout:  timeout,
+		ReadTimeout:  timeout,
+		Handler: HandlerFunc(func(_ context.Context, _ *encoding.ActionWriter, _ *encoding.Message) {
+			// Slow handlers do not make the connection idle.
+			time.Sleep(3 * timeout)
+		}),
+	}
+	l := testutil.TCPListener(t)
+	go a.Serve(l)
+	addr := l.Addr().String()
+
+	expectDisconnect := func(t *testing.T, conn net.Conn, want errorCode) {
+		t.Helper()
+		code, err := readDisconnect(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("expected disconnect with %q, got %q", want, code)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected connection to be closed, got %v", err)
+		}
+	}
+
+	t.Run("hello timeout", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		expectDisconnect(t, conn, ErrorTimeout)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn := helloConn(t, addr)
+		if err := newNotifyFrame(conn, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAck); err != nil {
+			t.Fatal(err)
+		}
+
+		expectDisconnect(t, conn, ErrorTimeout)
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		conn := helloConn(t, addr)
+		// Only the length of a frame arrives.
+		if _, err := conn.Write([]byte{0, 0, 0, 16}); err != nil {
+			t.Fatal(err)
+		}
+
+		expectDisconnect(t, conn, ErrorTimeout)
+	})
+
+	t.Run("max conns", func(t *testing.T) {
+		helloConn(t, addr)
+		helloConn(t, addr)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		expectDisconnect(t, conn, ErrorRes)
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
 )
@@ -16,6 +19,7 @@ func newProtocolClient(ctx context.Context, rw io.ReadWriter, as *asyncScheduler
 	c.handler = handler
 	c.ctx, c.ctxCancel = context.WithCancelCause(ctx)
 	c.as = as
+	c.fr.c = &c
 	return &c
 }
 
@@ -31,9 +35,23 @@ type protocolClient struct {
 	maxFrameSize uint32
 
 	gotHello bool
+
+	// The timeouts are only applied if rw supports read deadlines.
+	helloTimeout time.Duration
+	idleTimeout  time.Duration
+	readTimeout  time.Duration
+	fr           frameReader
+	// inFlight is the number of scheduled frames not yet handled.
+	inFlight atomic.Int32
 }
 
 func (c *protocolClient) Close() error {
+	return c.disconnect(ErrorUnknown, fmt.Errorf("closing client"))
+}
+
+// disconnect sends an AGENT-DISCONNECT frame with the error code and ends
+// the session with cause.
+func (c *protocolClient) disconnect(code errorCode, cause error) error {
 	if c.ctx.Err() != nil {
 		return c.ctx.Err()
 	}
@@ -41,14 +59,66 @@ func (c *protocolClient) Close() error {
 	// We ignore any error since the disconnect frame is delivered on
 	// best effort anyway.
 	_, _ = (&AgentDisconnectFrame{
-		ErrCode: ErrorUnknown,
+		ErrCode: code,
 	}).WriteTo(c.rw)
 
-	c.ctxCancel(fmt.Errorf("closing client"))
+	c.ctxCancel(cause)
 
 	return nil
 }
 
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// frameReader reads the frames of a client and switches from the idle
+// timeout to the read timeout once a frame starts to arrive.
+type frameReader struct {
+	c       *protocolClient
+	started bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	n, err := r.c.rw.Read(p)
+	if n > 0 && !r.started {
+		r.started = true
+		r.c.frameStarted()
+	}
+	return n, err
+}
+
+// setDeadline sets the read deadline to d from now, or removes it if d is
+// zero.
+func (c *protocolClient) setDeadline(d time.Duration) {
+	rd, ok := c.rw.(readDeadliner)
+	if !ok {
+		return
+	}
+
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	_ = rd.SetReadDeadline(t)
+}
+
+// waitFrame sets the deadline for the next frame to start to arrive.
+func (c *protocolClient) waitFrame() {
+	c.fr.started = false
+	// The hello timeout applies to the whole HAPROXY-HELLO frame and is
+	// set once by Serve.
+	if c.gotHello && (c.helloTimeout > 0 || c.idleTimeout > 0 || c.readTimeout > 0) {
+		c.setDeadline(c.idleTimeout)
+	}
+}
+
+// frameStarted sets the deadline for the rest of a frame to arrive.
+func (c *protocolClient) frameStarted() {
+	if c.gotHello && (c.idleTimeout > 0 || c.readTimeout > 0) {
+		c.setDeadline(c.readTimeout)
+	}
+}
+
 func (c *protocolClient) frameHandler(f *frame) error {
 	defer releaseFrame(f)
 
@@ -65,6 +135,12 @@ func (c *protocolClient) frameHandler(f *frame) error {
 }
 
 func (c *protocolClient) Serve() error {
+	if c.helloTimeout > 0 {
+		c.setDeadline(c.helloTimeout)
+	} else if c.readTimeout > 0 {
+		c.setDeadline(c.readTimeout)
+	}
+
 	for {
 		limit := uint32(maxFrameSize)
 		if c.gotHello {
@@ -72,7 +148,8 @@ func (c *protocolClient) Serve() error {
 		}
 
 		f := acquireFrame()
-		if _, err := f.readFrom(c.rw, limit); err != nil {
+		c.waitFrame()
+		if _, err := f.readFrom(&c.fr, limit); err != nil {
 			releaseFrame(f)
 			if c.ctx.Err() != nil {
 				return context.Cause(c.ctx)
@@ -82,6 +159,13 @@ func (c *protocolClient) Serve() error {
 				return nil
 			}
 
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if err := c.onTimeout(err); err != nil || c.ctx.Err() != nil {
+					return err
+				}
+				continue
+			}
+
 			return err
 		}
 
@@ -100,10 +184,32 @@ func (c *protocolClient) Serve() error {
 			continue
 		}
 
+		c.inFlight.Add(1)
 		c.as.schedule(f, c)
 	}
 }
 
+// onTimeout handles a read timeout of Serve. It returns nil if Serve
+// should continue or the idle session was closed.
+func (c *protocolClient) onTimeout(err error) error {
+	switch {
+	case !c.gotHello:
+		err = fmt.Errorf("hello timeout: %w", err)
+	case c.fr.started:
+		err = fmt.Errorf("frame read timeout: %w", err)
+	case c.inFlight.Load() > 0:
+		// The connection is not idle while HAProxy waits for ACK frames.
+		return nil
+	default:
+		// Closing idle connections is expected and not an error.
+		_ = c.disconnect(ErrorTimeout, nil)
+		return nil
+	}
+
+	_ = c.disconnect(ErrorTimeout, err)
+	return err
+}
+
 const (
 	version = "2.0"
 
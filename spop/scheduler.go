@@ -93,6 +93,7 @@ func (a *asyncScheduler) queueWorker() {
 		qe := a.q.Get()
 		// Use wrap panic to prevent loosing worker goroutines to panics
 		err := wrapPanic(func() error {
+			defer qe.pc.inFlight.Add(-1)
 			return qe.pc.frameHandler(qe.f)
 		})
 		if err != nil {
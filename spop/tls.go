@@ -0,0 +1,96 @@
+package spop
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/socket"
+)
+
+// tlsHandshakeTimeout limits the TLS handshake of accepted connections.
+const tlsHandshakeTimeout = 10 * time.Second
+
+func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
+	a := Agent{Addr: addr, Handler: handler}
+	return a.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeTLS is like ListenAndServe but accepts TLS connections.
+// The certificate and key are loaded from certFile and keyFile and added
+// to a copy of TLSConfig. They may be empty if TLSConfig already holds the
+// certificates.
+func (a *Agent) ListenAndServeTLS(certFile, keyFile string) error {
+	config := &tls.Config{}
+	if a.TLSConfig != nil {
+		config = a.TLSConfig.Clone()
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	l, err := socket.Listen(a.Addr, a.SocketMode)
+	if err != nil {
+		return fmt.Errorf("opening listener: %w", err)
+	}
+	defer l.Close()
+
+	return a.serve(l, config)
+}
+
+type contextKey string
+
+const connectionKey = contextKey("connection")
+
+// Connection returns the underlying connection used in calls to
+// functions in a Handler.
+func Connection(ctx context.Context) net.Conn {
+	nc, _ := ctx.Value(connectionKey).(net.Conn)
+	return nc
+}
+
+// ConnectionState returns the state of the TLS connection in calls to
+// functions in a Handler, or nil if the connection does not use TLS.
+func ConnectionState(ctx context.Context) *tls.ConnectionState {
+	tc, ok := Connection(ctx).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tc.ConnectionState()
+	return &state
+}
+
+// PeerCertificate returns the verified certificate of HAProxy in calls to
+// functions in a Handler. It returns nil if the connection does not use
+// TLS or HAProxy did not present a verified certificate.
+func PeerCertificate(ctx context.Context) *x509.Certificate {
+	state := ConnectionState(ctx)
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// tlsHandshake runs the TLS handshake of the connection, if it uses TLS.
+func tlsHandshake(ctx context.Context, nc net.Conn) error {
+	tc, ok := nc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("tls handshake: %w", err)
+	}
+	return nil
+}
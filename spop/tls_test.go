@@ -0,0 +1,74 @@
+package spop
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/dropmorepackets/haproxy-go/pkg/encoding"
+	"github.com/dropmorepackets/haproxy-go/pkg/testutil"
+)
+
+func TestAgentTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ca := testutil.NewCA(t)
+	certs := make(chan string, 1)
+	a := Agent{
+		BaseContext: ctx,
+		TLSConfig:   ca.ServerConfig(t, "agent.example"),
+		Handler: HandlerFunc(func(ctx context.Context, _ *encoding.ActionWriter, _ *encoding.Message) {
+			certs <- PeerCertificate(ctx).Subject.CommonName
+		}),
+	}
+	l := testutil.TCPListener(t)
+	go a.Serve(l)
+
+	t.Run("client certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), ca.ClientConfig(t, "haproxy.example"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err := newHelloFrame(conn, maxFrameSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAgentHello); err != nil {
+			t.Fatal(err)
+		}
+		if err := newNotifyFrame(conn, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAck); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case cn := <-certs:
+			if cn != "haproxy.example" {
+				t.Errorf("expected certificate haproxy.example, got %q", cn)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for message")
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), ca.ClientConfig(t, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// With TLS 1.3 the missing certificate is reported on the first read.
+		if err := newHelloFrame(conn, maxFrameSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := readExpectedFrame(conn, frameTypeIDAgentHello); err == nil {
+			t.Error("expected error without client certificate")
+		}
+	})
+}